@@ -0,0 +1,171 @@
+// Package client talks to the local-persist volume plugin over its socket, using the same
+// protocol as the Docker daemon.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// contentType is the content type of the volume plugin protocol.
+const contentType = "application/vnd.docker.plugins.v1.1+json"
+
+// Client calls the methods of the volume plugin. It is safe for concurrent use.
+type Client struct {
+	http *http.Client
+}
+
+// New returns a client for the plugin listening on the unix socket.
+func New(socket string) *Client {
+	return NewWithDialer(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	})
+}
+
+// NewFromEnvironment returns a client for the socket found by Discover.
+func NewFromEnvironment() (*Client, error) {
+	socket, err := Discover()
+	if err != nil {
+		return nil, err
+	}
+	return New(socket), nil
+}
+
+// NewWithDialer returns a client that connects to the plugin with dial.
+func NewWithDialer(dial func(ctx context.Context) (net.Conn, error)) *Client {
+	return &Client{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}}}
+}
+
+// Activate performs the plugin handshake and returns the implemented subsystems.
+func (c *Client) Activate(ctx context.Context) ([]string, error) {
+	var res struct {
+		Implements []string
+	}
+	if err := c.call(ctx, "/Plugin.Activate", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Implements, nil
+}
+
+// Create creates a volume.
+func (c *Client) Create(ctx context.Context, req *volume.CreateRequest) error {
+	return c.call(ctx, "/VolumeDriver.Create", req, nil)
+}
+
+// Remove removes a volume, its data is kept.
+func (c *Client) Remove(ctx context.Context, req *volume.RemoveRequest) error {
+	return c.call(ctx, "/VolumeDriver.Remove", req, nil)
+}
+
+// Get returns a volume.
+func (c *Client) Get(ctx context.Context, req *volume.GetRequest) (*volume.GetResponse, error) {
+	res := &volume.GetResponse{}
+	if err := c.call(ctx, "/VolumeDriver.Get", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// List returns every volume.
+func (c *Client) List(ctx context.Context) (*volume.ListResponse, error) {
+	res := &volume.ListResponse{}
+	if err := c.call(ctx, "/VolumeDriver.List", struct{}{}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Path returns the mountpoint of a volume.
+func (c *Client) Path(ctx context.Context, req *volume.PathRequest) (*volume.PathResponse, error) {
+	res := &volume.PathResponse{}
+	if err := c.call(ctx, "/VolumeDriver.Path", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Mount mounts a volume for the mount ID.
+func (c *Client) Mount(ctx context.Context, req *volume.MountRequest) (*volume.MountResponse, error) {
+	res := &volume.MountResponse{}
+	if err := c.call(ctx, "/VolumeDriver.Mount", req, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Unmount releases the mount of a volume for the mount ID.
+func (c *Client) Unmount(ctx context.Context, req *volume.UnmountRequest) error {
+	return c.call(ctx, "/VolumeDriver.Unmount", req, nil)
+}
+
+// Capabilities returns the capabilities of the plugin.
+func (c *Client) Capabilities(ctx context.Context) (*volume.CapabilitiesResponse, error) {
+	res := &volume.CapabilitiesResponse{}
+	if err := c.call(ctx, "/VolumeDriver.Capabilities", struct{}{}, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// call posts req to the plugin method and decodes the response into res.
+func (c *Client) call(ctx context.Context, method string, req interface{}, res interface{}) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://local-persist"+method, &body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", contentType)
+	r.Header.Set("Content-Type", contentType)
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e volume.ErrorResponse
+		if json.Unmarshal(data, &e) != nil || e.Err == "" {
+			e.Err = strings.TrimSpace(string(data))
+		}
+		return newError(method, resp.StatusCode, e.Err)
+	}
+
+	// Errors may also be reported with status 200
+	var e volume.ErrorResponse
+	if json.Unmarshal(data, &e) == nil && e.Err != "" {
+		return newError(method, resp.StatusCode, e.Err)
+	}
+
+	if res == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, res); err != nil {
+		return fmt.Errorf("%s: invalid response: %w", method, err)
+	}
+	return nil
+}
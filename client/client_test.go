@@ -0,0 +1,227 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Carbonique/local-persist/client"
+	"github.com/Carbonique/local-persist/client/clienttest"
+	"github.com/Carbonique/local-persist/driver"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// serveDriver serves the real driver, like the plugin does, on a unix socket in a temporary
+// directory. A non-empty config is written to its configuration file first.
+func serveDriver(t *testing.T, config string) (*client.Client, string) {
+	dir := t.TempDir()
+	if config != "" {
+		if err := os.MkdirAll(filepath.Join(dir, "state"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "state", driver.CONFIGFILE), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := driver.NewLocalPersistDriver(filepath.Join(dir, "state"), filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "local-persist.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go volume.NewHandler(d.Instrumented()).Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	return client.New(socket), filepath.Join(dir, "data")
+}
+
+func TestClient(t *testing.T) {
+	real, data := serveDriver(t, "")
+	server := clienttest.NewServer()
+	defer server.Close()
+
+	for _, c := range []struct {
+		name   string
+		client *client.Client
+		root   string
+	}{{"driver", real, data}, {"clienttest", server.Client(), clienttest.ROOT}} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			implements, err := c.client.Activate(ctx)
+			if err != nil || len(implements) != 1 || implements[0] != "VolumeDriver" {
+				t.Fatalf("Activate() = %v, %v", implements, err)
+			}
+
+			if err := c.client.Create(ctx, &volume.CreateRequest{Name: "test", Options: map[string]string{}}); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			res, err := c.client.Get(ctx, &volume.GetRequest{Name: "test"})
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if res.Volume.Mountpoint != filepath.Join(c.root, "test") {
+				t.Errorf("Get() mountpoint = %s, want %s", res.Volume.Mountpoint, filepath.Join(c.root, "test"))
+			}
+
+			list, err := c.client.List(ctx)
+			if err != nil || len(list.Volumes) != 1 {
+				t.Fatalf("List() = %v, %v", list, err)
+			}
+
+			mount, err := c.client.Mount(ctx, &volume.MountRequest{Name: "test", ID: "one"})
+			if err != nil || mount.Mountpoint != res.Volume.Mountpoint {
+				t.Fatalf("Mount() = %v, %v", mount, err)
+			}
+			if err := c.client.Unmount(ctx, &volume.UnmountRequest{Name: "test", ID: "one"}); err != nil {
+				t.Fatalf("Unmount() error = %v", err)
+			}
+
+			caps, err := c.client.Capabilities(ctx)
+			if err != nil || caps.Capabilities.Scope != "local" {
+				t.Fatalf("Capabilities() = %v, %v", caps, err)
+			}
+
+			tests := []struct {
+				name string
+				call func() error
+				want error
+			}{
+				{"Create existing volume", func() error {
+					return c.client.Create(ctx, &volume.CreateRequest{Name: "test", Options: map[string]string{}})
+				}, client.ErrAlreadyExists},
+				{"Create outside of the data directory", func() error {
+					return c.client.Create(ctx, &volume.CreateRequest{Name: "escape", Options: map[string]string{"mountpoint": "../escape"}})
+				}, client.ErrPathContainment},
+				{"Get unknown volume", func() error {
+					_, err := c.client.Get(ctx, &volume.GetRequest{Name: "unknown"})
+					return err
+				}, client.ErrNotFound},
+				{"Path of unknown volume", func() error {
+					_, err := c.client.Path(ctx, &volume.PathRequest{Name: "unknown"})
+					return err
+				}, client.ErrNotFound},
+				{"Mount unknown volume", func() error {
+					_, err := c.client.Mount(ctx, &volume.MountRequest{Name: "unknown", ID: "one"})
+					return err
+				}, client.ErrNotFound},
+				{"Remove unknown volume", func() error {
+					return c.client.Remove(ctx, &volume.RemoveRequest{Name: "unknown"})
+				}, client.ErrNotFound},
+			}
+			for _, tt := range tests {
+				err := tt.call()
+				if !errors.Is(err, tt.want) {
+					t.Errorf("%s: error = %v, want %v", tt.name, err, tt.want)
+				}
+				var e *client.Error
+				if !errors.As(err, &e) || e.Message == "" {
+					t.Errorf("%s: error = %#v, want a *client.Error", tt.name, err)
+				}
+			}
+
+			if err := c.client.Remove(ctx, &volume.RemoveRequest{Name: "test"}); err != nil {
+				t.Fatalf("Remove() error = %v", err)
+			}
+		})
+	}
+}
+
+// TestClient_driverErrors checks the recognised kinds against messages only the driver gives, so
+// changing one of them breaks the client.
+func TestClient_driverErrors(t *testing.T) {
+	host := filepath.Join(t.TempDir(), "host")
+	if err := os.MkdirAll(filepath.Join(host, "docker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A symlink inside the allowed prefix pointing outside of it
+	if err := os.Symlink("..", filepath.Join(host, "docker", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := serveDriver(t, `{"allowedPrefixes": ["/srv/docker"], "hostPath": "/srv", "hostMount": "`+host+`"}`)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"Create through a symlink out of an allowed prefix", func() error {
+			return c.Create(ctx, &volume.CreateRequest{Name: "escape", Options: map[string]string{"mountpoint": "/srv/docker/escape/app"}})
+		}, client.ErrPathContainment},
+		{"Create with an invalid option", func() error {
+			return c.Create(ctx, &volume.CreateRequest{Name: "invalid", Options: map[string]string{"ephemeral": "sometimes"}})
+		}, nil},
+	}
+	for _, tt := range tests {
+		err := tt.call()
+		var e *client.Error
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: error = %#v, want a *client.Error", tt.name, err)
+		}
+		if e.Unwrap() != tt.want {
+			t.Errorf("%s: error = %v, kind %v, want %v", tt.name, err, e.Unwrap(), tt.want)
+		}
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	server := clienttest.NewServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := server.Client().List(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("List() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	t.Setenv(client.SOCKETENV, "")
+	dir := t.TempDir()
+
+	listen := func(p string) {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("unix", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+	}
+
+	if _, err := client.DiscoverIn(dir); err == nil {
+		t.Errorf("DiscoverIn() without socket should fail")
+	}
+
+	managed := filepath.Join(dir, "0123abcd", client.SOCKET)
+	listen(managed)
+	if got, err := client.DiscoverIn(dir); err != nil || got != managed {
+		t.Errorf("DiscoverIn() = %s, %v, want %s", got, err, managed)
+	}
+
+	listen(filepath.Join(dir, "4567ef01", client.SOCKET))
+	if _, err := client.DiscoverIn(dir); err == nil {
+		t.Errorf("DiscoverIn() with two managed sockets should fail")
+	}
+
+	legacy := filepath.Join(dir, client.SOCKET)
+	listen(legacy)
+	if got, err := client.DiscoverIn(dir); err != nil || got != legacy {
+		t.Errorf("DiscoverIn() = %s, %v, want %s", got, err, legacy)
+	}
+
+	t.Setenv(client.SOCKETENV, "/somewhere/else.sock")
+	if got, _ := client.DiscoverIn(dir); got != "/somewhere/else.sock" {
+		t.Errorf("DiscoverIn() = %s, want the socket of %s", got, client.SOCKETENV)
+	}
+}
@@ -0,0 +1,238 @@
+// Package clienttest provides an in-memory volume plugin for testing code that uses the client
+// package, without a socket or a data directory.
+package clienttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Carbonique/local-persist/client"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// ROOT is the data directory of the in-memory plugin.
+const ROOT = "/local-persist/data"
+
+// Server serves an in-memory volume plugin. Its errors have the messages of the real driver, so
+// clients can match them with errors.Is.
+type Server struct {
+	Driver *Driver
+
+	listener *pipeListener
+	done     chan struct{}
+}
+
+// NewServer starts a server with no volumes.
+func NewServer() *Server {
+	s := &Server{
+		Driver:   &Driver{volumes: map[string]*memVolume{}},
+		listener: newPipeListener(),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		volume.NewHandler(s.Driver).Serve(s.listener)
+	}()
+	return s
+}
+
+// Client returns a client connected to the server.
+func (s *Server) Client() *client.Client {
+	return client.NewWithDialer(s.listener.dial)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.listener.Close()
+	<-s.done
+}
+
+// Driver is an in-memory volume.Driver.
+type Driver struct {
+	sync.Mutex
+	volumes map[string]*memVolume
+}
+
+type memVolume struct {
+	mountpoint string
+	createdAt  string
+	mounts     []string
+}
+
+// Create creates a volume in ROOT, at the mountpoint option or named after the volume.
+func (d *Driver) Create(req *volume.CreateRequest) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.volumes[req.Name]; ok {
+		return fmt.Errorf("the volume %s already exists", req.Name)
+	}
+
+	mountpoint := req.Options["mountpoint"]
+	if mountpoint == "" {
+		mountpoint = req.Name
+	}
+	if !filepath.IsAbs(mountpoint) {
+		mountpoint = filepath.Join(ROOT, mountpoint)
+	}
+	mountpoint = filepath.Clean(mountpoint)
+	if !strings.HasPrefix(mountpoint, ROOT+string(filepath.Separator)) {
+		return fmt.Errorf("targetpath %s is not relative to basepath %s", mountpoint, ROOT)
+	}
+
+	d.volumes[req.Name] = &memVolume{mountpoint: mountpoint, createdAt: time.Now().Format(time.RFC3339)}
+	return nil
+}
+
+// List returns every volume, sorted by name.
+func (d *Driver) List() (*volume.ListResponse, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	res := &volume.ListResponse{}
+	for name, v := range d.volumes {
+		res.Volumes = append(res.Volumes, &volume.Volume{Name: name, Mountpoint: v.mountpoint, CreatedAt: v.createdAt})
+	}
+	sort.Slice(res.Volumes, func(i, j int) bool { return res.Volumes[i].Name < res.Volumes[j].Name })
+	return res, nil
+}
+
+// Get returns a volume.
+func (d *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.volumes[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("no volume found with the name %s", req.Name)
+	}
+	return &volume.GetResponse{Volume: &volume.Volume{Name: req.Name, Mountpoint: v.mountpoint, CreatedAt: v.createdAt}}, nil
+}
+
+// Remove removes a volume that is not mounted.
+func (d *Driver) Remove(req *volume.RemoveRequest) error {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.volumes[req.Name]
+	if !ok {
+		return fmt.Errorf("error deleting volume %s failed as it does not exist", req.Name)
+	}
+	if len(v.mounts) > 0 {
+		return fmt.Errorf("error deleting volume %s failed: it is in use", req.Name)
+	}
+	delete(d.volumes, req.Name)
+	return nil
+}
+
+// Path returns the mountpoint of a volume.
+func (d *Driver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.volumes[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", req.Name)
+	}
+	return &volume.PathResponse{Mountpoint: v.mountpoint}, nil
+}
+
+// Mount records the mount ID.
+func (d *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.volumes[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", req.Name)
+	}
+	v.mounts = append(v.mounts, req.ID)
+	return &volume.MountResponse{Mountpoint: v.mountpoint}, nil
+}
+
+// Unmount forgets the mount ID.
+func (d *Driver) Unmount(req *volume.UnmountRequest) error {
+	d.Lock()
+	defer d.Unlock()
+
+	v, ok := d.volumes[req.Name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", req.Name)
+	}
+	for i, id := range v.mounts {
+		if id == req.ID {
+			v.mounts = append(v.mounts[:i], v.mounts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Capabilities reports the local scope, like the real driver.
+func (d *Driver) Capabilities() *volume.CapabilitiesResponse {
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "local"}}
+}
+
+// Mounts returns the active mount IDs of a volume.
+func (d *Driver) Mounts(name string) []string {
+	d.Lock()
+	defer d.Unlock()
+
+	if v, ok := d.volumes[name]; ok {
+		return append([]string(nil), v.mounts...)
+	}
+	return nil
+}
+
+// pipeListener is a net.Listener of in-memory connections.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial(ctx context.Context) (net.Conn, error) {
+	server, conn := net.Pipe()
+	select {
+	case l.conns <- server:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("server closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "local-persist" }
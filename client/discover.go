@@ -0,0 +1,61 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SOCKETENV overrides the socket found by Discover.
+const SOCKETENV = "LOCAL_PERSIST_SOCKET"
+
+// PLUGINSOCKETDIR is the directory Docker looks for plugin sockets in.
+const PLUGINSOCKETDIR = "/run/docker/plugins"
+
+// SOCKET is the name of the socket of the plugin.
+const SOCKET = "local-persist.sock"
+
+// Discover returns the socket of the plugin: the socket in SOCKETENV, the socket of a legacy
+// install in PLUGINSOCKETDIR, or the socket of the managed plugin in PLUGINSOCKETDIR/<plugin id>.
+func Discover() (string, error) {
+	return DiscoverIn(PLUGINSOCKETDIR)
+}
+
+// DiscoverIn is Discover with another plugin socket directory.
+func DiscoverIn(dir string) (string, error) {
+	if socket := os.Getenv(SOCKETENV); socket != "" {
+		return socket, nil
+	}
+
+	legacy := filepath.Join(dir, SOCKET)
+	if isSocket(legacy) {
+		return legacy, nil
+	}
+
+	managed, err := filepath.Glob(filepath.Join(dir, "*", SOCKET))
+	if err != nil {
+		return "", err
+	}
+	var sockets []string
+	for _, socket := range managed {
+		if isSocket(socket) {
+			sockets = append(sockets, socket)
+		}
+	}
+	sort.Strings(sockets)
+
+	switch len(sockets) {
+	case 0:
+		return "", fmt.Errorf("no %s found in %s, set %s", SOCKET, dir, SOCKETENV)
+	case 1:
+		return sockets[0], nil
+	default:
+		return "", fmt.Errorf("found more than one %s (%v), set %s", SOCKET, sockets, SOCKETENV)
+	}
+}
+
+func isSocket(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode()&os.ModeSocket != 0
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+var (
+	// ErrNotFound is matched by errors for volumes that do not exist.
+	ErrNotFound = errors.New("volume not found")
+	// ErrAlreadyExists is matched by errors for creating a volume that already exists.
+	ErrAlreadyExists = errors.New("volume already exists")
+	// ErrPathContainment is matched by errors for mountpoints outside of the pools and allowed prefixes.
+	ErrPathContainment = errors.New("path not contained")
+)
+
+// The protocol only transports the message of an error, so the kind of an error is recognised by
+// the messages of the driver.
+var kinds = []struct {
+	pattern *regexp.Regexp
+	err     error
+}{
+	{regexp.MustCompile(`^no volume found with the name |^volume \S+ not found$|^error deleting volume \S+ failed as it does not exist$`), ErrNotFound},
+	{regexp.MustCompile(`^the volume \S+ already exists$`), ErrAlreadyExists},
+	{regexp.MustCompile(`is not relative to basepath|is not inside`), ErrPathContainment},
+}
+
+// Error is an error returned by the plugin.
+type Error struct {
+	// Method is the called plugin method, e.g. /VolumeDriver.Create.
+	Method string
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Message is the error message of the plugin.
+	Message string
+
+	kind error
+}
+
+func newError(method string, status int, message string) *Error {
+	e := &Error{Method: method, StatusCode: status, Message: message}
+	for _, k := range kinds {
+		if k.pattern.MatchString(message) {
+			e.kind = k.err
+			break
+		}
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Message)
+}
+
+// Unwrap returns ErrNotFound, ErrAlreadyExists, ErrPathContainment or nil.
+func (e *Error) Unwrap() error {
+	return e.kind
+}
@@ -0,0 +1,476 @@
+package driver
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ADMINSOCKET is the default unix socket of the admin API, created in the state directory.
+const ADMINSOCKET = "local-persist-admin.sock"
+
+// STATELOCKFILE in the state directory is locked by the running plugin, and by the commands that
+// change the state of a stopped plugin while they run. It contains the process ID of the holder.
+const STATELOCKFILE = "local-persist.lock"
+
+// ADMINAPIVERSION is the version of the admin API, it prefixes every path and is sent in the
+// Api-Version header of every response.
+const ADMINAPIVERSION = "1"
+
+// openAPI describes the admin API.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// errVolumeNotFound is reported by the admin API for unknown volumes.
+var errVolumeNotFound = errors.New("volume not found")
+
+// VolumeInfo describes a volume in the admin API.
+type VolumeInfo struct {
+	Name       string                 `json:"name"`
+	Mountpoint string                 `json:"mountpoint"`
+	CreatedAt  string                 `json:"createdAt"`
+	Pool       string                 `json:"pool"`
+	Backend    string                 `json:"backend"`
+	Mounts     int                    `json:"mounts"`
+	Status     map[string]interface{} `json:"status,omitempty"`
+}
+
+// volumeInfo returns the description of a volume, the driver has to be locked.
+func (driver *localPersistDriver) volumeInfo(name string, v *localPersistVolume) VolumeInfo {
+	info := VolumeInfo{
+		Name:       name,
+		Mountpoint: v.Mountpoint,
+		CreatedAt:  v.CreatedAt,
+		Pool:       v.Pool,
+		Backend:    v.Backend,
+		Mounts:     len(v.Mounts),
+		Status:     driver.status(name, v),
+	}
+	if info.Pool == "" {
+		info.Pool = DEFAULTPOOL
+	}
+	if info.Backend == "" {
+		info.Backend = BACKENDDIRECTORY
+	}
+	return info
+}
+
+// Volumes describes every volume, sorted by name.
+func (driver *localPersistDriver) Volumes() []VolumeInfo {
+	log.Debug("Volumes called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	infos := []VolumeInfo{}
+	for name, v := range driver.volumes {
+		infos = append(infos, driver.volumeInfo(name, v))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Volume describes a single volume.
+func (driver *localPersistDriver) Volume(name string) (VolumeInfo, error) {
+	log.Debug("Volume called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return VolumeInfo{}, fmt.Errorf("volume %s: %w", name, errVolumeNotFound)
+	}
+	return driver.volumeInfo(name, v), nil
+}
+
+// LockState locks the state in statePath for the running plugin, or for a command that changes
+// the state of a stopped plugin, and returns the function releasing the lock. It fails when the
+// state is locked already, or when the admin socket of a plugin answers, e.g. one that does not
+// lock the state yet. The lock is released when the process exits.
+func LockState(statePath string) (func(), error) {
+	if err := ensureDir(statePath, 0700); err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(statePath, STATELOCKFILE)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			holder, _ := os.ReadFile(lockPath)
+			return nil, fmt.Errorf("the state in %s is locked by process %s, the plugin or another command is running; disable the plugin first", statePath, strings.TrimSpace(string(holder)))
+		}
+		return nil, err
+	}
+	release := func() {
+		f.Truncate(0)
+		f.Close()
+	}
+
+	if err := f.Truncate(0); err != nil {
+		release()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		release()
+		return nil, err
+	}
+
+	config, err := loadConfig(statePath)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	driver := &localPersistDriver{stateFilePath: filepath.Join(statePath, STATEFILE), config: config}
+	socket := driver.adminSocket()
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		release()
+		return nil, fmt.Errorf("the plugin is running, its admin socket %s answers; disable the plugin first", socket)
+	}
+
+	return release, nil
+}
+
+// RequireStopped returns an error when the plugin using the state in statePath is running, or
+// another command changes its state, see LockState.
+func RequireStopped(statePath string) error {
+	release, err := LockState(statePath)
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// adminSocket returns the path of the admin socket.
+func (driver *localPersistDriver) adminSocket() string {
+	if driver.config.AdminSocket != "" {
+		return driver.config.AdminSocket
+	}
+	return filepath.Join(filepath.Dir(driver.stateFilePath), ADMINSOCKET)
+}
+
+// ServeAdmin serves the admin API on its unix socket, which only root can connect to.
+func (driver *localPersistDriver) ServeAdmin() error {
+	socket := driver.adminSocket()
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	log.Infof("Serving the admin API on %s", socket)
+
+	server := &http.Server{
+		Handler: driver.AdminHandler(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, adminActorKey{}, peerActor(c))
+		},
+	}
+	return server.Serve(l)
+}
+
+// AdminHandler returns the handler of the admin API.
+func (driver *localPersistDriver) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	prefix := "/v" + ADMINAPIVERSION
+	// Volumes are created like the volume plugin does, serveAudited records them in the audit log
+	instrumented := &instrumentedDriver{driver: driver}
+
+	mux.HandleFunc("GET "+prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPI)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, driver.Volumes())
+	})
+	mux.HandleFunc("POST "+prefix+"/volumes", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name    string            `json:"name"`
+			Options map[string]string `json:"options"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Options == nil {
+			req.Options = map[string]string{}
+		}
+		if err := instrumented.Create(&volume.CreateRequest{Name: req.Name, Options: req.Options}); err != nil {
+			writeError(w, err)
+			return
+		}
+		driver.writeVolume(w, http.StatusCreated, req.Name)
+	})
+	mux.HandleFunc("POST "+prefix+"/adopt", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if err := driver.Adopt(req.Name, req.Path); err != nil {
+			writeError(w, err)
+			return
+		}
+		driver.writeVolume(w, http.StatusCreated, req.Name)
+	})
+	mux.HandleFunc("GET "+prefix+"/volumes/{name}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := driver.Volume(r.PathValue("name"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/volumes/{name}/snapshots", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		snapshots, err := driver.Snapshots(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if snapshots == nil {
+			snapshots = []string{}
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/snapshots", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		snapshot, err := driver.Snapshot(name, req.Name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"name": snapshot})
+	}))
+	mux.HandleFunc("DELETE "+prefix+"/volumes/{name}/snapshots/{snapshot}", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		writeResult(w, driver.DeleteSnapshot(name, r.PathValue("snapshot")))
+	}))
+
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/forget", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		writeResult(w, driver.Forget(name))
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/purge", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		writeResult(w, driver.Purge(name))
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/reset", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		writeResult(w, driver.Reset(name))
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/resize", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		var change QuotaChange
+		if !readJSON(w, r, &change) {
+			return
+		}
+		writeResult(w, driver.Resize(name, change))
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/move", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		var req struct {
+			Pool       string `json:"pool"`
+			Mountpoint string `json:"mountpoint"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		mountpoint, err := driver.Move(name, req.Pool, req.Mountpoint)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"mountpoint": mountpoint})
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/rename", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		var req struct {
+			Name    string `json:"name"`
+			MoveDir bool   `json:"moveDir"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		writeResult(w, driver.Rename(name, req.Name, req.MoveDir))
+	}))
+	mux.HandleFunc("POST "+prefix+"/volumes/{name}/cleanup", driver.withVolume(func(w http.ResponseWriter, r *http.Request, name string) {
+		dirs, err := driver.CleanMountDirs(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if dirs == nil {
+			dirs = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"removed": dirs})
+	}))
+
+	mux.HandleFunc("GET "+prefix+"/trash", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := driver.TrashEntries()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+	mux.HandleFunc("DELETE "+prefix+"/trash", func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, adminError{"the path parameter is missing"})
+			return
+		}
+		writeResult(w, driver.DeleteTrash(path))
+	})
+
+	mux.HandleFunc("GET "+prefix+"/drift", func(w http.ResponseWriter, r *http.Request) {
+		report, err := driver.Drift()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("POST "+prefix+"/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		var opts ReconcileOptions
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		report, err := driver.Reconcile(opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/state", func(w http.ResponseWriter, r *http.Request) {
+		state, err := driver.ExportState()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(state)
+	})
+
+	mux.HandleFunc("GET "+prefix+"/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, driver.config)
+	})
+	mux.HandleFunc("GET "+prefix+"/pools", func(w http.ResponseWriter, r *http.Request) {
+		infos, err := driver.Pools()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusNotFound, adminError{fmt.Sprintf("%s %s not found", r.Method, r.URL.Path)})
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("Admin API %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Api-Version", ADMINAPIVERSION)
+		if r.Method == http.MethodGet {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		driver.serveAudited(mux, w, r)
+	})
+}
+
+// withVolume responds with 404 to requests for volumes that do not exist.
+func (driver *localPersistDriver) withVolume(handler func(w http.ResponseWriter, r *http.Request, name string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if _, err := driver.Volume(name); err != nil {
+			writeError(w, err)
+			return
+		}
+		handler(w, r, name)
+	}
+}
+
+// writeVolume responds with the description of a volume.
+func (driver *localPersistDriver) writeVolume(w http.ResponseWriter, status int, name string) {
+	info, err := driver.Volume(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, info)
+}
+
+// adminError is the body of every failed admin API request.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// readJSON decodes the optional request body, and responds with 400 if it is invalid.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{fmt.Sprintf("invalid request body: %s", err)})
+		return false
+	}
+	return true
+}
+
+// writeResult responds with 204 to successful requests without a result.
+func writeResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError responds with 404 for unknown volumes, and with 409 for refused operations.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusConflict
+	if errors.Is(err, errVolumeNotFound) {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, adminError{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Could not write admin API response: %s", err)
+	}
+}
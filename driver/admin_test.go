@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_AdminHandler(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	for _, req := range []*volume.CreateRequest{
+		{Name: "first", Options: map[string]string{}},
+		{Name: "second", Options: map[string]string{}},
+	} {
+		if err := driver.Create(req); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "second", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	if err := os.MkdirAll(path.Join(DATAPATH, "untracked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(DATAPATH, SNAPSHOTDIR, "first", "snap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(driver.AdminHandler())
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "OpenAPI description, should pass", method: "GET", path: "/v1/openapi.json", wantStatus: http.StatusOK, wantBody: `"openapi"`},
+		{name: "List volumes, should pass", method: "GET", path: "/v1/volumes", wantStatus: http.StatusOK, wantBody: `"name":"first"`},
+		{name: "Inspect volume, should pass", method: "GET", path: "/v1/volumes/second", wantStatus: http.StatusOK, wantBody: `"mounts":1`},
+		{name: "Inspect unknown volume, should fail", method: "GET", path: "/v1/volumes/unknown", wantStatus: http.StatusNotFound, wantBody: `"error"`},
+		{name: "List snapshots, should pass", method: "GET", path: "/v1/volumes/first/snapshots", wantStatus: http.StatusOK, wantBody: `["snap"]`},
+		{name: "Delete snapshot, should pass", method: "DELETE", path: "/v1/volumes/first/snapshots/snap", wantStatus: http.StatusNoContent},
+		{name: "Snapshot directory volume, should fail", method: "POST", path: "/v1/volumes/first/snapshots", body: `{"name":"other"}`, wantStatus: http.StatusConflict},
+		{name: "Snapshot unknown volume, should fail", method: "POST", path: "/v1/volumes/unknown/snapshots", wantStatus: http.StatusNotFound},
+		{name: "Invalid body, should fail", method: "POST", path: "/v1/volumes/first/snapshots", body: `{"unknown":true}`, wantStatus: http.StatusBadRequest},
+		{name: "Purge volume in use, should fail", method: "POST", path: "/v1/volumes/second/purge", wantStatus: http.StatusConflict},
+		{name: "Create volume, should pass", method: "POST", path: "/v1/volumes", body: `{"name":"third","options":{"mountpoint":"elsewhere"}}`, wantStatus: http.StatusCreated, wantBody: `"name":"third"`},
+		{name: "Create existing volume, should fail", method: "POST", path: "/v1/volumes", body: `{"name":"third"}`, wantStatus: http.StatusConflict},
+		{name: "Forget volume in use, should fail", method: "POST", path: "/v1/volumes/second/forget", wantStatus: http.StatusConflict},
+		{name: "Forget volume, should pass", method: "POST", path: "/v1/volumes/third/forget", wantStatus: http.StatusNoContent},
+		{name: "Adopt directory, should pass", method: "POST", path: "/v1/adopt", body: `{"name":"adopted","path":"` + path.Join(DATAPATH, "elsewhere") + `"}`, wantStatus: http.StatusCreated, wantBody: `"name":"adopted"`},
+		{name: "Export state, should pass", method: "GET", path: "/v1/state", wantStatus: http.StatusOK, wantBody: `"adopted"`},
+		{name: "Rename volume, should pass", method: "POST", path: "/v1/volumes/first/rename", body: `{"name":"renamed"}`, wantStatus: http.StatusNoContent},
+		{name: "Drift, should pass", method: "GET", path: "/v1/drift", wantStatus: http.StatusOK, wantBody: "untracked"},
+		{name: "Reconcile with adopt and trash, should fail", method: "POST", path: "/v1/reconcile", body: `{"adopt":true,"trash":true}`, wantStatus: http.StatusConflict},
+		{name: "Reconcile trashing untracked directories, should pass", method: "POST", path: "/v1/reconcile", body: `{"trash":true}`, wantStatus: http.StatusOK, wantBody: "untracked"},
+		{name: "List trash, should pass", method: "GET", path: "/v1/trash", wantStatus: http.StatusOK, wantBody: `"name":"untracked"`},
+		{name: "Delete outside of the trash, should fail", method: "DELETE", path: "/v1/trash?path=" + path.Join(DATAPATH, "second"), wantStatus: http.StatusConflict},
+		{name: "Config, should pass", method: "GET", path: "/v1/config", wantStatus: http.StatusOK},
+		{name: "Unknown path, should fail", method: "GET", path: "/v2/volumes", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var body json.RawMessage
+			if resp.StatusCode != http.StatusNoContent {
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatalf("response is not JSON: %v", err)
+				}
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if resp.Header.Get("Api-Version") != ADMINAPIVERSION {
+				t.Errorf("Api-Version = %q, want %q", resp.Header.Get("Api-Version"), ADMINAPIVERSION)
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Errorf("body = %s, want %s", body, tt.wantBody)
+			}
+		})
+	}
+
+	entries, err := driver.TrashEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("TrashEntries() = %v, want 1 entry", entries)
+	}
+	if err := driver.DeleteTrash(entries[0].Path); err != nil {
+		t.Fatalf("localPersistDriver.DeleteTrash() error = %v", err)
+	}
+	if _, err := os.Stat(entries[0].Path); !os.IsNotExist(err) {
+		t.Errorf("trashed directory %s still exists", entries[0].Path)
+	}
+}
@@ -0,0 +1,525 @@
+package driver
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ARCHIVEDIR is the directory inside every pool containing the archives of idle volumes, unless
+// the archive configuration has a path.
+const ARCHIVEDIR = ".local-persist-archives"
+
+// Defaults of the archive configuration. Docker waits two minutes for a Mount call, the restore
+// timeout leaves some room for the rest of it.
+const (
+	DEFAULTARCHIVESCANINTERVAL = 10 * time.Minute
+	DEFAULTRESTORETIMEOUT      = 90 * time.Second
+)
+
+// Tiers of a volume, shown in its status.
+const (
+	TIERHOT      = "hot"
+	TIERARCHIVED = "archived"
+)
+
+// ArchiveConfig is the tiering policy that compresses volumes which are not used for a while into
+// an archive. They are restored by the next Mount.
+type ArchiveConfig struct {
+	// After is the time a volume has to be unused before it is archived, e.g. "30d".
+	After string `json:"after"`
+	// Path is the directory for the archives, e.g. a slower disk. Defaults to ARCHIVEDIR in the pool.
+	Path string `json:"path,omitempty"`
+	// RestoreTimeout is the maximum time a Mount may spend restoring a volume, e.g. "90s".
+	RestoreTimeout string `json:"restoreTimeout,omitempty"`
+	// ScanInterval is the time between two checks for volumes to archive, e.g. "10m".
+	ScanInterval string `json:"scanInterval,omitempty"`
+
+	after          time.Duration
+	restoreTimeout time.Duration
+	scanInterval   time.Duration
+}
+
+func (c *ArchiveConfig) validate() error {
+	var err error
+	if c.after, err = parseExpiry(c.After); err != nil {
+		return fmt.Errorf("invalid after: %s", err)
+	}
+	if c.Path != "" {
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("path %s is not absolute", c.Path)
+		}
+		c.Path = filepath.Clean(c.Path)
+	}
+
+	c.restoreTimeout = DEFAULTRESTORETIMEOUT
+	if c.RestoreTimeout != "" {
+		if c.restoreTimeout, err = time.ParseDuration(c.RestoreTimeout); err != nil || c.restoreTimeout <= 0 {
+			return fmt.Errorf("invalid restoreTimeout %s", c.RestoreTimeout)
+		}
+	}
+	c.scanInterval = DEFAULTARCHIVESCANINTERVAL
+	if c.ScanInterval != "" {
+		if c.scanInterval, err = time.ParseDuration(c.ScanInterval); err != nil || c.scanInterval <= 0 {
+			return fmt.Errorf("invalid scanInterval %s", c.ScanInterval)
+		}
+	}
+	return nil
+}
+
+// archiveState is the state of an archived volume.
+type archiveState struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// archivePath returns the path of the archive of a volume.
+func (driver *localPersistDriver) archivePath(name string, v *localPersistVolume) (string, error) {
+	dir := driver.config.Archive.Path
+	if dir == "" {
+		root, err := driver.poolPath(v.Pool)
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(root, ARCHIVEDIR)
+	}
+
+	p := filepath.Join(dir, name+".tar.gz")
+	if _, err := isSubDir(dir, p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// archivable reports whether a volume can be archived: an unused plain directory or btrfs volume
+// that no other volume depends on.
+func (driver *localPersistDriver) archivable(name string, v *localPersistVolume) bool {
+	return v.Archive == nil && len(v.Mounts) == 0 && v.Parent == "" &&
+		(v.Backend == BACKENDDIRECTORY || v.Backend == BACKENDBTRFS) &&
+		len(driver.dependents(name)) == 0
+}
+
+// requireHot returns an error when a volume is archived.
+func requireHot(name string, v *localPersistVolume) error {
+	if v.Archive != nil {
+		return fmt.Errorf("volume %s is archived, mount it to restore it", name)
+	}
+	return nil
+}
+
+// requireNotRestoring returns an error when the archive of a volume is being restored.
+func requireNotRestoring(name string, v *localPersistVolume) error {
+	if v.restoring != nil {
+		return fmt.Errorf("volume %s is being restored", name)
+	}
+	return nil
+}
+
+// ArchiveIdle archives the volumes that were not used for the configured time until the context
+// is cancelled. It does nothing without archive configuration.
+func (driver *localPersistDriver) ArchiveIdle(ctx context.Context) {
+	if driver.config.Archive == nil {
+		return
+	}
+	log.Infof("Archiving volumes unused for %s every %s", driver.config.Archive.After, driver.config.Archive.scanInterval)
+
+	for {
+		driver.archiveIdle(ctx, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(driver.config.Archive.scanInterval):
+		}
+	}
+}
+
+// archiveIdle archives the volumes that are idle at now and returns their names.
+func (driver *localPersistDriver) archiveIdle(ctx context.Context, now time.Time) []string {
+	driver.RLock()
+	var names []string
+	for name, v := range driver.volumes {
+		if driver.archivable(name, v) && now.Sub(lastUsed(v)) >= driver.config.Archive.after {
+			names = append(names, name)
+		}
+	}
+	driver.RUnlock()
+	sort.Strings(names)
+
+	archived := []string{}
+	for _, name := range names {
+		err := driver.archiveVolume(ctx, name)
+		driver.metrics.job("archive", err)
+		driver.audit(AUDITACTORPLUGIN, "archive", name, nil, err)
+		if err != nil {
+			log.Warnf("Could not archive volume %s: %s", name, err)
+			continue
+		}
+		archived = append(archived, name)
+	}
+	return archived
+}
+
+// archiveVolume compresses a volume into its archive and empties its directory. The archive is
+// written without holding the lock, it is discarded when the volume was used in the meantime.
+func (driver *localPersistDriver) archiveVolume(ctx context.Context, name string) error {
+	driver.RLock()
+	v, ok := driver.volumes[name]
+	if !ok || !driver.archivable(name, v) {
+		driver.RUnlock()
+		return fmt.Errorf("volume %s cannot be archived", name)
+	}
+	mountpoint, used := v.Mountpoint, lastUsed(v)
+	dst, err := driver.archivePath(name, v)
+	driver.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDir(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	defer os.Remove(tmp)
+
+	log.Infof("Archiving volume %s to %s", name, dst)
+	if err := writeArchive(ctx, mountpoint, tmp); err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	if driver.volumes[name] != v || !driver.archivable(name, v) || !lastUsed(v).Equal(used) {
+		return fmt.Errorf("volume %s was used while it was archived", name)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	if err := emptyDir(defaultLogger(), mountpoint, nil); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	v.Archive = &archiveState{Path: dst, Size: fi.Size(), ArchivedAt: time.Now()}
+	if err := driver.saveState(); err != nil {
+		return fmt.Errorf("error %s", err)
+	}
+
+	log.Infof("Archived volume %s, the archive is %d bytes", name, fi.Size())
+
+	return nil
+}
+
+// restoreVolume extracts the archive of a volume into its directory. The caller must hold the lock,
+// which is released while extracting; other mounts of the volume wait for the restore and other
+// changes to it are refused. When the extraction does not finish in time, the partially restored
+// files are deleted and the volume stays archived.
+func (driver *localPersistDriver) restoreVolume(logger *log.Entry, name string, v *localPersistVolume) error {
+	timeout := DEFAULTRESTORETIMEOUT
+	if driver.config.Archive != nil {
+		timeout = driver.config.Archive.restoreTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	archive, mountpoint := v.Archive.Path, v.Mountpoint
+	logger.Infof("Restoring volume %s from %s", name, archive)
+	start := time.Now()
+
+	v.restoring = make(chan struct{})
+	driver.Unlock()
+	err := extractArchive(ctx, archive, mountpoint)
+	if err != nil {
+		if cleanErr := emptyDir(logger, mountpoint, nil); cleanErr != nil {
+			logger.Errorf("Could not clean up partially restored volume %s: %s", name, cleanErr)
+		}
+	}
+	driver.Lock()
+	close(v.restoring)
+	v.restoring = nil
+
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("restoring volume %s takes longer than %s, it stays archived", name, timeout)
+		}
+		return fmt.Errorf("could not restore volume %s: %s", name, err)
+	}
+
+	if err := os.Remove(archive); err != nil {
+		logger.Warnf("Could not remove archive %s: %s", archive, err)
+	}
+	v.Archive = nil
+	if err := driver.saveState(); err != nil {
+		return fmt.Errorf("error %s", err)
+	}
+
+	logger.Infof("Restored volume %s in %s", name, time.Since(start).Round(time.Millisecond))
+
+	return nil
+}
+
+// awaitRestore waits for the restore of a volume started by another mount. The caller must hold
+// the lock, which is released while waiting.
+func (driver *localPersistDriver) awaitRestore(name string, v *localPersistVolume) error {
+	done := v.restoring
+	driver.Unlock()
+	<-done
+	driver.Lock()
+
+	if driver.volumes[name] != v {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if v.Archive != nil {
+		return fmt.Errorf("volume %s could not be restored, it stays archived", name)
+	}
+	return nil
+}
+
+// ctxReader stops reading when its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// writeArchive writes the contents of src to a gzip compressed tar at dst. Symlinks, hardlinks,
+// devices and named pipes are stored as such, and other filesystems mounted below src are skipped.
+// Sockets cannot be stored, so volumes containing them are refused.
+func writeArchive(ctx context.Context, src string, dst string) error {
+	var root unix.Stat_t
+	if err := unix.Lstat(src, &root); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	// The first name of every file with more than one link, later names are stored as hardlinks
+	type inode struct{ dev, ino uint64 }
+	linked := map[inode]string{}
+
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if p == src {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var stat unix.Stat_t
+		if err := unix.Lstat(p, &stat); err != nil {
+			return err
+		}
+		if stat.Dev != root.Dev {
+			log.Warnf("Not archiving %s, it is on another filesystem", p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSocket != 0:
+			return fmt.Errorf("%s is a socket, which cannot be archived", p)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Format = tar.FormatPAX
+
+		if d.Type().IsRegular() && stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+			if first, ok := linked[key]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				linked[key] = hdr.Name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, ctxReader{ctx: ctx, r: file})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// extractArchive extracts a gzip compressed tar written by writeArchive into dst, with the
+// ownership, modes including the setuid, setgid and sticky bits, and hardlinks of the entries.
+// Entries that would end up outside dst are refused.
+func extractArchive(ctx context.Context, src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(ctxReader{ctx: ctx, r: f})
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	// Directories stay writable until their contents are restored, then get their archived mode
+	type dirMode struct {
+		path string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			for i := len(dirs) - 1; i >= 0; i-- {
+				if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		if _, err := isSubDir(dst, target); err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		if hdr.Typeflag != tar.TypeDir {
+			if err := ensureDir(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, mode})
+		case tar.TypeReg:
+			if err := extractFile(tr, target, mode.Perm()); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// A hardlink shares the ownership and mode of the file it links to, which is restored already
+			source := filepath.Join(dst, filepath.FromSlash(hdr.Linkname))
+			if _, err := isSubDir(dst, source); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			kind := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+			if err := unix.Mknod(target, kind|uint32(mode.Perm()), int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot restore %s, unsupported type %c", target, hdr.Typeflag)
+		}
+
+		// Only root can give files away, the ownership is kept where possible. Changing the owner
+		// clears the setuid and setgid bits, so the mode is set after it.
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+func extractFile(r io.Reader, target string, mode fs.FileMode) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
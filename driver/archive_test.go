@@ -0,0 +1,239 @@
+package driver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/sys/unix"
+)
+
+func Test_ArchiveConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ArchiveConfig
+		wantErr bool
+	}{
+		{name: "Only after, should pass", config: ArchiveConfig{After: "30d"}},
+		{name: "All fields, should pass", config: ArchiveConfig{After: "12h", Path: "/archive", RestoreTimeout: "1m", ScanInterval: "1h"}},
+		{name: "No after, should fail", config: ArchiveConfig{}, wantErr: true},
+		{name: "Relative path, should fail", config: ArchiveConfig{After: "1d", Path: "archive"}, wantErr: true},
+		{name: "Invalid restore timeout, should fail", config: ArchiveConfig{After: "1d", RestoreTimeout: "-1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("ArchiveConfig.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_archive(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	config := &ArchiveConfig{After: "1h"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{Archive: config},
+	}
+	for _, name := range []string{"cold", "hot"} {
+		if err := driver.Create(&volume.CreateRequest{Name: name, Options: map[string]string{}}); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	v := driver.volumes["cold"]
+	if err := os.MkdirAll(path.Join(v.Mountpoint, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(v.Mountpoint, "dir", "file"), []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", path.Join(v.Mountpoint, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(v.Mountpoint, "readonly"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(v.Mountpoint, "readonly", "file"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(v.Mountpoint, "readonly"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path.Join(v.Mountpoint, "dir", "file"), path.Join(v.Mountpoint, "hardlink")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(v.Mountpoint, "setuid"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path.Join(v.Mountpoint, "setuid"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(path.Join(v.Mountpoint, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "hot", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+
+	archived := driver.archiveIdle(context.Background(), time.Now().Add(2*time.Hour))
+	if len(archived) != 1 || archived[0] != "cold" {
+		t.Fatalf("archiveIdle() = %v, want [cold]", archived)
+	}
+	if entries, _ := os.ReadDir(v.Mountpoint); len(entries) != 0 || v.Archive == nil {
+		t.Fatalf("archiveIdle() left %v in the archived volume", entries)
+	}
+	got, err := driver.Get(&volume.GetRequest{Name: "cold"})
+	if err != nil || got.Volume.Status["tier"] != TIERARCHIVED {
+		t.Errorf("localPersistDriver.Get() status = %v, %v, want tier %s", got.Volume.Status, err, TIERARCHIVED)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "view", Options: map[string]string{"view-of": "cold"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() view of archived volume should give error")
+	}
+
+	// A restore that takes too long fails cleanly and keeps the archive
+	config.restoreTimeout = time.Nanosecond
+	if _, err := driver.Mount(&volume.MountRequest{Name: "cold", ID: "two"}); err == nil {
+		t.Fatalf("localPersistDriver.Mount() with restore timeout should give error")
+	}
+	if entries, _ := os.ReadDir(v.Mountpoint); len(entries) != 0 || v.Archive == nil || len(v.Mounts) != 0 {
+		t.Errorf("localPersistDriver.Mount() did not clean up the failed restore")
+	}
+
+	config.restoreTimeout = time.Minute
+	archive := v.Archive.Path
+	if _, err := driver.Mount(&volume.MountRequest{Name: "cold", ID: "two"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	if data, err := os.ReadFile(path.Join(v.Mountpoint, "link")); err != nil || string(data) != "data" {
+		t.Errorf("localPersistDriver.Mount() restored %q, %v, want data", data, err)
+	}
+	if fi, err := os.Stat(path.Join(v.Mountpoint, "dir", "file")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("localPersistDriver.Mount() restored file with mode %v, %v, want 0640", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(path.Join(v.Mountpoint, "dir")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("localPersistDriver.Mount() restored directory with mode %v, %v, want 0750", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(path.Join(v.Mountpoint, "readonly")); err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("localPersistDriver.Mount() restored directory with mode %v, %v, want 0500", fi.Mode(), err)
+	}
+	if _, err := os.Stat(path.Join(v.Mountpoint, "readonly", "file")); err != nil {
+		t.Errorf("localPersistDriver.Mount() did not restore the file in a read-only directory: %v", err)
+	}
+	if fi, err := os.Stat(path.Join(v.Mountpoint, "setuid")); err != nil || fi.Mode()&os.ModeSetuid == 0 {
+		t.Errorf("localPersistDriver.Mount() restored file with mode %v, %v, want setuid", fi.Mode(), err)
+	}
+	if fi, err := os.Lstat(path.Join(v.Mountpoint, "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("localPersistDriver.Mount() did not restore the named pipe: %v", err)
+	}
+	var link, file unix.Stat_t
+	if unix.Stat(path.Join(v.Mountpoint, "hardlink"), &link) != nil || unix.Stat(path.Join(v.Mountpoint, "dir", "file"), &file) != nil || link.Ino != file.Ino {
+		t.Errorf("localPersistDriver.Mount() did not restore the hardlink")
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) || v.Archive != nil {
+		t.Errorf("localPersistDriver.Mount() did not remove the archive after restoring")
+	}
+}
+
+func Test_localPersistDriver_Mount_restoring(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "cold", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["cold"]
+
+	// A restore started by another mount, without the lock held
+	driver.Lock()
+	v.Archive = &archiveState{Path: path.Join(DATAPATH, "cold.tar.gz")}
+	v.restoring = make(chan struct{})
+	done := v.restoring
+	driver.Unlock()
+
+	if err := driver.Remove(&volume.RemoveRequest{Name: "cold"}); err == nil {
+		t.Errorf("localPersistDriver.Remove() of a volume being restored should give error")
+	}
+	if err := driver.Rename("cold", "warm", false); err == nil {
+		t.Errorf("localPersistDriver.Rename() of a volume being restored should give error")
+	}
+
+	mounted := make(chan error)
+	go func() {
+		_, err := driver.Mount(&volume.MountRequest{Name: "cold", ID: "two"})
+		mounted <- err
+	}()
+	select {
+	case err := <-mounted:
+		t.Fatalf("localPersistDriver.Mount() returned %v before the restore was done", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := driver.Get(&volume.GetRequest{Name: "cold"}); err != nil {
+		t.Errorf("localPersistDriver.Get() is blocked by the restore: %v", err)
+	}
+
+	driver.Lock()
+	v.Archive = nil
+	v.restoring = nil
+	close(done)
+	driver.Unlock()
+
+	if err := <-mounted; err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	if !reflect.DeepEqual(v.Mounts, []string{"two"}) {
+		t.Errorf("localPersistDriver.Mount() mounts = %v, want [two]", v.Mounts)
+	}
+}
+
+func Test_localPersistDriver_archive_socket(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	config := &ArchiveConfig{After: "1h"}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{Archive: config},
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "cold", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["cold"]
+	l, err := net.Listen("unix", path.Join(v.Mountpoint, "socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := driver.archiveVolume(context.Background(), "cold"); err == nil {
+		t.Errorf("localPersistDriver.archiveVolume() of a volume with a socket should give error")
+	}
+	if _, err := os.Lstat(path.Join(v.Mountpoint, "socket")); err != nil || v.Archive != nil {
+		t.Errorf("localPersistDriver.archiveVolume() archived a volume with a socket")
+	}
+}
@@ -0,0 +1,443 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// AUDITFILE is the audit log in the state directory. Every line is an AuditEntry in JSON, linked
+// to the line before it by its hash.
+const AUDITFILE = "local-persist-audit.log"
+
+// AUDITHEADFILE holds the sequence number and hash of the last entry of the audit log, so that
+// removing entries from the end of the log is detected. It is written before the entry, so after
+// a crash it may be one entry ahead of the log.
+const AUDITHEADFILE = "local-persist-audit.head"
+
+// Actors of operations that are not requested by an operator.
+const (
+	AUDITACTORDOCKER = "docker"
+	AUDITACTORPLUGIN = "local-persist"
+)
+
+// Outcomes of audited operations.
+const (
+	AUDITSUCCESS = "success"
+	AUDITFAILURE = "failure"
+)
+
+// AuditEntry is a single operation in the audit log.
+type AuditEntry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Operation string            `json:"operation"`
+	Volume    string            `json:"volume,omitempty"`
+	Args      map[string]string `json:"args,omitempty"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+	// Prev is the hash of the previous entry, empty for the first entry
+	Prev string `json:"prev"`
+	// Hash is the SHA-256 of the entry without its hash
+	Hash string `json:"hash"`
+}
+
+// auditHead is the content of AUDITHEADFILE.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+	// Prev is the hash of the entry before it
+	Prev string `json:"prev"`
+}
+
+// matches reports whether the head is the last entry of the log, or the entry after it that was
+// not written before a crash.
+func (head auditHead) matches(last AuditEntry) bool {
+	if head.Seq == last.Seq+1 {
+		return head.Prev == last.Hash
+	}
+	return head.Seq == last.Seq && head.Hash == last.Hash
+}
+
+// auditLock serializes the appends of this process, flock those of different processes.
+var auditLock sync.Mutex
+
+// hash returns the hash of the entry, which covers every field but Hash.
+func (e AuditEntry) hash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AppendAudit appends an operation and its outcome to the audit log in the state directory.
+func AppendAudit(stateDir string, actor string, operation string, volume string, args map[string]string, opErr error) (AuditEntry, error) {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Actor:     actor,
+		Operation: operation,
+		Volume:    volume,
+		Args:      args,
+		Outcome:   AUDITSUCCESS,
+	}
+	if opErr != nil {
+		entry.Outcome = AUDITFAILURE
+		entry.Error = opErr.Error()
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(stateDir, AUDITFILE), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return entry, err
+	}
+	defer unix.Flock(int(f.Fd()), unix.LOCK_UN)
+
+	last, err := lastAuditLine(f)
+	if err != nil {
+		return entry, err
+	}
+	if last != nil {
+		var previous AuditEntry
+		if err := json.Unmarshal(last, &previous); err != nil {
+			return entry, fmt.Errorf("the last entry of the audit log is invalid, check it with verify-audit: %s", err)
+		}
+		entry.Seq, entry.Prev = previous.Seq, previous.Hash
+	}
+	entry.Seq++
+
+	if entry.Hash, err = entry.hash(); err != nil {
+		return entry, err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	if err := writeAuditHead(stateDir, auditHead{Seq: entry.Seq, Hash: entry.Hash, Prev: entry.Prev}); err != nil {
+		return entry, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return entry, err
+	}
+	return entry, f.Sync()
+}
+
+// lastAuditLine returns the last line of the audit log without its newline, or nil if it is empty.
+func lastAuditLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	for chunk := int64(4096); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+		buf := make([]byte, chunk)
+		if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if chunk == size {
+			if len(buf) == 0 {
+				return nil, nil
+			}
+			return buf, nil
+		}
+	}
+}
+
+// writeAuditHead replaces the head file and syncs it, so that it is on disk before the entry.
+func writeAuditHead(stateDir string, head auditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	headPath := filepath.Join(stateDir, AUDITHEADFILE)
+	tmp := headPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, headPath); err != nil {
+		return err
+	}
+	dir, err := os.Open(stateDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// audit records an operation in the audit log. The operation has happened already, so a failure
+// to record it is only logged.
+func (driver *localPersistDriver) audit(actor string, operation string, volume string, args map[string]string, err error) {
+	if _, auditErr := AppendAudit(filepath.Dir(driver.stateFilePath), actor, operation, volume, args, err); auditErr != nil {
+		log.Errorf("Could not record %s of volume %s in the audit log: %s", operation, volume, auditErr)
+	}
+}
+
+// peerActor describes the process on the other end of a unix socket connection by its
+// credentials, e.g. "uid=0 pid=1234".
+func peerActor(c net.Conn) string {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *unix.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return fmt.Sprintf("uid=%d pid=%d", cred.Uid, cred.Pid)
+}
+
+// adminActorKey is the context key of the actor of an admin API connection.
+type adminActorKey struct{}
+
+// adminOperations are the audited operations of the admin API by method and path.
+var adminOperations = map[string]string{
+	"POST /volumes":                               "create",
+	"POST /adopt":                                 "adopt",
+	"POST /volumes/{name}/snapshots":              "snapshot",
+	"DELETE /volumes/{name}/snapshots/{snapshot}": "delete-snapshot",
+	"POST /volumes/{name}/forget":                 "forget",
+	"POST /volumes/{name}/purge":                  "purge",
+	"POST /volumes/{name}/reset":                  "reset",
+	"POST /volumes/{name}/resize":                 "resize",
+	"POST /volumes/{name}/move":                   "move",
+	"POST /volumes/{name}/rename":                 "rename",
+	"POST /volumes/{name}/cleanup":                "cleanup",
+	"DELETE /trash":                               "delete-trash",
+	"POST /reconcile":                             "reconcile",
+}
+
+// auditedResponse keeps the status and the body of failed admin API responses.
+type auditedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditedResponse) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= http.StatusBadRequest {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// serveAudited serves an admin API request and records it in the audit log when it is one of
+// adminOperations. The arguments are the request body, the query and the snapshot name.
+func (driver *localPersistDriver) serveAudited(mux *http.ServeMux, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{fmt.Sprintf("could not read request body: %s", err)})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	res := &auditedResponse{ResponseWriter: w}
+	mux.ServeHTTP(res, r)
+
+	method, pattern, _ := strings.Cut(r.Pattern, " ")
+	operation := adminOperations[method+" "+strings.TrimPrefix(pattern, "/v"+ADMINAPIVERSION)]
+	if operation == "" {
+		return
+	}
+
+	args := map[string]string{}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil {
+		for k, v := range fields {
+			var s string
+			if json.Unmarshal(v, &s) != nil {
+				s = string(v)
+			}
+			args[k] = s
+		}
+	}
+	for k, v := range r.URL.Query() {
+		args[k] = strings.Join(v, ",")
+	}
+	if snapshot := r.PathValue("snapshot"); snapshot != "" {
+		args["snapshot"] = snapshot
+	}
+
+	name := r.PathValue("name")
+	if name == "" {
+		name = args["name"]
+	}
+
+	var opErr error
+	if res.status >= http.StatusBadRequest {
+		var e adminError
+		if json.Unmarshal(res.body.Bytes(), &e) != nil || e.Error == "" {
+			e.Error = http.StatusText(res.status)
+		}
+		opErr = errors.New(e.Error)
+	}
+
+	actor := "admin"
+	if peer, _ := r.Context().Value(adminActorKey{}).(string); peer != "" {
+		actor += " " + peer
+	}
+	driver.audit(actor, operation, name, args, opErr)
+}
+
+// AuditReport is the result of verifying the audit log.
+type AuditReport struct {
+	Entries int `json:"entries"`
+	// Head is the hash of the last entry, keep a copy outside of the host to verify it later
+	Head     string   `json:"head"`
+	Problems []string `json:"problems"`
+}
+
+// VerifyAudit checks the hash chain of the audit log in the state directory and compares its end
+// with the head file. A non-empty anchor is the hash of an entry that has to be in the log, e.g.
+// the head of an earlier verification.
+func VerifyAudit(stateDir string, anchor string) (*AuditReport, error) {
+	report := &AuditReport{Problems: []string{}}
+
+	f, err := os.Open(filepath.Join(stateDir, AUDITFILE))
+	if errors.Is(err, fs.ErrNotExist) {
+		f = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var previous AuditEntry
+	anchored := anchor == ""
+	if f != nil {
+		defer f.Close()
+
+		r := bufio.NewReader(f)
+		for n := 1; ; n++ {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				if len(line) > 0 {
+					report.Problems = append(report.Problems, fmt.Sprintf("line %d: the line is incomplete", n))
+				}
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var entry AuditEntry
+			dec := json.NewDecoder(bytes.NewReader(line))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&entry); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("line %d: invalid entry: %s", n, err))
+				continue
+			}
+			report.Entries++
+
+			if entry.Seq != previous.Seq+1 {
+				report.Problems = append(report.Problems, fmt.Sprintf("line %d: entry %d follows entry %d, entries are missing or reordered", n, entry.Seq, previous.Seq))
+			}
+			if entry.Prev != previous.Hash {
+				report.Problems = append(report.Problems, fmt.Sprintf("line %d: entry %d does not link to the entry before it", n, entry.Seq))
+			}
+			if hash, err := entry.hash(); err != nil || hash != entry.Hash {
+				report.Problems = append(report.Problems, fmt.Sprintf("line %d: entry %d was modified", n, entry.Seq))
+			}
+			if entry.Hash == anchor {
+				anchored = true
+			}
+			previous = entry
+		}
+	}
+	report.Head = previous.Hash
+
+	var head auditHead
+	data, err := os.ReadFile(filepath.Join(stateDir, AUDITHEADFILE))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if report.Entries > 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s is missing", AUDITHEADFILE))
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &head); err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s is invalid: %s", AUDITHEADFILE, err))
+		} else if !head.matches(previous) {
+			report.Problems = append(report.Problems, fmt.Sprintf("the log ends at entry %d, but the head is entry %d, the log was truncated or the head was changed", previous.Seq, head.Seq))
+		}
+	}
+
+	if !anchored {
+		report.Problems = append(report.Problems, fmt.Sprintf("no entry has the hash %s, the log was truncated or rewritten", anchor))
+	}
+
+	return report, nil
+}
+
+// WriteText writes the report in a human readable form.
+func (report *AuditReport) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%d entries, head %s\n", report.Entries, report.Head); err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		if _, err := fmt.Fprintln(w, problem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_VerifyAudit(t *testing.T) {
+	logPath := path.Join(STATEPATH, AUDITFILE)
+	headPath := path.Join(STATEPATH, AUDITHEADFILE)
+
+	tests := []struct {
+		name         string
+		tamper       func(lines [][]byte) [][]byte
+		removeHead   bool
+		anchor       int
+		wantProblems int
+	}{
+		{name: "Untouched log, should pass"},
+		{name: "Untouched log with anchor, should pass", anchor: 2},
+		{name: "Edited entry, should fail", tamper: func(lines [][]byte) [][]byte {
+			lines[1] = bytes.Replace(lines[1], []byte(`"volume":"second"`), []byte(`"volume":"other"`), 1)
+			return lines
+		}, wantProblems: 1},
+		{name: "Removed entry, should fail", tamper: func(lines [][]byte) [][]byte {
+			return append(lines[:1], lines[2:]...)
+		}, wantProblems: 2},
+		{name: "Log one entry behind its head, as after a crash, should pass", tamper: func(lines [][]byte) [][]byte {
+			return lines[:2]
+		}},
+		{name: "Truncated log, should fail", tamper: func(lines [][]byte) [][]byte {
+			return lines[:1]
+		}, wantProblems: 1},
+		{name: "Truncated log and head, should fail with anchor", tamper: func(lines [][]byte) [][]byte {
+			return lines[:1]
+		}, removeHead: true, anchor: 2, wantProblems: 2},
+		{name: "Incomplete line, should fail", tamper: func(lines [][]byte) [][]byte {
+			return append(lines, []byte(`{"seq":4`))
+		}, wantProblems: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDirs(t)
+			defer cleanupBaseDir()
+
+			var entries []AuditEntry
+			for _, name := range []string{"first", "second", "third"} {
+				var opErr error
+				if name == "third" {
+					opErr = errors.New("refused")
+				}
+				entry, err := AppendAudit(STATEPATH, AUDITACTORDOCKER, "create", name, map[string]string{"size": "1G"}, opErr)
+				if err != nil {
+					t.Fatalf("AppendAudit() error = %v", err)
+				}
+				entries = append(entries, entry)
+			}
+			if entries[2].Seq != 3 || entries[2].Prev != entries[1].Hash || entries[2].Outcome != AUDITFAILURE {
+				t.Fatalf("AppendAudit() = %+v, want the third entry linked to the second", entries[2])
+			}
+
+			if tt.tamper != nil {
+				data, err := os.ReadFile(logPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				lines := tt.tamper(bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")))
+				data = append(bytes.Join(lines, []byte("\n")), '\n')
+				if strings.HasSuffix(string(lines[len(lines)-1]), `"seq":4`) {
+					data = bytes.TrimSuffix(data, []byte("\n"))
+				}
+				if err := os.WriteFile(logPath, data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.removeHead {
+				if err := os.Remove(headPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			anchor := ""
+			if tt.anchor > 0 {
+				anchor = entries[tt.anchor-1].Hash
+			}
+
+			report, err := VerifyAudit(STATEPATH, anchor)
+			if err != nil {
+				t.Fatalf("VerifyAudit() error = %v", err)
+			}
+			if len(report.Problems) != tt.wantProblems {
+				t.Errorf("VerifyAudit() problems = %q, want %d", report.Problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_audit(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	instrumented := driver.Instrumented()
+	if err := instrumented.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"soft-limit": "1G"}}); err != nil {
+		t.Fatalf("instrumentedDriver.Create() error = %v", err)
+	}
+	if _, err := instrumented.Mount(&volume.MountRequest{Name: "test-volume", ID: "first"}); err != nil {
+		t.Fatalf("instrumentedDriver.Mount() error = %v", err)
+	}
+	if err := instrumented.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "first"}); err != nil {
+		t.Fatalf("instrumentedDriver.Unmount() error = %v", err)
+	}
+	if _, err := instrumented.Mount(&volume.MountRequest{Name: "missing", ID: "second"}); err == nil {
+		t.Fatalf("instrumentedDriver.Mount() of a missing volume should fail")
+	}
+	if _, err := instrumented.Get(&volume.GetRequest{Name: "test-volume"}); err != nil {
+		t.Fatalf("instrumentedDriver.Get() error = %v", err)
+	}
+
+	server := httptest.NewServer(driver.AdminHandler())
+	defer server.Close()
+	for _, req := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{method: "GET", path: "/v1/volumes"},
+		{method: "POST", path: "/v1/volumes", body: `{"name":"admin-volume"}`},
+		{method: "POST", path: "/v1/volumes/test-volume/rename", body: `{"name":"renamed"}`},
+		{method: "POST", path: "/v1/volumes/renamed/purge"},
+	} {
+		r, _ := http.NewRequest(req.method, server.URL+req.path, strings.NewReader(req.body))
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	data, err := os.ReadFile(path.Join(STATEPATH, AUDITFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry)
+	}
+
+	tests := []struct {
+		name      string
+		actor     string
+		operation string
+		volume    string
+		arg       string
+		argValue  string
+		outcome   string
+	}{
+		{name: "Create, should be recorded", actor: AUDITACTORDOCKER, operation: "create", volume: "test-volume", arg: "soft-limit", argValue: "1G", outcome: AUDITSUCCESS},
+		{name: "Mount, should be recorded", actor: AUDITACTORDOCKER, operation: "mount", volume: "test-volume", arg: "id", argValue: "first", outcome: AUDITSUCCESS},
+		{name: "Unmount, should be recorded", actor: AUDITACTORDOCKER, operation: "unmount", volume: "test-volume", arg: "id", argValue: "first", outcome: AUDITSUCCESS},
+		{name: "Failed mount, should be recorded", actor: AUDITACTORDOCKER, operation: "mount", volume: "missing", arg: "id", argValue: "second", outcome: AUDITFAILURE},
+		{name: "Create through the admin API, should be recorded once", actor: "admin", operation: "create", volume: "admin-volume", arg: "name", argValue: "admin-volume", outcome: AUDITSUCCESS},
+		{name: "Rename, should be recorded", actor: "admin", operation: "rename", volume: "test-volume", arg: "name", argValue: "renamed", outcome: AUDITSUCCESS},
+		{name: "Purge, should be recorded", actor: "admin", operation: "purge", volume: "renamed", outcome: AUDITSUCCESS},
+	}
+	if len(got) != len(tests) {
+		t.Fatalf("audit log = %+v, want %d entries", got, len(tests))
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := got[i]
+			if e.Actor != tt.actor || e.Operation != tt.operation || e.Volume != tt.volume || e.Outcome != tt.outcome || e.Args[tt.arg] != tt.argValue {
+				t.Errorf("audit entry = %+v, want %s %s of %s with %s=%s: %s", e, tt.actor, tt.operation, tt.volume, tt.arg, tt.argValue, tt.outcome)
+			}
+		})
+	}
+
+	report, err := VerifyAudit(STATEPATH, "")
+	if err != nil {
+		t.Fatalf("VerifyAudit() error = %v", err)
+	}
+	if len(report.Problems) != 0 || report.Entries != len(tests) {
+		t.Errorf("VerifyAudit() = %+v, want %d entries without problems", report, len(tests))
+	}
+}
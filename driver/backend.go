@@ -0,0 +1,292 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// BACKENDDIRECTORY is the backend option of volumes stored in a plain directory, the default.
+const BACKENDDIRECTORY = "directory"
+
+// ErrSnapshotNotSupported is returned by backends that cannot snapshot volumes.
+var ErrSnapshotNotSupported = errors.New("the backend of the volume does not support snapshots")
+
+// Backend provisions the storage of volumes. The driver computes and checks the mountpoint of a
+// volume and keeps track of its users; the backend of the volume decides what is stored there.
+type Backend interface {
+	// Provision creates the storage of a new volume at its mountpoint, using the create options.
+	// Like Mount, Unmount and Remove, it logs with the logger of the request.
+	Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error
+	// Mount makes the volume available at its mountpoint. It is called for the first user.
+	Mount(logger *log.Entry, name string, v *localPersistVolume) error
+	// Unmount is called when the last user of the volume is gone.
+	Unmount(logger *log.Entry, name string, v *localPersistVolume) error
+	// Remove is called when the volume is removed. The data of the volume persists.
+	Remove(logger *log.Entry, name string, v *localPersistVolume) error
+	// Purge deletes the data of the volume.
+	Purge(name string, v *localPersistVolume) error
+	// Usage returns the number of bytes used by the volume and its size, zero if unlimited.
+	Usage(name string, v *localPersistVolume) (used uint64, size uint64, err error)
+	// Snapshot creates a read-only copy of the volume at dst, or returns ErrSnapshotNotSupported.
+	Snapshot(name string, v *localPersistVolume, dst string) error
+}
+
+// recoverer is implemented by backends that need to restore their state after a restart.
+type recoverer interface {
+	// Recover brings the storage of the volume in line with its state and reports whether the
+	// state changed.
+	Recover(name string, v *localPersistVolume) (bool, error)
+}
+
+// backend returns the backend with the given name, an empty name selects the directory backend.
+func (driver *localPersistDriver) backend(name string) (Backend, error) {
+	switch name {
+	case "", BACKENDDIRECTORY:
+		return directoryBackend{driver: driver}, nil
+	case BACKENDIMAGE:
+		return imageBackend{driver: driver}, nil
+	case BACKENDBTRFS:
+		return btrfsBackend{driver: driver}, nil
+	case BACKENDOVERLAY:
+		return overlayBackend{driver: driver}, nil
+	case BACKENDVIEW:
+		return viewBackend{driver: driver}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %s", name)
+	}
+}
+
+// defaultBackend returns the backend of a volume created without backend option: an overlay for
+// the overlay-of option, a view for the view-of option, a directory for children, a btrfs subvolume when the mountpoint is on btrfs, a directory otherwise.
+func defaultBackend(mountpoint string, options map[string]string) string {
+	if options["overlay-of"] != "" {
+		return BACKENDOVERLAY
+	}
+	if options["view-of"] != "" {
+		return BACKENDVIEW
+	}
+	if options["parent"] != "" {
+		return BACKENDDIRECTORY
+	}
+	if isBtrfs(existingAncestor(mountpoint)) {
+		return BACKENDBTRFS
+	}
+	return BACKENDDIRECTORY
+}
+
+// Purge removes a volume and deletes its data. Volumes in use cannot be purged.
+func (driver *localPersistDriver) Purge(name string) error {
+	log.Debug("Purge called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	return driver.purgeVolume(defaultLogger(), name)
+}
+
+// purgeVolume removes a volume and deletes its data, the caller must hold the lock.
+func (driver *localPersistDriver) purgeVolume(logger *log.Entry, name string) error {
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if len(v.Mounts) > 0 {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	if err := requireNotRestoring(name, v); err != nil {
+		return err
+	}
+	if dependents := driver.dependents(name); len(dependents) > 0 {
+		return fmt.Errorf("volume %s is used by %s", name, strings.Join(dependents, ", "))
+	}
+	if err := driver.checkContained(v.Mountpoint); err != nil {
+		return fmt.Errorf("refusing to purge volume %s: %s", name, err)
+	}
+
+	backend, err := driver.backend(v.Backend)
+	if err != nil {
+		return err
+	}
+	if err := backend.Remove(logger, name, v); err != nil {
+		return err
+	}
+	if err := backend.Purge(name, v); err != nil {
+		return fmt.Errorf("could not purge volume %s: %s", name, err)
+	}
+	if v.Archive != nil {
+		if err := os.Remove(v.Archive.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("could not purge archive of volume %s: %s", name, err)
+		}
+	}
+
+	delete(driver.volumes, name)
+	driver.forgetUsage(name)
+
+	if err := driver.saveState(); err != nil {
+		return fmt.Errorf("error %s", err)
+	}
+
+	logger.Infof("Purged volume %s", name)
+
+	return nil
+}
+
+// checkContained returns an error unless path is inside one of the pools or allowed prefixes.
+func (driver *localPersistDriver) checkContained(path string) error {
+	if _, _, err := driver.poolOf(path); err == nil {
+		return nil
+	}
+	if _, base, ok := driver.hostMountpoint(driver.hostPathOf(path)); ok {
+		if inside, _ := isSubDir(base, path); inside {
+			return nil
+		}
+	}
+	return fmt.Errorf("path %s is not inside any pool or allowed prefix", path)
+}
+
+// Recover lets every backend restore the storage of its volumes after a restart of the plugin,
+// e.g. after a crash.
+func (driver *localPersistDriver) Recover() error {
+	log.Debug("Recover called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	var changed bool
+	for name, v := range driver.volumes {
+		backend, err := driver.backend(v.Backend)
+		if err != nil {
+			log.Errorf("Could not recover volume %s: %s", name, err)
+			continue
+		}
+		readOnly := v.ReadOnly && v.View == nil
+		if readOnly && len(v.Mounts) == 0 {
+			if ro, _ := isReadOnlyMounted(v.Mountpoint); ro {
+				log.Warnf("Volume %s is not in use, but its read-only bind mount exists. Unmounting it", name)
+				if err := unix.Unmount(v.Mountpoint, 0); err != nil {
+					log.Errorf("Could not recover volume %s: %s", name, err)
+				}
+			}
+		}
+		if r, ok := backend.(recoverer); ok {
+			c, err := r.Recover(name, v)
+			if err != nil {
+				log.Errorf("Could not recover volume %s: %s", name, err)
+			}
+			changed = changed || c
+		}
+		if readOnly && len(v.Mounts) > 0 {
+			if ro, _ := isReadOnlyMounted(v.Mountpoint); !ro {
+				log.Warnf("Volume %s is in use, but it is not read-only. Bind mounting it read-only again", name)
+				if err := bindReadOnly(v.Mountpoint, v.Mountpoint); err != nil {
+					log.Errorf("Could not recover volume %s: %s", name, err)
+				}
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return driver.saveState()
+}
+
+// directoryBackend stores volumes in a plain directory, optionally limited by a project quota.
+type directoryBackend struct {
+	driver *localPersistDriver
+}
+
+func (b directoryBackend) Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error {
+	if options["clone-of"] != "" {
+		return fmt.Errorf("the %s backend cannot clone volumes", BACKENDDIRECTORY)
+	}
+
+	limits, err := quotaOptions(options)
+	if err != nil {
+		return err
+	}
+	if limits != nil {
+		err = supportsProjectQuota(existingAncestor(v.Mountpoint))
+		if err != nil {
+			return fmt.Errorf("cannot create volume %s with a size: %w", name, err)
+		}
+	}
+
+	logger.Debugf("Ensuring directory %s exists", v.Mountpoint)
+
+	_, statErr := os.Stat(v.Mountpoint)
+	err = ensureDir(v.Mountpoint, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %s", v.Mountpoint, err)
+	}
+
+	if limits != nil {
+		v.ProjectID, err = b.driver.nextProjectID(v.Mountpoint)
+		if err == nil {
+			v.Quota = limits
+			err = setProjectQuota(logger, v.Mountpoint, v.ProjectID, *limits)
+		}
+		if err != nil {
+			v.ProjectID, v.Quota = 0, nil
+			// Only remove the directory when it was created for this volume
+			if os.IsNotExist(statErr) {
+				if removeErr := os.Remove(v.Mountpoint); removeErr != nil {
+					logger.Warnf("Could not remove directory %s: %s", v.Mountpoint, removeErr)
+				}
+			}
+			return fmt.Errorf("cannot create volume %s with a size: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b directoryBackend) Mount(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b directoryBackend) Unmount(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b directoryBackend) Remove(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b directoryBackend) Purge(name string, v *localPersistVolume) error {
+	return os.RemoveAll(v.Mountpoint)
+}
+
+func (b directoryBackend) Usage(name string, v *localPersistVolume) (uint64, uint64, error) {
+	if v.ProjectID != 0 {
+		usage, err := projectUsage(v.Mountpoint, v.ProjectID)
+		if err != nil {
+			return 0, 0, err
+		}
+		return usage.Used, usage.Size, nil
+	}
+
+	used, err := dirSize(v.Mountpoint)
+	return uint64(used), 0, err
+}
+
+func (b directoryBackend) Snapshot(name string, v *localPersistVolume, dst string) error {
+	return ErrSnapshotNotSupported
+}
+
+// statfsUsage returns the used and total bytes of the filesystem mounted at path.
+func statfsUsage(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	size := stat.Blocks * uint64(stat.Bsize)
+	return size - stat.Bfree*uint64(stat.Bsize), size, nil
+}
@@ -0,0 +1,118 @@
+package driver
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_backend(t *testing.T) {
+	driver := &localPersistDriver{}
+
+	tests := []struct {
+		name    string
+		want    Backend
+		wantErr bool
+	}{
+		{name: "", want: directoryBackend{driver: driver}},
+		{name: BACKENDDIRECTORY, want: directoryBackend{driver: driver}},
+		{name: BACKENDIMAGE, want: imageBackend{driver: driver}},
+		{name: "i-do-not-exist", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := driver.backend(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.backend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("localPersistDriver.backend() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Create_backend(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "unknown", Options: map[string]string{"backend": "i-do-not-exist"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() with unknown backend should give error")
+	}
+	if _, err := os.Stat(path.Join(DATAPATH, "unknown")); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Create() with unknown backend created a directory")
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume"}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["test-volume"]
+	if v.Backend != BACKENDDIRECTORY {
+		t.Errorf("localPersistDriver.Create() backend = %s, want %s", v.Backend, BACKENDDIRECTORY)
+	}
+
+	if err := os.WriteFile(path.Join(v.Mountpoint, "data"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend, _ := driver.backend(v.Backend)
+	if used, size, err := backend.Usage("test-volume", v); err != nil || used != 100 || size != 0 {
+		t.Errorf("directoryBackend.Usage() = %d, %d, %v, want 100, 0", used, size, err)
+	}
+	if err := backend.Snapshot("test-volume", v, path.Join(DATAPATH, "snapshot")); !errors.Is(err, ErrSnapshotNotSupported) {
+		t.Errorf("directoryBackend.Snapshot() error = %v, want %v", err, ErrSnapshotNotSupported)
+	}
+
+	// Directories have nothing to recover, so the state is not written
+	os.Remove(STATEFILEPATH)
+	if err := driver.Recover(); err != nil {
+		t.Errorf("localPersistDriver.Recover() error = %v", err)
+	}
+	if _, err := os.Stat(STATEFILEPATH); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Recover() saved unchanged state")
+	}
+}
+
+func Test_localPersistDriver_Purge(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["test-volume"]
+
+	v.Mounts = []string{"one"}
+	if err := driver.Purge("test-volume"); err == nil {
+		t.Errorf("localPersistDriver.Purge() of volume in use should give error")
+	}
+	v.Mounts = nil
+
+	if err := driver.Purge("test-volume"); err != nil {
+		t.Fatalf("localPersistDriver.Purge() error = %v", err)
+	}
+	if _, ok := driver.volumes["test-volume"]; ok {
+		t.Errorf("localPersistDriver.Purge() did not remove volume from the state")
+	}
+	if _, err := os.Stat(v.Mountpoint); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Purge() did not delete %s", v.Mountpoint)
+	}
+	if err := driver.Purge("test-volume"); err == nil {
+		t.Errorf("localPersistDriver.Purge() of unknown volume should give error")
+	}
+}
@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// BACKENDBTRFS is the backend option of volumes stored in a btrfs subvolume.
+const BACKENDBTRFS = "btrfs"
+
+// Btrfs ioctls, see linux/btrfs.h
+const (
+	btrfsIocSnapCreateV2 = 0x50009417
+	btrfsIocSubvolCreate = 0x5000940e
+	btrfsIocSnapDestroy  = 0x5000940f
+	btrfsIocInoLookup    = 0xd0009412
+	btrfsSubvolRdonly    = 1 << 1
+	btrfsFirstFreeObject = 256
+)
+
+// btrfsVolArgs mirrors struct btrfs_ioctl_vol_args.
+type btrfsVolArgs struct {
+	fd   int64
+	name [4088]byte
+}
+
+// btrfsVolArgsV2 mirrors struct btrfs_ioctl_vol_args_v2.
+type btrfsVolArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [4040]byte
+}
+
+// btrfsInoLookupArgs mirrors struct btrfs_ioctl_ino_lookup_args.
+type btrfsInoLookupArgs struct {
+	treeid   uint64
+	objectid uint64
+	name     [4080]byte
+}
+
+// isBtrfs reports whether path is on a btrfs filesystem.
+func isBtrfs(path string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false
+	}
+	return stat.Type == unix.BTRFS_SUPER_MAGIC
+}
+
+// isSubvolume reports whether path is the root of a btrfs subvolume.
+func isSubvolume(path string) bool {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return false
+	}
+	return stat.Ino == btrfsFirstFreeObject && isBtrfs(path)
+}
+
+// createSubvolume creates the subvolume path, its parent has to exist.
+func createSubvolume(path string) error {
+	var args btrfsVolArgs
+	return btrfsParentIoctl(path, btrfsIocSubvolCreate, args.name[:], unsafe.Pointer(&args))
+}
+
+// deleteSubvolume deletes the subvolume path with everything in it.
+func deleteSubvolume(path string) error {
+	var args btrfsVolArgs
+	return btrfsParentIoctl(path, btrfsIocSnapDestroy, args.name[:], unsafe.Pointer(&args))
+}
+
+// snapshotSubvolume creates a snapshot of the subvolume src at dst.
+func snapshotSubvolume(src string, dst string, readonly bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	args := btrfsVolArgsV2{fd: int64(f.Fd())}
+	if readonly {
+		args.flags = btrfsSubvolRdonly
+	}
+	if err := btrfsParentIoctl(dst, btrfsIocSnapCreateV2, args.name[:], unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("could not snapshot %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// btrfsParentIoctl issues a btrfs ioctl on the parent directory of path, with the base name of
+// path in name.
+func btrfsParentIoctl(path string, req uintptr, name []byte, arg unsafe.Pointer) error {
+	base := filepath.Base(path)
+	if len(base) >= len(name) {
+		return fmt.Errorf("name %s is too long", base)
+	}
+	copy(name, base)
+
+	parent, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	return ioctl(parent.Fd(), req, arg)
+}
+
+// subvolumeID returns the ID of the subvolume containing path.
+func subvolumeID(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	args := btrfsInoLookupArgs{objectid: btrfsFirstFreeObject}
+	if err := ioctl(f.Fd(), btrfsIocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return 0, err
+	}
+	return args.treeid, nil
+}
+
+// qgroupUsage returns the referenced bytes of the subvolume from its qgroup. It fails when quotas
+// are not enabled on the filesystem.
+func qgroupUsage(path string) (uint64, error) {
+	id, err := subvolumeID(path)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := exec.Command("btrfs", "qgroup", "show", "--raw", "-f", path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("could not show qgroup of %s: %s", path, err)
+	}
+	return parseQgroupShow(out, id)
+}
+
+// parseQgroupShow returns the referenced bytes of qgroup 0/<id> from the output of btrfs qgroup show.
+func parseQgroupShow(out []byte, id uint64) (uint64, error) {
+	qgroup := "0/" + strconv.FormatUint(id, 10)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == qgroup {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("qgroup %s not found", qgroup)
+}
+
+// btrfsBackend stores volumes in btrfs subvolumes, which can be snapshotted and cloned cheaply.
+type btrfsBackend struct {
+	driver *localPersistDriver
+}
+
+func (b btrfsBackend) Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error {
+	explicit := options["backend"] == BACKENDBTRFS
+
+	fallback := func(reason string) error {
+		if explicit || options["clone-of"] != "" {
+			return fmt.Errorf("cannot create volume %s as btrfs subvolume: %s", name, reason)
+		}
+		logger.Infof("Creating volume %s as directory: %s", name, reason)
+		v.Backend = BACKENDDIRECTORY
+		return directoryBackend{driver: b.driver}.Provision(logger, name, v, options)
+	}
+
+	if options["size"] != "" {
+		return fallback("the size option needs project quotas")
+	}
+
+	if err := ensureDir(filepath.Dir(v.Mountpoint), 0755); err != nil {
+		return err
+	}
+	if !isBtrfs(filepath.Dir(v.Mountpoint)) {
+		return fallback(fmt.Sprintf("%s is not on btrfs", v.Mountpoint))
+	}
+
+	if source := options["clone-of"]; source != "" {
+		src, err := b.cloneSource(source)
+		if err != nil {
+			return err
+		}
+		if err := snapshotSubvolume(src, v.Mountpoint, false); err != nil {
+			return err
+		}
+		logger.Infof("Cloned %s to volume %s", src, name)
+		return nil
+	}
+
+	if _, err := os.Stat(v.Mountpoint); err == nil {
+		if isSubvolume(v.Mountpoint) {
+			logger.Infof("Reusing existing subvolume %s", v.Mountpoint)
+			return nil
+		}
+		return fallback(fmt.Sprintf("%s already exists and is not a subvolume", v.Mountpoint))
+	}
+
+	if err := createSubvolume(v.Mountpoint); err != nil {
+		return fallback(fmt.Sprintf("could not create subvolume %s: %s", v.Mountpoint, err))
+	}
+
+	logger.Debugf("Created subvolume %s", v.Mountpoint)
+
+	return nil
+}
+
+// cloneSource returns the subvolume of a volume, or of one of its snapshots (volume@snapshot).
+func (b btrfsBackend) cloneSource(source string) (string, error) {
+	name, snapshot, _ := strings.Cut(source, "@")
+
+	v, ok := b.driver.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("volume %s to clone not found", name)
+	}
+	if v.Backend != BACKENDBTRFS {
+		return "", fmt.Errorf("volume %s to clone is not a btrfs volume", name)
+	}
+	if err := requireHot(name, v); err != nil {
+		return "", err
+	}
+
+	if snapshot == "" {
+		return v.Mountpoint, nil
+	}
+	return b.driver.snapshotPath(name, v, snapshot)
+}
+
+func (b btrfsBackend) Mount(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b btrfsBackend) Unmount(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b btrfsBackend) Remove(logger *log.Entry, name string, v *localPersistVolume) error {
+	return nil
+}
+
+func (b btrfsBackend) Purge(name string, v *localPersistVolume) error {
+	if !isSubvolume(v.Mountpoint) {
+		return os.RemoveAll(v.Mountpoint)
+	}
+	return deleteSubvolume(v.Mountpoint)
+}
+
+func (b btrfsBackend) Usage(name string, v *localPersistVolume) (uint64, uint64, error) {
+	used, err := qgroupUsage(v.Mountpoint)
+	if err != nil {
+		log.Debugf("Could not get qgroup usage of volume %s, measuring it instead: %s", name, err)
+		size, err := dirSize(v.Mountpoint)
+		return uint64(size), 0, err
+	}
+	return used, 0, nil
+}
+
+func (b btrfsBackend) Snapshot(name string, v *localPersistVolume, dst string) error {
+	return snapshotSubvolume(v.Mountpoint, dst, true)
+}
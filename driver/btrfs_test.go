@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_parseQgroupShow(t *testing.T) {
+	out := []byte(`qgroupid         rfer         excl
+--------         ----         ----
+0/5             16384        16384
+0/256         1048576       524288
+`)
+	tests := []struct {
+		name    string
+		id      uint64
+		want    uint64
+		wantErr bool
+	}{
+		{name: "Existing qgroup, should pass", id: 256, want: 1048576},
+		{name: "Top level qgroup, should pass", id: 5, want: 16384},
+		{name: "Unknown qgroup, should fail", id: 257, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQgroupShow(out, tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseQgroupShow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseQgroupShow() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Create_btrfsFallback(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if isBtrfs(DATAPATH) {
+		t.Skip("test data is on btrfs")
+	}
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if v := driver.volumes["test-volume"]; v.Backend != BACKENDDIRECTORY {
+		t.Errorf("localPersistDriver.Create() backend = %s, want %s", v.Backend, BACKENDDIRECTORY)
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "test-btrfs", Options: map[string]string{"backend": "btrfs"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() with backend=btrfs outside btrfs should give error")
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-clone", Options: map[string]string{"clone-of": "test-volume"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() clone of directory volume should give error")
+	}
+}
+
+func Test_localPersistDriver_btrfs(t *testing.T) {
+	mnt := mountLoopbackImage(t, "btrfs", "")
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      mnt,
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["test-volume"]
+	if v.Backend != BACKENDBTRFS || !isSubvolume(v.Mountpoint) {
+		t.Fatalf("localPersistDriver.Create() volume = %+v, want a subvolume", v)
+	}
+	if err := os.WriteFile(path.Join(v.Mountpoint, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := driver.Snapshot("test-volume", "first")
+	if err != nil {
+		t.Fatalf("localPersistDriver.Snapshot() error = %v", err)
+	}
+	snapshots, err := driver.Snapshots("test-volume")
+	if err != nil || len(snapshots) != 1 || snapshots[0] != snapshot {
+		t.Errorf("localPersistDriver.Snapshots() = %v, %v, want [%s]", snapshots, err, snapshot)
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "test-clone", Options: map[string]string{"clone-of": "test-volume@first"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() clone error = %v", err)
+	}
+	clone := driver.volumes["test-clone"]
+	if data, err := os.ReadFile(path.Join(clone.Mountpoint, "file")); err != nil || string(data) != "data" {
+		t.Errorf("localPersistDriver.Create() clone contains %q, %v, want data", data, err)
+	}
+	if err := os.WriteFile(path.Join(clone.Mountpoint, "file"), []byte("changed"), 0644); err != nil {
+		t.Errorf("localPersistDriver.Create() clone is not writable: %v", err)
+	}
+
+	if _, _, err := (btrfsBackend{driver: driver}).Usage("test-volume", v); err != nil {
+		t.Errorf("btrfsBackend.Usage() error = %v", err)
+	}
+
+	if err := driver.DeleteSnapshot("test-volume", "first"); err != nil {
+		t.Errorf("localPersistDriver.DeleteSnapshot() error = %v", err)
+	}
+	if err := driver.Purge("test-clone"); err != nil {
+		t.Fatalf("localPersistDriver.Purge() error = %v", err)
+	}
+	if _, err := os.Stat(clone.Mountpoint); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Purge() did not delete subvolume %s", clone.Mountpoint)
+	}
+}
@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies for removing a volume that has children, see Config.RemoveParent.
+const (
+	REMOVEPARENTBLOCK   = "block"
+	REMOVEPARENTCASCADE = "cascade"
+)
+
+// childMountpoint returns the mountpoint of a new volume carved out of the subpath of its parent.
+func (driver *localPersistDriver) childMountpoint(parentName string, subpath string, pool string) (string, error) {
+	parent, ok := driver.volumes[parentName]
+	if !ok {
+		return "", fmt.Errorf("parent volume %s not found", parentName)
+	}
+	if parent.Backend != BACKENDDIRECTORY && parent.Backend != BACKENDBTRFS {
+		return "", fmt.Errorf("volumes with the %s backend cannot have children", parent.Backend)
+	}
+	if err := requireHot(parentName, parent); err != nil {
+		return "", err
+	}
+	if parent.Pool != pool {
+		return "", fmt.Errorf("parent volume %s is not in pool %s", parentName, pool)
+	}
+	if subpath == "" || filepath.IsAbs(subpath) {
+		return "", fmt.Errorf("the parent option needs a relative subpath option")
+	}
+
+	mountpoint := filepath.Join(parent.Mountpoint, subpath)
+	if _, err := isSubDir(parent.Mountpoint, mountpoint); err != nil {
+		return "", err
+	}
+	for name, v := range driver.volumes {
+		if v == nil || v.Mountpoint == "" {
+			continue
+		}
+		if filepath.Clean(v.Mountpoint) == mountpoint {
+			return "", fmt.Errorf("subpath %s of volume %s is already used by volume %s", subpath, parentName, name)
+		}
+		if driver.mountpointNestedIn(mountpoint, parentName, name) {
+			return "", fmt.Errorf("subpath %s of volume %s is inside volume %s", subpath, parentName, name)
+		}
+		if inside, _ := isSubDir(mountpoint, v.Mountpoint); inside {
+			return "", fmt.Errorf("subpath %s of volume %s contains volume %s", subpath, parentName, name)
+		}
+	}
+	return mountpoint, nil
+}
+
+// children returns the names of the volumes carved out of name.
+func (driver *localPersistDriver) children(name string) []string {
+	children := []string{}
+	for other, v := range driver.volumes {
+		if v.Parent == name {
+			children = append(children, other)
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// blockingDependents returns the dependents that prevent removing name. Children only do so
+// when the remove policy does not cascade.
+func (driver *localPersistDriver) blockingDependents(name string) []string {
+	if driver.config.RemoveParent != REMOVEPARENTCASCADE {
+		return driver.dependents(name)
+	}
+	blocking := []string{}
+	for _, dependent := range driver.dependents(name) {
+		if driver.volumes[dependent].Parent != name {
+			blocking = append(blocking, dependent)
+		}
+	}
+	return blocking
+}
+
+// removeChildren removes the children of a volume, and their children, from the state when the
+// remove policy cascades. The data persists, like it does for every removed volume. Every child
+// gets its own entry in the audit log.
+func (driver *localPersistDriver) removeChildren(logger *log.Entry, name string) error {
+	if driver.config.RemoveParent != REMOVEPARENTCASCADE {
+		return nil
+	}
+	for _, child := range driver.children(name) {
+		err := driver.removeVolume(logger, child)
+		driver.audit(AUDITACTORPLUGIN, "remove", child, map[string]string{"cascade-of": name}, err)
+		if err != nil {
+			return fmt.Errorf("could not remove child %s: %s", child, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Create_child(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "project", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		volume         string
+		options        map[string]string
+		wantMountpoint string
+		wantErr        bool
+	}{
+		{name: "Child in subpath, should pass", volume: "api", options: map[string]string{"parent": "project", "subpath": "services/api"}, wantMountpoint: path.Join(DATAPATH, "project", "services", "api")},
+		{name: "Child of child, should pass", volume: "api-cache", options: map[string]string{"parent": "api", "subpath": "cache"}, wantMountpoint: path.Join(DATAPATH, "project", "services", "api", "cache")},
+		{name: "Used subpath, should fail", volume: "api2", options: map[string]string{"parent": "project", "subpath": "services/api"}, wantErr: true},
+		{name: "Subpath inside a child, should fail", volume: "api-logs", options: map[string]string{"parent": "project", "subpath": "services/api/logs"}, wantErr: true},
+		{name: "Subpath containing a child, should fail", volume: "services", options: map[string]string{"parent": "project", "subpath": "services"}, wantErr: true},
+		{name: "No subpath, should fail", volume: "empty", options: map[string]string{"parent": "project"}, wantErr: true},
+		{name: "Subpath outside parent, should fail", volume: "escape", options: map[string]string{"parent": "project", "subpath": "../escape"}, wantErr: true},
+		{name: "Absolute subpath, should fail", volume: "absolute", options: map[string]string{"parent": "project", "subpath": "/etc"}, wantErr: true},
+		{name: "Unknown parent, should fail", volume: "orphan", options: map[string]string{"parent": "unknown", "subpath": "orphan"}, wantErr: true},
+		{name: "Parent and mountpoint, should fail", volume: "both", options: map[string]string{"parent": "project", "subpath": "both", "mountpoint": "both"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := driver.Create(&volume.CreateRequest{Name: tt.volume, Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := driver.volumes[tt.volume].Mountpoint; got != tt.wantMountpoint {
+				t.Errorf("localPersistDriver.Create() mountpoint = %s, want %s", got, tt.wantMountpoint)
+			}
+			if _, err := os.Stat(tt.wantMountpoint); err != nil {
+				t.Errorf("localPersistDriver.Create() did not create %s", tt.wantMountpoint)
+			}
+		})
+	}
+
+	got, err := driver.Get(&volume.GetRequest{Name: "project"})
+	if err != nil {
+		t.Fatalf("localPersistDriver.Get() error = %v", err)
+	}
+	if children := got.Volume.Status["children"]; !reflect.DeepEqual(children, []string{"api"}) {
+		t.Errorf("localPersistDriver.Get() children = %v, want [api]", children)
+	}
+}
+
+func Test_localPersistDriver_Remove_parent(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	tests := []struct {
+		name        string
+		policy      string
+		wantErr     bool
+		wantRemoved []string
+		// wantCascaded are the audited removals of children by the parent they were removed with
+		wantCascaded map[string]string
+	}{
+		{name: "Default policy, should block", policy: "", wantErr: true, wantCascaded: map[string]string{}},
+		{name: "Block policy, should block", policy: REMOVEPARENTBLOCK, wantErr: true, wantCascaded: map[string]string{}},
+		{name: "Cascade policy, should remove children", policy: REMOVEPARENTCASCADE, wantRemoved: []string{"project", "api", "api-cache"}, wantCascaded: map[string]string{"api": "project", "api-cache": "api"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &localPersistDriver{
+				Name:          "local-persist-test",
+				volumes:       map[string]*localPersistVolume{},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+				config:        Config{RemoveParent: tt.policy},
+			}
+			for _, req := range []*volume.CreateRequest{
+				{Name: "project", Options: map[string]string{}},
+				{Name: "api", Options: map[string]string{"parent": "project", "subpath": "api"}},
+				{Name: "api-cache", Options: map[string]string{"parent": "api", "subpath": "cache"}},
+			} {
+				if err := driver.Create(req); err != nil {
+					t.Fatalf("localPersistDriver.Create() error = %v", err)
+				}
+			}
+
+			err := driver.Remove(&volume.RemoveRequest{Name: "project"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Remove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, name := range tt.wantRemoved {
+				if _, ok := driver.volumes[name]; ok {
+					t.Errorf("localPersistDriver.Remove() did not remove %s", name)
+				}
+			}
+			if _, err := os.Stat(path.Join(DATAPATH, "project", "api", "cache")); err != nil {
+				t.Errorf("localPersistDriver.Remove() removed the data of the children")
+			}
+
+			data, _ := os.ReadFile(path.Join(STATEPATH, AUDITFILE))
+			os.Remove(path.Join(STATEPATH, AUDITFILE))
+			cascaded := map[string]string{}
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				var entry AuditEntry
+				if json.Unmarshal([]byte(line), &entry) == nil && entry.Operation == "remove" && entry.Outcome == AUDITSUCCESS && entry.Args["cascade-of"] != "" {
+					cascaded[entry.Volume] = entry.Args["cascade-of"]
+				}
+			}
+			if !reflect.DeepEqual(cascaded, tt.wantCascaded) {
+				t.Errorf("localPersistDriver.Remove() audited cascaded removals %v, want %v", cascaded, tt.wantCascaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CONFIGFILE is the optional configuration file, read from the state directory.
+const CONFIGFILE = "local-persist-config.json"
+
+// Config is the administrator supplied configuration of the driver.
+type Config struct {
+	// Pools are additional named data roots next to the default data path.
+	Pools map[string]*Pool `json:"pools,omitempty"`
+	// PoolsMount is the path inside the plugin every pool has to be below, defaults to POOLSMOUNT.
+	PoolsMount string `json:"poolsMount,omitempty"`
+
+	// AllowedPrefixes are host directories in which volumes may be created with an absolute
+	// mountpoint. They must be inside HostPath.
+	AllowedPrefixes []string `json:"allowedPrefixes,omitempty"`
+	// HostPath is the host directory mounted into the plugin at HostMount.
+	HostPath string `json:"hostPath,omitempty"`
+	// HostMount is the path of the host mount inside the plugin.
+	HostMount string `json:"hostMount,omitempty"`
+
+	// Layout is a text/template for the directory of volumes created without a mountpoint
+	// option, relative to the data root.
+	Layout string `json:"layout,omitempty"`
+
+	// UsageScanInterval is the time in which every volume with a soft-limit is measured once, e.g. "10m".
+	UsageScanInterval string `json:"usageScanInterval,omitempty"`
+	// RefuseMountRatio refuses to mount volumes using more than this multiple of their soft-limit.
+	// Zero never refuses.
+	RefuseMountRatio float64 `json:"refuseMountRatio,omitempty"`
+
+	// RemoveParent is the policy for removing a volume that has children: "block" (default)
+	// refuses, "cascade" removes the children as well.
+	RemoveParent string `json:"removeParent,omitempty"`
+
+	// ExpiryScanInterval is the time between two checks for volumes past their ttl or idle-expiry, e.g. "1m".
+	ExpiryScanInterval string `json:"expiryScanInterval,omitempty"`
+	// ExpiryPurge deletes the data of expired volumes, instead of only removing them.
+	ExpiryPurge bool `json:"expiryPurge,omitempty"`
+
+	// Archive is the tiering policy for volumes that are not used for a while.
+	Archive *ArchiveConfig `json:"archive,omitempty"`
+
+	// AdminSocket is the unix socket of the admin API, defaults to ADMINSOCKET in the state directory.
+	AdminSocket string `json:"adminSocket,omitempty"`
+
+	// MetricsListen is the unix socket, an absolute path, or the TCP address to serve Prometheus
+	// metrics on, e.g. "/var/lib/local-persist/local-persist-metrics.sock" or ":9310". Empty
+	// disables the metrics.
+	MetricsListen string `json:"metricsListen,omitempty"`
+
+	usageScanInterval  time.Duration
+	expiryScanInterval time.Duration
+}
+
+func loadConfig(statePath string) (Config, error) {
+	var config Config
+
+	configFilePath := path.Join(statePath, CONFIGFILE)
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Debugf("No config found in path: %s", configFilePath)
+			return config, nil
+		}
+		return config, err
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("could not parse %s: %s", configFilePath, err)
+	}
+
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("invalid config %s: %s", configFilePath, err)
+	}
+
+	log.Debugf("Loaded config from %s", configFilePath)
+
+	return config, nil
+}
+
+func (config *Config) validate() error {
+	if config.PoolsMount == "" {
+		config.PoolsMount = POOLSMOUNT
+	}
+	for name, p := range config.Pools {
+		if p == nil {
+			return fmt.Errorf("pool %s has no configuration", name)
+		}
+		if _, err := parseLayout(p.Layout); err != nil {
+			return fmt.Errorf("invalid layout for pool %s: %s", name, err)
+		}
+		if name == DEFAULTPOOL {
+			if p.Path != "" {
+				return fmt.Errorf("the path of pool %s is the data path and cannot be configured", DEFAULTPOOL)
+			}
+			continue
+		}
+		if p.Path == "" || !filepath.IsAbs(p.Path) {
+			return fmt.Errorf("pool %s needs an absolute path", name)
+		}
+		p.Path = filepath.Clean(p.Path)
+		if rel, err := hostRel(config.PoolsMount, p.Path); err != nil || rel == "." {
+			return fmt.Errorf("the path of pool %s is not below %s, volumes in it would not be visible on the host", name, config.PoolsMount)
+		}
+	}
+
+	if _, err := parseLayout(config.Layout); err != nil {
+		return fmt.Errorf("invalid layout: %s", err)
+	}
+
+	if config.UsageScanInterval != "" {
+		interval, err := time.ParseDuration(config.UsageScanInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid usageScanInterval %s", config.UsageScanInterval)
+		}
+		config.usageScanInterval = interval
+	}
+	if config.ExpiryScanInterval != "" {
+		interval, err := time.ParseDuration(config.ExpiryScanInterval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid expiryScanInterval %s", config.ExpiryScanInterval)
+		}
+		config.expiryScanInterval = interval
+	}
+	if config.RefuseMountRatio < 0 {
+		return fmt.Errorf("refuseMountRatio cannot be negative")
+	}
+
+	if config.Archive != nil {
+		if err := config.Archive.validate(); err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+	}
+
+	if config.AdminSocket != "" && !filepath.IsAbs(config.AdminSocket) {
+		return fmt.Errorf("adminSocket %s is not absolute", config.AdminSocket)
+	}
+	if config.MetricsListen != "" && !filepath.IsAbs(config.MetricsListen) {
+		if _, _, err := net.SplitHostPort(config.MetricsListen); err != nil {
+			return fmt.Errorf("invalid metricsListen %s: %s", config.MetricsListen, err)
+		}
+	}
+
+	switch config.RemoveParent {
+	case "", REMOVEPARENTBLOCK, REMOVEPARENTCASCADE:
+	default:
+		return fmt.Errorf("invalid removeParent %s, must be %s or %s", config.RemoveParent, REMOVEPARENTBLOCK, REMOVEPARENTCASCADE)
+	}
+
+	if len(config.AllowedPrefixes) > 0 {
+		if config.HostPath == "" || !filepath.IsAbs(config.HostPath) {
+			return fmt.Errorf("allowedPrefixes need an absolute hostPath")
+		}
+		config.HostPath = filepath.Clean(config.HostPath)
+		if config.HostMount == "" {
+			config.HostMount = HOSTMOUNT
+		}
+		for i, prefix := range config.AllowedPrefixes {
+			if !filepath.IsAbs(prefix) {
+				return fmt.Errorf("allowed prefix %s is not absolute", prefix)
+			}
+			prefix = filepath.Clean(prefix)
+			if _, err := hostRel(config.HostPath, prefix); err != nil {
+				return fmt.Errorf("allowed prefix %s is not inside hostPath %s", prefix, config.HostPath)
+			}
+			config.AllowedPrefixes[i] = prefix
+		}
+	}
+	return nil
+}
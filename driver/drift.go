@@ -0,0 +1,466 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TRASHDIR is the directory inside every pool that trashed directories are moved to.
+// It is never reported as drift.
+const TRASHDIR = ".local-persist-trash"
+
+// internalDirs are the directories inside every pool that are used by the driver itself.
+var internalDirs = map[string]bool{TRASHDIR: true, IMAGEDIR: true, SNAPSHOTDIR: true, OVERLAYDIR: true, ARCHIVEDIR: true}
+
+// DriftReport describes the differences between the volumes known to the driver and the
+// directories that actually exist under the pools.
+type DriftReport struct {
+	Roots          []string        `json:"roots"`
+	Untracked      []UntrackedDir  `json:"untracked"`
+	Missing        []MissingVolume `json:"missing"`
+	TypeMismatches []TypeMismatch  `json:"typeMismatches"`
+}
+
+// UntrackedDir is a directory in a pool that no volume points at.
+type UntrackedDir struct {
+	Path    string    `json:"path"`
+	Pool    string    `json:"pool"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// MissingVolume is a volume whose mountpoint no longer exists.
+type MissingVolume struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+}
+
+// TypeMismatch is a volume whose mountpoint exists, but is not a directory.
+type TypeMismatch struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+}
+
+// Clean reports whether no drift was found.
+func (r *DriftReport) Clean() bool {
+	return len(r.Untracked) == 0 && len(r.Missing) == 0 && len(r.TypeMismatches) == 0
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *DriftReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText writes the report in a human readable table format.
+func (r *DriftReport) WriteText(w io.Writer) error {
+	if r.Clean() {
+		_, err := fmt.Fprintf(w, "No drift found in %s\n", strings.Join(r.Roots, ", "))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(r.Untracked) > 0 {
+		fmt.Fprintf(tw, "UNTRACKED DIRECTORY\tPOOL\tSIZE\tMODIFIED\n")
+		for _, u := range r.Untracked {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", u.Path, u.Pool, u.Size, u.ModTime.Format(time.RFC3339))
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.Missing) > 0 {
+		fmt.Fprintf(tw, "MISSING VOLUME\tMOUNTPOINT\n")
+		for _, m := range r.Missing {
+			fmt.Fprintf(tw, "%s\t%s\n", m.Name, m.Mountpoint)
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(r.TypeMismatches) > 0 {
+		fmt.Fprintf(tw, "MISMATCHED VOLUME\tMOUNTPOINT\tTYPE\n")
+		for _, m := range r.TypeMismatches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", m.Name, m.Mountpoint, m.Type)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// Drift compares the volumes in the state with the directory tree under every pool.
+func (driver *localPersistDriver) Drift() (*DriftReport, error) {
+	log.Debug("Drift called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	report := &DriftReport{
+		Roots:          []string{},
+		Untracked:      []UntrackedDir{},
+		Missing:        []MissingVolume{},
+		TypeMismatches: []TypeMismatch{},
+	}
+
+	// Every mountpoint is tracked, every parent of a mountpoint has to be walked to find
+	// untracked siblings. Pool roots nested in another pool are walked on their own.
+	roots := driver.poolRoots()
+	tracked := map[string]bool{}
+	for _, root := range roots {
+		tracked[root] = true
+	}
+	parents := map[string]bool{}
+	for name, v := range driver.volumes {
+		mountpoint := filepath.Clean(v.Mountpoint)
+		tracked[mountpoint] = true
+		for dir := filepath.Dir(mountpoint); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			parents[dir] = true
+		}
+
+		fi, err := os.Lstat(mountpoint)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			report.Missing = append(report.Missing, MissingVolume{Name: name, Mountpoint: mountpoint})
+		case err != nil:
+			return nil, err
+		case !fi.IsDir():
+			report.TypeMismatches = append(report.TypeMismatches, TypeMismatch{Name: name, Mountpoint: mountpoint, Type: fileType(fi.Mode())})
+		}
+	}
+
+	for pool, root := range roots {
+		report.Roots = append(report.Roots, root)
+
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == root {
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if tracked[p] {
+				return filepath.SkipDir
+			}
+			if parents[p] {
+				return nil
+			}
+			if filepath.Dir(p) == root && internalDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size, err := dirSize(p)
+			if err != nil {
+				return err
+			}
+			report.Untracked = append(report.Untracked, UntrackedDir{Path: p, Pool: pool, Size: size, ModTime: fi.ModTime()})
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(report.Roots)
+	sort.Slice(report.Untracked, func(i, j int) bool { return report.Untracked[i].Path < report.Untracked[j].Path })
+	sort.Slice(report.Missing, func(i, j int) bool { return report.Missing[i].Name < report.Missing[j].Name })
+	sort.Slice(report.TypeMismatches, func(i, j int) bool { return report.TypeMismatches[i].Name < report.TypeMismatches[j].Name })
+
+	log.Debugf("Found %d untracked directories, %d missing volumes and %d type mismatches",
+		len(report.Untracked), len(report.Missing), len(report.TypeMismatches))
+
+	return report, nil
+}
+
+// Adopt registers an existing directory in one of the pools as a volume.
+func (driver *localPersistDriver) Adopt(name string, dir string) error {
+	log.Debug("Adopt called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	if _, exists := driver.volumes[name]; exists {
+		return fmt.Errorf("the volume %s already exists", name)
+	}
+
+	pool, _, err := driver.poolOf(dir)
+	if err != nil {
+		return err
+	}
+	if pool == DEFAULTPOOL {
+		pool = ""
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("path %s is a %s, not a directory", dir, fileType(fi.Mode()))
+	}
+
+	driver.volumes[name] = &localPersistVolume{
+		Mountpoint: filepath.Clean(dir),
+		CreatedAt:  time.Now().Local().Format("2006-01-02T15:04:05Z07:00"),
+		Pool:       pool,
+	}
+
+	if err := driver.saveState(); err != nil {
+		delete(driver.volumes, name)
+		return fmt.Errorf("error %s", err)
+	}
+
+	log.Infof("Adopted directory %s as volume %s", dir, name)
+
+	return nil
+}
+
+// Forget removes a volume from the state without touching its directory.
+func (driver *localPersistDriver) Forget(name string) error {
+	log.Debug("Forget called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if len(v.Mounts) > 0 {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	if err := requireNotRestoring(name, v); err != nil {
+		return err
+	}
+	if dependents := driver.dependents(name); len(dependents) > 0 {
+		return fmt.Errorf("volume %s is used by %s", name, strings.Join(dependents, ", "))
+	}
+	delete(driver.volumes, name)
+
+	if err := driver.saveState(); err != nil {
+		driver.volumes[name] = v
+		return fmt.Errorf("error %s", err)
+	}
+
+	log.Infof("Forgot volume %s", name)
+
+	return nil
+}
+
+// Trash moves an untracked directory into the trash directory of its pool and returns its
+// new location. Directories that contain a volume or are inside one are refused.
+func (driver *localPersistDriver) Trash(dir string) (string, error) {
+	log.Debug("Trash called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	_, root, err := driver.poolOf(dir)
+	if err != nil {
+		return "", err
+	}
+
+	dir = filepath.Clean(dir)
+	for name, v := range driver.volumes {
+		if v.Mountpoint == "" {
+			continue
+		}
+		contains, _ := isSubDir(dir, v.Mountpoint)
+		inside, _ := isSubDir(v.Mountpoint, dir)
+		if contains || inside || filepath.Clean(v.Mountpoint) == dir {
+			return "", fmt.Errorf("directory %s is in use by volume %s", dir, name)
+		}
+	}
+
+	return moveToTrash(root, filepath.Base(dir), dir)
+}
+
+// moveToTrash moves src to <root>/TRASHDIR/<name>/<timestamp>.
+func moveToTrash(root string, name string, src string) (string, error) {
+	trashDir := filepath.Join(root, TRASHDIR, name)
+	if err := ensureDir(trashDir, 0700); err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(trashDir, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+
+	log.Infof("Moved %s to trash at %s", src, dst)
+
+	return dst, nil
+}
+
+// dirSize returns the total size of the regular files below path.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return size, err
+}
+
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconcileOptions are the actions Reconcile applies to the drift it finds.
+type ReconcileOptions struct {
+	// Adopt registers every untracked directory as a volume, named after its path in the pool.
+	Adopt bool `json:"adopt"`
+	// Trash moves every untracked directory to the trash.
+	Trash bool `json:"trash"`
+	// Forget removes every volume with a missing mountpoint from the state.
+	Forget bool `json:"forget"`
+}
+
+// Reconcile finds the drift and resolves it as requested. It returns the drift found before
+// anything was resolved.
+func (driver *localPersistDriver) Reconcile(opts ReconcileOptions) (*DriftReport, error) {
+	log.Debug("Reconcile called")
+
+	if opts.Adopt && opts.Trash {
+		return nil, fmt.Errorf("adopt and trash are mutually exclusive")
+	}
+
+	report, err := driver.Drift()
+	if err != nil {
+		return nil, err
+	}
+
+	roots := driver.poolRoots()
+	for _, u := range report.Untracked {
+		switch {
+		case opts.Adopt:
+			rel, err := filepath.Rel(roots[u.Pool], u.Path)
+			if err != nil {
+				return nil, err
+			}
+			if err := driver.Adopt(strings.ReplaceAll(rel, string(filepath.Separator), "-"), u.Path); err != nil {
+				return nil, err
+			}
+		case opts.Trash:
+			if _, err := driver.Trash(u.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.Forget {
+		for _, m := range report.Missing {
+			if err := driver.Forget(m.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// TrashEntry is a directory in the trash of a pool.
+type TrashEntry struct {
+	Pool      string    `json:"pool"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	TrashedAt time.Time `json:"trashedAt"`
+}
+
+// TrashEntries lists the trash of every pool.
+func (driver *localPersistDriver) TrashEntries() ([]TrashEntry, error) {
+	log.Debug("TrashEntries called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	entries := []TrashEntry{}
+	for pool, root := range driver.poolRoots() {
+		names, err := os.ReadDir(filepath.Join(root, TRASHDIR))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			dir := filepath.Join(root, TRASHDIR, name.Name())
+			trashed, err := os.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range trashed {
+				p := filepath.Join(dir, t.Name())
+				size, err := dirSize(p)
+				if err != nil {
+					return nil, err
+				}
+				at, _ := time.Parse("20060102T150405.000000000Z", t.Name())
+				entries = append(entries, TrashEntry{Pool: pool, Name: name.Name(), Path: p, Size: size, TrashedAt: at})
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// DeleteTrash deletes a directory in the trash for good.
+func (driver *localPersistDriver) DeleteTrash(path string) error {
+	log.Debug("DeleteTrash called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	for _, root := range driver.poolRoots() {
+		if inside, _ := isSubDir(filepath.Join(root, TRASHDIR), path); inside {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			log.Infof("Deleted %s from the trash", path)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in the trash", path)
+}
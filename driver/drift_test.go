@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Drift(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	tracked := path.Join(DATAPATH, "nested", "tracked")
+	untracked := path.Join(DATAPATH, "nested", "untracked")
+	missing := path.Join(DATAPATH, "missing")
+	file := path.Join(DATAPATH, "file")
+
+	for _, dir := range []string{tracked, untracked, path.Join(DATAPATH, TRASHDIR, "old")} {
+		if err := ensureDir(dir, 0755); err != nil {
+			t.Fatalf("Could not ensureDir %s", dir)
+		}
+	}
+	if err := os.WriteFile(path.Join(untracked, "data"), []byte("12345"), 0644); err != nil {
+		t.Fatalf("Could not create file in %s", untracked)
+	}
+	if err := os.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatalf("Could not create file %s", file)
+	}
+
+	driver := &localPersistDriver{
+		Name: "local-persist-test",
+		volumes: map[string]*localPersistVolume{
+			"tracked": {Mountpoint: tracked},
+			"missing": {Mountpoint: missing},
+			"file":    {Mountpoint: file},
+		},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+
+	report, err := driver.Drift()
+	if err != nil {
+		t.Fatalf("localPersistDriver.Drift() error = %v", err)
+	}
+
+	if len(report.Untracked) != 1 || report.Untracked[0].Path != filepath.Clean(untracked) || report.Untracked[0].Size != 5 {
+		t.Errorf("localPersistDriver.Drift() untracked = %v, want %s with size 5", report.Untracked, untracked)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Name != "missing" {
+		t.Errorf("localPersistDriver.Drift() missing = %v, want volume missing", report.Missing)
+	}
+	if len(report.TypeMismatches) != 1 || report.TypeMismatches[0].Type != "file" {
+		t.Errorf("localPersistDriver.Drift() type mismatches = %v, want volume file", report.TypeMismatches)
+	}
+
+	if err := driver.Adopt("adopted", untracked); err != nil {
+		t.Errorf("localPersistDriver.Adopt() error = %v", err)
+	}
+	if err := driver.Adopt("adopted", untracked); err == nil {
+		t.Errorf("localPersistDriver.Adopt() of existing volume should give error")
+	}
+	if err := driver.Adopt("outside", BASEDIR); err == nil {
+		t.Errorf("localPersistDriver.Adopt() of directory outside the data path should give error")
+	}
+	if _, err := driver.Trash(untracked); err == nil {
+		t.Errorf("localPersistDriver.Trash() of an adopted directory should give error")
+	}
+
+	if err := driver.Forget("missing"); err != nil {
+		t.Errorf("localPersistDriver.Forget() error = %v", err)
+	}
+	if err := driver.Forget("missing"); err == nil {
+		t.Errorf("localPersistDriver.Forget() of non-existing volume should give error")
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "adopted-view", Options: map[string]string{"view-of": "adopted"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if err := driver.Forget("adopted"); err == nil {
+		t.Errorf("localPersistDriver.Forget() of a viewed volume should give error")
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "busy", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "busy", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	if err := driver.Forget("busy"); err == nil {
+		t.Errorf("localPersistDriver.Forget() of a volume in use should give error")
+	}
+
+	report, err = driver.Drift()
+	if err != nil {
+		t.Fatalf("localPersistDriver.Drift() error = %v", err)
+	}
+	if len(report.Untracked) != 0 || len(report.Missing) != 0 {
+		t.Errorf("localPersistDriver.Drift() = %v, want no untracked or missing entries", report)
+	}
+}
+
+func Test_localPersistDriver_Trash(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	untracked := path.Join(DATAPATH, "untracked")
+	if err := ensureDir(untracked, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", untracked)
+	}
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+
+	dst, err := driver.Trash(untracked)
+	if err != nil {
+		t.Fatalf("localPersistDriver.Trash() error = %v", err)
+	}
+	if _, err := os.Stat(untracked); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Trash() directory %s still exists", untracked)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Errorf("localPersistDriver.Trash() directory %s does not exist", dst)
+	}
+	if _, err := driver.Trash(path.Join(BASEDIR, "state")); err == nil {
+		t.Errorf("localPersistDriver.Trash() of directory outside the data path should give error")
+	}
+
+	if err := driver.Create(&volume.CreateRequest{Name: "live", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	inside := path.Join(DATAPATH, "live", "data")
+	if err := ensureDir(inside, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", inside)
+	}
+	if _, err := driver.Trash(inside); err == nil {
+		t.Errorf("localPersistDriver.Trash() of directory inside a volume should give error")
+	}
+	if _, err := os.Stat(inside); err != nil {
+		t.Errorf("localPersistDriver.Trash() moved directory %s of a volume", inside)
+	}
+}
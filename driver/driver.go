@@ -8,9 +8,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
     "time"
 
 	"github.com/docker/go-plugins-helpers/volume"
@@ -26,11 +26,44 @@ type localPersistDriver struct {
 	volumes       map[string]*localPersistVolume
 	stateFilePath string
 	dataPath      string
+	config        Config
+
+	usageLock sync.Mutex
+	usage     map[string]*SoftLimitUsage
+
+	metrics *metricsRegistry
+	// requests numbers the requests of the instrumented drivers, see instrumentedDriver
+	requests atomic.Uint64
 }
 
 type localPersistVolume struct {
     Mountpoint string
     CreatedAt  string
+	Pool       string `json:",omitempty"`
+	ProjectID  uint32        `json:",omitempty"`
+	Quota      *QuotaLimits  `json:",omitempty"`
+	SoftLimit  uint64        `json:",omitempty"`
+	Backend    string        `json:",omitempty"`
+	Image      *imageState   `json:",omitempty"`
+	Overlay    *overlayState `json:",omitempty"`
+	View       *viewState    `json:",omitempty"`
+	ReadOnly   bool          `json:",omitempty"`
+	// Parent is the volume this volume is a subdirectory of
+	Parent string `json:",omitempty"`
+	// PerMount volumes give every mount its own subdirectory, named after the mount ID
+	PerMount  bool     `json:",omitempty"`
+	MountDirs []string `json:",omitempty"`
+	// Ephemeral volumes are cleared when their last user is gone, see ephemeralOption
+	Ephemeral string  `json:",omitempty"`
+	Expiry    *expiry `json:",omitempty"`
+	// LastUsedAt is the time the volume was created or its last user was gone
+	LastUsedAt *time.Time    `json:",omitempty"`
+	Archive    *archiveState `json:",omitempty"`
+	// Mounts are the IDs of the active mounts of the volume
+	Mounts []string `json:",omitempty"`
+
+	// restoring is closed when the restore of the archive in progress is done
+	restoring chan struct{}
 }
 
 type saveData struct {
@@ -38,17 +71,17 @@ type saveData struct {
 }
 
 func NewLocalPersistDriver(statePath string, dataPath string) (*localPersistDriver, error) {
-	log.Info("Starting")
-	debug := os.Getenv("DEBUG")
-	if ok, _ := strconv.ParseBool(debug); ok {
-		log.SetLevel(log.DebugLevel)
+	if err := ConfigureLogging(); err != nil {
+		return nil, err
 	}
+	log.Info("Starting")
 
 	driver := localPersistDriver{
 		Name:          "local-persist",
 		volumes:       map[string]*localPersistVolume{},
 		stateFilePath: path.Join(statePath, STATEFILE),
 		dataPath:      dataPath,
+		metrics:       newMetricsRegistry(),
 	}
 
 	var err error
@@ -63,6 +96,26 @@ func NewLocalPersistDriver(statePath string, dataPath string) (*localPersistDriv
 		return nil, err
 	}
 
+	driver.config, err = loadConfig(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, p := range driver.config.Pools {
+		if name == DEFAULTPOOL {
+			continue
+		}
+		err = ensureDir(p.Path, 0755)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Using pool %s at %s", name, p.Path)
+	}
+
+	for _, prefix := range driver.config.AllowedPrefixes {
+		log.Infof("Allowing absolute mountpoints under %s", prefix)
+	}
+
 	data, err := os.ReadFile(driver.stateFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -96,7 +149,87 @@ func (driver *localPersistDriver) Get(req *volume.GetRequest) (*volume.GetRespon
 
 	log.Debugf("Found %s", req.Name)
 
-    return &volume.GetResponse{Volume: &volume.Volume{Name: req.Name, Mountpoint: v.Mountpoint, CreatedAt: v.CreatedAt}}, nil
+    return &volume.GetResponse{Volume: &volume.Volume{Name: req.Name, Mountpoint: v.Mountpoint, CreatedAt: v.CreatedAt, Status: driver.status(req.Name, v)}}, nil
+}
+
+// status returns the driver specific status of a volume, or nil if there is nothing to report.
+func (driver *localPersistDriver) status(name string, v *localPersistVolume) map[string]interface{} {
+	status := map[string]interface{}{}
+
+	if v.Pool != "" {
+		status["pool"] = v.Pool
+	}
+
+	if v.Backend != "" && v.Backend != BACKENDDIRECTORY {
+		status["backend"] = v.Backend
+	}
+
+	if v.ReadOnly {
+		status["readonly"] = true
+	}
+
+	if v.Parent != "" {
+		status["parent"] = v.Parent
+	}
+	if children := driver.children(name); len(children) > 0 {
+		status["children"] = children
+	}
+
+	if v.PerMount {
+		status["mountDirs"] = v.MountDirs
+	}
+
+	if v.Ephemeral != "" {
+		status["ephemeral"] = v.Ephemeral
+	}
+
+	if next := expiration(v); next != nil {
+		status["expiration"] = next
+	}
+
+	if v.Archive != nil {
+		status["tier"] = TIERARCHIVED
+		status["archive"] = v.Archive
+	} else if driver.config.Archive != nil {
+		status["tier"] = TIERHOT
+	}
+
+	if v.View != nil {
+		status["viewOf"] = v.View.Source
+		if v.View.Subpath != "" {
+			status["viewOf"] = v.View.Source + ":" + v.View.Subpath
+		}
+	}
+
+	if v.Overlay != nil {
+		status["overlayOf"] = v.Overlay.Source
+		if v.Overlay.Snapshot != "" {
+			status["overlayOf"] = v.Overlay.Source + "@" + v.Overlay.Snapshot
+		}
+	}
+
+	if v.ProjectID != 0 {
+		usage, err := projectUsage(v.Mountpoint, v.ProjectID)
+		if err != nil {
+			log.Warnf("Could not get quota usage of volume %s: %s", name, err)
+			status["quota"] = err.Error()
+		} else {
+			status["quota"] = usage
+		}
+	}
+
+	if v.SoftLimit > 0 {
+		if usage := driver.softLimitUsage(name); usage != nil {
+			status["softLimit"] = usage
+		} else {
+			status["softLimit"] = &SoftLimitUsage{Limit: v.SoftLimit}
+		}
+	}
+
+	if len(status) == 0 {
+		return nil
+	}
+	return status
 }
 
 func (driver *localPersistDriver) List() (*volume.ListResponse, error) {
@@ -116,7 +249,12 @@ func (driver *localPersistDriver) List() (*volume.ListResponse, error) {
 }
 
 func (driver *localPersistDriver) Create(req *volume.CreateRequest) error {
-	log.Debug("Create called")
+	return driver.create(defaultLogger(), req)
+}
+
+// create is Create with the logger of the request.
+func (driver *localPersistDriver) create(logger *log.Entry, req *volume.CreateRequest) error {
+	logger.Debug("Create called")
 
 	driver.Lock()
 	defer driver.Unlock()
@@ -126,21 +264,44 @@ func (driver *localPersistDriver) Create(req *volume.CreateRequest) error {
 		return fmt.Errorf("the volume %s already exists", req.Name)
 	}
 
-    vol := &localPersistVolume{}
-	mountpoint := req.Options["mountpoint"]
+	poolName := req.Options["pool"]
+	if poolName == DEFAULTPOOL {
+		poolName = ""
+	}
+	if parent, ok := driver.volumes[req.Options["parent"]]; ok && req.Options["pool"] == "" {
+		// Children are in the pool of their parent
+		poolName = parent.Pool
+	}
+	root, err := driver.poolPath(poolName)
+	if err != nil {
+		return err
+	}
+	options := driver.poolOptions(poolName, req.Options)
 
-	switch {
-	case mountpoint == "":
-		mountpoint = path.Join(driver.dataPath, req.Name)
-		log.Debugf("No mountpoint option provided. Setting mountpoint to %s", mountpoint)
+    vol := &localPersistVolume{Pool: poolName}
+	mountpoint := options["mountpoint"]
 
-	case mountpoint != "":
-		mountpoint = path.Join(driver.dataPath, mountpoint)
-		log.Debugf("Mountpoint is %s", mountpoint)
+	switch {
+	case options["parent"] != "":
+		if mountpoint != "" {
+			return fmt.Errorf("the parent and mountpoint options are mutually exclusive")
+		}
+		mountpoint, err = driver.childMountpoint(options["parent"], options["subpath"], poolName)
+		if err != nil {
+			return err
+		}
+		root = driver.volumes[options["parent"]].Mountpoint
+		vol.Parent = options["parent"]
+		logger.Debugf("Volume is a child of %s. Setting mountpoint to %s", vol.Parent, mountpoint)
 
+	default:
+		mountpoint, root, err = driver.resolveMountpoint(req.Name, poolName, root, options)
+		if err != nil {
+			return err
+		}
 	}
 
-	isSubDir, err := isSubDir(driver.dataPath, mountpoint)
+	isSubDir, err := isSubDir(root, mountpoint)
 	if err != nil {
 		return err
 	}
@@ -148,20 +309,62 @@ func (driver *localPersistDriver) Create(req *volume.CreateRequest) error {
 		return err
 	}
 
-	err = ensureDir(mountpoint, 0755)
+	backendName := options["backend"]
+	if backendName == "" {
+		backendName = defaultBackend(mountpoint, options)
+	}
+	if options["overlay-of"] != "" && backendName != BACKENDOVERLAY {
+		return fmt.Errorf("the overlay-of option needs the %s backend", BACKENDOVERLAY)
+	}
+	if options["view-of"] != "" && backendName != BACKENDVIEW {
+		return fmt.Errorf("the view-of option needs the %s backend", BACKENDVIEW)
+	}
+	if vol.Parent != "" && backendName != BACKENDDIRECTORY {
+		return fmt.Errorf("children of volumes need the %s backend", BACKENDDIRECTORY)
+	}
+	backend, err := driver.backend(backendName)
+	if err != nil {
+		return err
+	}
+
+	vol.Backend = backendName
+	vol.Mountpoint = mountpoint
+	vol.SoftLimit, err = softLimitOption(options)
+	if err != nil {
+		return err
+	}
+	vol.ReadOnly, err = readOnlyOption(options)
+	if err != nil {
+		return err
+	}
+	vol.PerMount, err = perMountOption(options)
+	if err != nil {
+		return err
+	}
+	if vol.PerMount && (vol.ReadOnly || backendName == BACKENDVIEW) {
+		return fmt.Errorf("read-only volumes cannot be per-mount")
+	}
+	vol.Ephemeral, err = ephemeralOption(options)
+	if err != nil {
+		return err
+	}
+	vol.Expiry, err = expiryOptions(options, time.Now())
 	if err != nil {
 		return err
 	}
-    // Docker daemon seems to need this format for parsing
-    timestamp := time.Now().Local().Format("2006-01-02T15:04:05Z07:00")
 
-    log.Debugf("Ensuring directory %s exists", mountpoint)
+	if err := driver.validateEphemeral(req.Name, vol, options); err != nil {
+		return err
+	}
 
+	err = backend.Provision(logger, req.Name, vol, options)
 	if err != nil {
-		return fmt.Errorf("%17s could not create directory %s", " ", mountpoint)
+		return err
 	}
 
-    vol.Mountpoint = mountpoint
+    // Docker daemon seems to need this format for parsing
+    timestamp := time.Now().Local().Format("2006-01-02T15:04:05Z07:00")
+
     vol.CreatedAt = timestamp
 
 	driver.volumes[req.Name] = vol
@@ -171,39 +374,102 @@ func (driver *localPersistDriver) Create(req *volume.CreateRequest) error {
 		return fmt.Errorf("error %s", err)
 	}
 
-	log.Infof("Created volume %s at %s with mountpoint %s", req.Name, timestamp, mountpoint)
+	logger.Infof("Created volume %s at %s with mountpoint %s", req.Name, timestamp, mountpoint)
 
 	return nil
 }
 
+// resolveMountpoint returns the mountpoint of a volume in a pool, from the mountpoint option or
+// the layout of the pool, and the root the mountpoint has to stay inside of.
+func (driver *localPersistDriver) resolveMountpoint(name string, poolName string, root string, options map[string]string) (string, string, error) {
+	mountpoint := options["mountpoint"]
+	hostMountpoint, hostBase, isHostPath := driver.hostMountpoint(mountpoint)
+
+	switch {
+	case mountpoint == "" && driver.layout(poolName) != "":
+		mountpoint, err := driver.layoutMountpoint(root, driver.layout(poolName), name, poolName, options)
+		if err != nil {
+			return "", "", err
+		}
+		log.Debugf("No mountpoint option provided. Setting mountpoint to %s using the layout", mountpoint)
+		return mountpoint, root, nil
+
+	case mountpoint == "":
+		mountpoint = path.Join(root, name)
+		log.Debugf("No mountpoint option provided. Setting mountpoint to %s", mountpoint)
+		return mountpoint, root, nil
+
+	case isHostPath && path.IsAbs(mountpoint) && poolName == "":
+		log.Debugf("Mountpoint %s is under an allowed host prefix. Setting mountpoint to %s", mountpoint, hostMountpoint)
+		return hostMountpoint, hostBase, nil
+
+	default:
+		mountpoint = path.Join(root, mountpoint)
+		log.Debugf("Mountpoint is %s", mountpoint)
+		return mountpoint, root, nil
+	}
+}
+
 func (driver *localPersistDriver) Remove(req *volume.RemoveRequest) error {
-	log.Debug("Remove called")
+	return driver.remove(defaultLogger(), req)
+}
+
+// remove is Remove with the logger of the request.
+func (driver *localPersistDriver) remove(logger *log.Entry, req *volume.RemoveRequest) error {
+	logger.Debug("Remove called")
 
 	driver.Lock()
 	defer driver.Unlock()
 
-	_, ok := driver.volumes[req.Name]
+	return driver.removeVolume(logger, req.Name)
+}
+
+// removeVolume removes a volume from the state, the caller must hold the lock.
+func (driver *localPersistDriver) removeVolume(logger *log.Entry, name string) error {
+	v, ok := driver.volumes[name]
 	// Check if the key exists
 	if !ok {
-		return fmt.Errorf("error deleting volume %s failed as it does not exist", req.Name)
+		return fmt.Errorf("error deleting volume %s failed as it does not exist", name)
+	}
+	if err := requireNotRestoring(name, v); err != nil {
+		return err
+	}
+	if dependents := driver.blockingDependents(name); len(dependents) > 0 {
+		return fmt.Errorf("error deleting volume %s failed: it is used by %s", name, strings.Join(dependents, ", "))
+	}
+	if err := driver.removeChildren(logger, name); err != nil {
+		return fmt.Errorf("error deleting volume %s failed: %s", name, err)
 	}
-	delete(driver.volumes, req.Name)
+	backend, err := driver.backend(v.Backend)
+	if err != nil {
+		return err
+	}
+	if err := backend.Remove(logger, name, v); err != nil {
+		return fmt.Errorf("error deleting volume %s failed: %s", name, err)
+	}
+	delete(driver.volumes, name)
+	driver.forgetUsage(name)
 
-	err := driver.saveState()
+	err = driver.saveState()
 	if err != nil {
 		return fmt.Errorf("error %s", err)
 	}
 
-	log.Infof("Removed volume %s", req.Name)
+	logger.Infof("Removed volume %s", name)
 
 	return nil
 }
 
 func (driver *localPersistDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
-	log.Debug("Mount called")
+	return driver.mount(defaultLogger(), req)
+}
 
-	driver.RLock()
-	defer driver.RUnlock()
+// mount is Mount with the logger of the request.
+func (driver *localPersistDriver) mount(logger *log.Entry, req *volume.MountRequest) (*volume.MountResponse, error) {
+	logger.Debug("Mount called")
+
+	driver.Lock()
+	defer driver.Unlock()
 
 	v, ok := driver.volumes[req.Name]
 
@@ -224,7 +490,52 @@ func (driver *localPersistDriver) Mount(req *volume.MountRequest) (*volume.Mount
 		return &volume.MountResponse{}, fmt.Errorf("Path %s for volume %s is a file, not a directory", p, req.Name)
 	}
 
-	log.Debugf("Mounted %s", req.Name)
+	if err := driver.checkSoftLimit(req.Name); err != nil {
+		return &volume.MountResponse{}, err
+	}
+
+	if v.restoring != nil {
+		if err := driver.awaitRestore(req.Name, v); err != nil {
+			return &volume.MountResponse{}, err
+		}
+	} else if v.Archive != nil {
+		err := driver.restoreVolume(logger, req.Name, v)
+		driver.metrics.job("restore", err)
+		driver.audit(AUDITACTORPLUGIN, "restore", req.Name, nil, err)
+		if err != nil {
+			return &volume.MountResponse{}, err
+		}
+	}
+
+	// The first user
+	if len(v.Mounts) == 0 {
+		if err := driver.mountVolume(logger, req.Name, v); err != nil {
+			return &volume.MountResponse{}, err
+		}
+	}
+
+	changed := false
+	if v.PerMount {
+		p, changed, err = ensureMountDir(v, req.ID)
+		if err != nil {
+			if len(v.Mounts) == 0 {
+				driver.unmountVolume(logger, req.Name, v)
+			}
+			return &volume.MountResponse{}, err
+		}
+	}
+
+	if !contains(v.Mounts, req.ID) {
+		v.Mounts = append(v.Mounts, req.ID)
+		changed = true
+	}
+	if changed {
+		if err := driver.saveState(); err != nil {
+			return &volume.MountResponse{}, fmt.Errorf("error %s", err)
+		}
+	}
+
+	logger.Debugf("Mounted %s", req.Name)
 
 	return &volume.MountResponse{Mountpoint: p}, nil
 }
@@ -232,30 +543,67 @@ func (driver *localPersistDriver) Mount(req *volume.MountRequest) (*volume.Mount
 func (driver *localPersistDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
 	log.Debug("Mount called")
 
-	driver.RLock()
-	defer driver.RUnlock()
+	driver.Lock()
+	defer driver.Unlock()
 
 	v, ok := driver.volumes[req.Name]
 	if !ok {
 		return &volume.PathResponse{}, fmt.Errorf("volume %s not found", req.Name)
 	}
-	log.Debugf("Returned path %s", v)
+	log.Debugf("Returned path %s", v.Mountpoint)
 
 	return &volume.PathResponse{Mountpoint: v.Mountpoint}, nil
 }
 
 func (driver *localPersistDriver) Unmount(req *volume.UnmountRequest) error {
-	log.Debug("Unmount called")
+	return driver.unmount(defaultLogger(), req)
+}
 
-	driver.RLock()
-	defer driver.RUnlock()
+// unmount is Unmount with the logger of the request.
+func (driver *localPersistDriver) unmount(logger *log.Entry, req *volume.UnmountRequest) error {
+	logger.Debug("Unmount called")
 
-	_, ok := driver.volumes[req.Name]
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[req.Name]
 	if !ok {
 		return fmt.Errorf("volume %s not found", req.Name)
 	}
 
-	log.Infof("Unmounted %s", req.Name)
+	if contains(v.Mounts, req.ID) {
+		v.Mounts = remove(v.Mounts, req.ID)
+
+		// The last user is gone
+		var resetErr error
+		if len(v.Mounts) == 0 {
+			// The user is kept until the backend is unmounted, so that the state matches the mounts
+			if v.Ephemeral != "" {
+				if err := driver.clearEphemeral(logger, req.Name, v); err != nil {
+					v.Mounts = append(v.Mounts, req.ID)
+					return err
+				}
+			}
+			if err := driver.unmountVolume(logger, req.Name, v); err != nil {
+				v.Mounts = append(v.Mounts, req.ID)
+				return err
+			}
+			if v.Ephemeral != "" && v.Overlay != nil {
+				resetErr = resetOverlay(v.Overlay)
+			}
+			now := time.Now()
+			v.LastUsedAt = &now
+		}
+
+		if err := driver.saveState(); err != nil {
+			return fmt.Errorf("error %s", err)
+		}
+		if resetErr != nil {
+			return fmt.Errorf("could not reset ephemeral volume %s: %s", req.Name, resetErr)
+		}
+	}
+
+	logger.Infof("Unmounted %s", req.Name)
 
 	return nil
 }
@@ -266,14 +614,22 @@ func (driver *localPersistDriver) Capabilities() *volume.CapabilitiesResponse {
 	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "local"}}
 }
 
-func (driver *localPersistDriver) saveState() error {
+func (driver *localPersistDriver) saveState() (err error) {
+	defer func(start time.Time) {
+		driver.metrics.stateSave(time.Since(start), err)
+	}(time.Now())
 
 	fileData, err := json.Marshal(driver.volumes)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(driver.stateFilePath, fileData, 0600)
+	// Write to a temporary file first, so the state file is replaced atomically
+	tmp := driver.stateFilePath + ".tmp"
+	if err := os.WriteFile(tmp, fileData, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, driver.stateFilePath)
 }
 
 func ensureDir(path string, perm os.FileMode) error {
@@ -290,6 +646,25 @@ func ensureDir(path string, perm os.FileMode) error {
 	return nil
 }
 
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(s []string, e string) []string {
+	var r []string
+	for _, v := range s {
+		if v != e {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
 func testEq(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -323,10 +698,26 @@ func isSubDir(basepath string, targetpath string) (bool, error) {
 		isSubdir = false
 
 	// Now test whether the targetpath is prefixed by the basepath
-	case strings.HasPrefix(absTargetpath, absBasepath):
+	case strings.HasPrefix(absTargetpath, absBasepath+string(filepath.Separator)) || absBasepath == string(filepath.Separator):
 		isSubdir = true
 	}
 
+	// Symlinks in the existing part of the targetpath must not lead outside of the basepath
+	if isSubdir {
+		resolvedBasepath, err := resolveExisting(absBasepath)
+		if err != nil {
+			return false, err
+		}
+		resolvedTargetpath, err := resolveExisting(absTargetpath)
+		if err != nil {
+			return false, err
+		}
+		if resolvedBasepath != string(filepath.Separator) && !strings.HasPrefix(resolvedTargetpath, resolvedBasepath+string(filepath.Separator)) {
+			log.Debugf("resolved target path %s is not in resolved base path %s", resolvedTargetpath, resolvedBasepath)
+			isSubdir = false
+		}
+	}
+
 	log.Debugf("%s is subpath of %s: %v", absTargetpath, absBasepath, isSubdir)
 
 	if !isSubdir {
@@ -334,3 +725,30 @@ func isSubDir(basepath string, targetpath string) (bool, error) {
 	}
 	return isSubdir, nil
 }
+
+// resolveExisting evaluates the symlinks in the longest existing part of an absolute path and
+// appends the part that does not exist (yet).
+func resolveExisting(p string) (string, error) {
+	var rest []string
+	for {
+		_, err := os.Lstat(p)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			break
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{resolved}, rest...)...), nil
+}
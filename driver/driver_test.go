@@ -609,3 +609,25 @@ func Test_localPersistDriver_Unmount(t *testing.T) {
 		})
 	}
 }
+
+func Test_isSubDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		basepath   string
+		targetpath string
+		want       bool
+	}{
+		{name: "Subdirectory, should pass", basepath: "/data", targetpath: "/data/volume", want: true},
+		{name: "Same directory, should fail", basepath: "/data", targetpath: "/data/", want: false},
+		{name: "Sibling with same prefix, should fail", basepath: "/data", targetpath: "/data2/volume", want: false},
+		{name: "Path traversal, should fail", basepath: "/data", targetpath: "/data/../etc", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isSubDir(tt.basepath, tt.targetpath)
+			if got != tt.want || (err != nil) == tt.want {
+				t.Errorf("isSubDir() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// EPHEMERALTRASH is the value of the ephemeral option that moves the contents of a volume to the
+// trash instead of deleting them.
+const EPHEMERALTRASH = "trash"
+
+// ephemeralOption parses the ephemeral option of a new volume: "true" deletes the contents on the
+// last unmount, "trash" moves them to the trash.
+func ephemeralOption(options map[string]string) (string, error) {
+	value, ok := options["ephemeral"]
+	if !ok {
+		return "", nil
+	}
+	if value == EPHEMERALTRASH {
+		return EPHEMERALTRASH, nil
+	}
+	ephemeral, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid ephemeral option %q", value)
+	}
+	if !ephemeral {
+		return "", nil
+	}
+	return "true", nil
+}
+
+// validateEphemeral checks whether a new volume can be ephemeral, and whether the volumes it is
+// carved out of, views or overlays are not.
+func (driver *localPersistDriver) validateEphemeral(name string, v *localPersistVolume, options map[string]string) error {
+	viewed, _, _ := strings.Cut(options["view-of"], ":")
+	overlaid, snapshot, _ := strings.Cut(options["overlay-of"], "@")
+	if snapshot != "" {
+		// Snapshots are not cleared with their volume
+		overlaid = ""
+	}
+	for _, source := range []string{v.Parent, viewed, overlaid} {
+		if sv, ok := driver.volumes[source]; ok && sv.Ephemeral != "" {
+			return fmt.Errorf("volume %s is ephemeral, its contents cannot be used by other volumes", source)
+		}
+	}
+
+	switch {
+	case v.Ephemeral == "":
+		return nil
+	case v.ReadOnly || v.Backend == BACKENDVIEW:
+		return fmt.Errorf("read-only volumes cannot be ephemeral")
+	case v.Ephemeral == EPHEMERALTRASH && v.Backend != BACKENDDIRECTORY:
+		return fmt.Errorf("only volumes with the %s backend can move their contents to the trash", BACKENDDIRECTORY)
+	case len(driver.dependents(name)) > 0:
+		return fmt.Errorf("volumes used by other volumes (%s) cannot be ephemeral", strings.Join(driver.dependents(name), ", "))
+	}
+	return nil
+}
+
+// dependentPaths returns the directories of an ephemeral volume used by other volumes, which are
+// not cleared. Only states written before creating those volumes was refused can have them.
+func (driver *localPersistDriver) dependentPaths(name string, v *localPersistVolume) map[string]bool {
+	paths := map[string]bool{}
+	for _, dependent := range driver.dependents(name) {
+		dv := driver.volumes[dependent]
+		switch {
+		case dv.Parent == name:
+			paths[filepath.Clean(dv.Mountpoint)] = true
+		case dv.View != nil:
+			paths[filepath.Clean(filepath.Join(v.Mountpoint, dv.View.Subpath))] = true
+		case dv.Overlay != nil && dv.Overlay.Snapshot == "":
+			paths[filepath.Clean(v.Mountpoint)] = true
+		}
+	}
+	return paths
+}
+
+// holdsPath reports whether dir is one of paths or contains one of them.
+func holdsPath(dir string, paths map[string]bool) bool {
+	dir = filepath.Clean(dir)
+	for p := range paths {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// clearEphemeral clears the contents of an ephemeral volume after its last user is gone. Mounted
+// backends are cleared before they are unmounted, overlays are reset after.
+func (driver *localPersistDriver) clearEphemeral(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Overlay != nil {
+		return nil
+	}
+
+	keep := driver.dependentPaths(name, v)
+	if keep[filepath.Clean(v.Mountpoint)] {
+		logger.Warnf("Not clearing ephemeral volume %s, it is overlaid by another volume", name)
+		return nil
+	}
+
+	var err error
+	if v.Ephemeral == EPHEMERALTRASH {
+		err = driver.trashContents(logger, name, v, keep)
+	} else {
+		err = emptyDir(logger, v.Mountpoint, keep)
+	}
+	if err != nil {
+		return fmt.Errorf("could not clear ephemeral volume %s: %s", name, err)
+	}
+	v.MountDirs = nil
+
+	logger.Infof("Cleared ephemeral volume %s", name)
+
+	return nil
+}
+
+// emptyDir deletes everything below dir, without following symlinks, crossing into other
+// filesystems mounted below it or touching the directories in keep.
+func emptyDir(logger *log.Entry, dir string, keep map[string]bool) error {
+	var stat unix.Stat_t
+	if err := unix.Lstat(dir, &stat); err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return emptyTree(logger, dir, stat.Dev, keep)
+}
+
+func emptyTree(logger *log.Entry, dir string, dev uint64, keep map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		p := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Lstat(p, &stat); err != nil {
+			return err
+		}
+		if stat.Dev != dev {
+			logger.Warnf("Not clearing %s, it is on another filesystem", p)
+			continue
+		}
+		if keep[filepath.Clean(p)] {
+			logger.Warnf("Not clearing %s, it is used by another volume", p)
+			continue
+		}
+		if err := emptyTree(logger, p, dev, keep); err != nil {
+			return err
+		}
+		if holdsPath(p, keep) {
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashContents moves the contents of a volume to <pool root>/TRASHDIR/<name>/<timestamp>, skipping
+// other filesystems mounted in it and the entries holding directories in keep.
+func (driver *localPersistDriver) trashContents(logger *log.Entry, name string, v *localPersistVolume, keep map[string]bool) error {
+	root, err := driver.poolPath(v.Pool)
+	if err != nil {
+		return err
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Lstat(v.Mountpoint, &stat); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(v.Mountpoint)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	dst := filepath.Join(root, TRASHDIR, name, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if _, err := isSubDir(filepath.Join(root, TRASHDIR), dst); err != nil {
+		return err
+	}
+	if err := ensureDir(dst, 0700); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		p := filepath.Join(v.Mountpoint, entry.Name())
+		var entryStat unix.Stat_t
+		if err := unix.Lstat(p, &entryStat); err != nil {
+			return err
+		}
+		if entryStat.Dev != stat.Dev {
+			logger.Warnf("Not moving %s to trash, it is on another filesystem", p)
+			continue
+		}
+		if holdsPath(p, keep) {
+			logger.Warnf("Not moving %s to trash, it is used by another volume", p)
+			continue
+		}
+		if err := os.Rename(p, filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	logger.Infof("Moved contents of volume %s to trash at %s", name, dst)
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/sys/unix"
+)
+
+func Test_ephemeralOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "No option, should not be ephemeral", options: map[string]string{}, want: ""},
+		{name: "True, should delete", options: map[string]string{"ephemeral": "true"}, want: "true"},
+		{name: "False, should not be ephemeral", options: map[string]string{"ephemeral": "false"}, want: ""},
+		{name: "Trash, should move to trash", options: map[string]string{"ephemeral": "trash"}, want: EPHEMERALTRASH},
+		{name: "Invalid, should fail", options: map[string]string{"ephemeral": "sometimes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ephemeralOption(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ephemeralOption() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ephemeralOption() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Unmount_ephemeral(t *testing.T) {
+	tests := []struct {
+		name      string
+		ephemeral string
+		wantTrash bool
+	}{
+		{name: "Delete contents", ephemeral: "true"},
+		{name: "Move contents to trash", ephemeral: "trash", wantTrash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDirs(t)
+			defer cleanupBaseDir()
+
+			driver := &localPersistDriver{
+				Name:          "local-persist-test",
+				volumes:       map[string]*localPersistVolume{},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+			}
+			if err := driver.Create(&volume.CreateRequest{Name: "scratch", Options: map[string]string{"ephemeral": tt.ephemeral}}); err != nil {
+				t.Fatalf("localPersistDriver.Create() error = %v", err)
+			}
+			v := driver.volumes["scratch"]
+
+			// A symlink to data outside the volume must not be followed
+			outside := path.Join(BASEDIR, "outside")
+			if err := os.MkdirAll(outside, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path.Join(outside, "keep"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(path.Join("..", "..", "outside"), path.Join(v.Mountpoint, "link")); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range []string{"one", "two"} {
+				if _, err := driver.Mount(&volume.MountRequest{Name: "scratch", ID: id}); err != nil {
+					t.Fatalf("localPersistDriver.Mount() error = %v", err)
+				}
+			}
+			if err := os.MkdirAll(path.Join(v.Mountpoint, "dir", "sub"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path.Join(v.Mountpoint, "dir", "sub", "file"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := driver.Unmount(&volume.UnmountRequest{Name: "scratch", ID: "one"}); err != nil {
+				t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+			}
+			if _, err := os.Stat(path.Join(v.Mountpoint, "dir", "sub", "file")); err != nil {
+				t.Errorf("localPersistDriver.Unmount() cleared the volume while it is still in use")
+			}
+
+			if err := driver.Unmount(&volume.UnmountRequest{Name: "scratch", ID: "two"}); err != nil {
+				t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+			}
+			entries, err := os.ReadDir(v.Mountpoint)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("localPersistDriver.Unmount() left %v, %v in the volume", entries, err)
+			}
+			if _, err := os.Stat(path.Join(outside, "keep")); err != nil {
+				t.Errorf("localPersistDriver.Unmount() followed a symlink out of the volume")
+			}
+
+			trash, _ := os.ReadDir(path.Join(DATAPATH, TRASHDIR, "scratch"))
+			if (len(trash) > 0) != tt.wantTrash {
+				t.Errorf("localPersistDriver.Unmount() trash = %v, want trash %v", trash, tt.wantTrash)
+			}
+		})
+	}
+}
+
+func Test_emptyDir_otherFilesystem(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting a tmpfs needs root")
+	}
+
+	dir := t.TempDir()
+	mnt := path.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("could not mount tmpfs: %s", err)
+	}
+	defer unix.Unmount(mnt, 0)
+	if err := os.WriteFile(path.Join(mnt, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := emptyDir(defaultLogger(), dir, nil); err != nil {
+		t.Fatalf("emptyDir() error = %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Errorf("emptyDir() did not delete file")
+	}
+	if _, err := os.Stat(path.Join(mnt, "keep")); err != nil {
+		t.Errorf("emptyDir() crossed into another filesystem")
+	}
+}
+
+func Test_localPersistDriver_Create_ephemeralDependents(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "scratch", Options: map[string]string{"ephemeral": "true"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if err := os.MkdirAll(path.Join(driver.volumes["scratch"].Mountpoint, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options map[string]string
+	}{
+		{name: "Child of an ephemeral volume, should fail", options: map[string]string{"parent": "scratch", "subpath": "sub"}},
+		{name: "View of an ephemeral volume, should fail", options: map[string]string{"view-of": "scratch:sub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := driver.Create(&volume.CreateRequest{Name: "dependent", Options: tt.options}); err == nil {
+				t.Errorf("localPersistDriver.Create() should refuse to depend on an ephemeral volume")
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Unmount_ephemeralChild(t *testing.T) {
+	tests := []struct {
+		name      string
+		ephemeral string
+	}{
+		{name: "Delete contents", ephemeral: "true"},
+		{name: "Move contents to trash", ephemeral: "trash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDirs(t)
+			defer cleanupBaseDir()
+
+			driver := &localPersistDriver{
+				Name:          "local-persist-test",
+				volumes:       map[string]*localPersistVolume{},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+			}
+			if err := driver.Create(&volume.CreateRequest{Name: "project", Options: map[string]string{}}); err != nil {
+				t.Fatalf("localPersistDriver.Create() error = %v", err)
+			}
+			if err := driver.Create(&volume.CreateRequest{Name: "api", Options: map[string]string{"parent": "project", "subpath": "services/api"}}); err != nil {
+				t.Fatalf("localPersistDriver.Create() error = %v", err)
+			}
+			// A state written before ephemeral volumes with children were refused
+			parent, child := driver.volumes["project"], driver.volumes["api"]
+			parent.Ephemeral = tt.ephemeral
+
+			for _, name := range []string{"project", "api"} {
+				if _, err := driver.Mount(&volume.MountRequest{Name: name, ID: name}); err != nil {
+					t.Fatalf("localPersistDriver.Mount() error = %v", err)
+				}
+			}
+			if err := os.WriteFile(path.Join(child.Mountpoint, "data"), []byte("keep"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path.Join(parent.Mountpoint, "scratch"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := driver.Unmount(&volume.UnmountRequest{Name: "project", ID: "project"}); err != nil {
+				t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+			}
+			if _, err := os.Stat(path.Join(parent.Mountpoint, "scratch")); !os.IsNotExist(err) {
+				t.Errorf("localPersistDriver.Unmount() did not clear the parent")
+			}
+			if data, err := os.ReadFile(path.Join(child.Mountpoint, "data")); err != nil || string(data) != "keep" {
+				t.Errorf("localPersistDriver.Unmount() cleared the data of the child: %v", err)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Unmount_failed(t *testing.T) {
+	tests := []struct {
+		name   string
+		volume *localPersistVolume
+	}{
+		{name: "Failed clear, should keep the user", volume: &localPersistVolume{Mountpoint: path.Join(DATAPATH, "missing"), Ephemeral: "true"}},
+		{name: "Failed backend unmount, should keep the user", volume: &localPersistVolume{Mountpoint: path.Join(DATAPATH, "broken"), Backend: "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDirs(t)
+			defer cleanupBaseDir()
+
+			tt.volume.Mounts = []string{"first"}
+			driver := &localPersistDriver{
+				Name:          "local-persist-test",
+				volumes:       map[string]*localPersistVolume{"test-volume": tt.volume},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+			}
+
+			if err := driver.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "first"}); err == nil {
+				t.Fatalf("localPersistDriver.Unmount() should give error")
+			}
+			if !reflect.DeepEqual(tt.volume.Mounts, []string{"first"}) || tt.volume.LastUsedAt != nil {
+				t.Errorf("localPersistDriver.Unmount() mounts = %v, last used at %v, want the user kept", tt.volume.Mounts, tt.volume.LastUsedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DEFAULTEXPIRYSCANINTERVAL is the default time between two checks for expired volumes.
+const DEFAULTEXPIRYSCANINTERVAL = time.Minute
+
+// Reasons for the expiry of a volume.
+const (
+	EXPIRYTTL  = "ttl"
+	EXPIRYIDLE = "idle"
+)
+
+// expiry is the state of a volume created with the ttl or idle-expiry option.
+type expiry struct {
+	// ExpiresAt is the creation time plus the ttl
+	ExpiresAt  *time.Time `json:",omitempty"`
+	IdleExpiry string     `json:",omitempty"`
+}
+
+// Expiration is the next expiration of a volume.
+type Expiration struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// parseExpiry parses a duration, which may also be given in days, e.g. "7d".
+func parseExpiry(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// expiryOptions parses the ttl and idle-expiry options of a new volume, nil means it never expires.
+func expiryOptions(options map[string]string, now time.Time) (*expiry, error) {
+	if options["ttl"] == "" && options["idle-expiry"] == "" {
+		return nil, nil
+	}
+
+	e := &expiry{}
+	if options["ttl"] != "" {
+		ttl, err := parseExpiry(options["ttl"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl option: %s", err)
+		}
+		expiresAt := now.Add(ttl)
+		e.ExpiresAt = &expiresAt
+	}
+	if options["idle-expiry"] != "" {
+		if _, err := parseExpiry(options["idle-expiry"]); err != nil {
+			return nil, fmt.Errorf("invalid idle-expiry option: %s", err)
+		}
+		e.IdleExpiry = options["idle-expiry"]
+	}
+	return e, nil
+}
+
+// expiration returns the next expiration of a volume, or nil if it does not expire. Volumes in use
+// do not expire by idling.
+func expiration(v *localPersistVolume) *Expiration {
+	if v.Expiry == nil {
+		return nil
+	}
+
+	var next *Expiration
+	if v.Expiry.ExpiresAt != nil {
+		next = &Expiration{At: *v.Expiry.ExpiresAt, Reason: EXPIRYTTL}
+	}
+	if v.Expiry.IdleExpiry != "" && len(v.Mounts) == 0 {
+		idle, err := parseExpiry(v.Expiry.IdleExpiry)
+		if err == nil {
+			at := lastUsed(v).Add(idle)
+			if next == nil || at.Before(next.At) {
+				next = &Expiration{At: at, Reason: EXPIRYIDLE}
+			}
+		}
+	}
+	return next
+}
+
+// lastUsed returns the time the volume was created or its last user was gone.
+func lastUsed(v *localPersistVolume) time.Time {
+	if v.LastUsedAt != nil {
+		return *v.LastUsedAt
+	}
+	createdAt, _ := time.Parse("2006-01-02T15:04:05Z07:00", v.CreatedAt)
+	return createdAt
+}
+
+// ReapExpired removes volumes past their ttl or idle-expiry until the context is cancelled.
+func (driver *localPersistDriver) ReapExpired(ctx context.Context) {
+	interval := driver.config.expiryScanInterval
+	if interval == 0 {
+		interval = DEFAULTEXPIRYSCANINTERVAL
+	}
+	log.Infof("Checking for expired volumes every %s", interval)
+
+	for {
+		driver.reapExpired(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// reapExpired removes the volumes that expired at now and returns their names.
+func (driver *localPersistDriver) reapExpired(now time.Time) []string {
+	logger := log.WithField("job", "expiry")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	var names []string
+	for name := range driver.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reaped := []string{}
+	for _, name := range names {
+		v, ok := driver.volumes[name]
+		if !ok {
+			continue
+		}
+		next := expiration(v)
+		if next == nil || now.Before(next.At) {
+			continue
+		}
+		if len(v.Mounts) > 0 {
+			logger.Infof("Volume %s expired (%s) at %s, but is in use. Skipping it", name, next.Reason, next.At.Format(time.RFC3339))
+			continue
+		}
+		if dependents := driver.dependents(name); len(dependents) > 0 {
+			logger.Infof("Volume %s expired (%s) at %s, but is used by %s. Skipping it", name, next.Reason, next.At.Format(time.RFC3339), strings.Join(dependents, ", "))
+			continue
+		}
+
+		logger.Infof("Volume %s expired (%s) at %s. Removing it", name, next.Reason, next.At.Format(time.RFC3339))
+		var err error
+		if driver.config.ExpiryPurge {
+			err = driver.purgeVolume(logger, name)
+		} else {
+			err = driver.removeVolume(logger, name)
+		}
+		driver.metrics.job("expiry", err)
+		driver.audit(AUDITACTORPLUGIN, "expire", name, map[string]string{"reason": next.Reason, "purge": strconv.FormatBool(driver.config.ExpiryPurge)}, err)
+		if err != nil {
+			logger.Warnf("Could not remove expired volume %s: %s", name, err)
+			continue
+		}
+		reaped = append(reaped, name)
+	}
+	return reaped
+}
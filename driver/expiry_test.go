@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_parseExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "Hours, should pass", s: "12h", want: 12 * time.Hour},
+		{name: "Days, should pass", s: "7d", want: 7 * 24 * time.Hour},
+		{name: "Zero, should fail", s: "0s", wantErr: true},
+		{name: "Negative days, should fail", s: "-1d", wantErr: true},
+		{name: "Garbage, should fail", s: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpiry(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExpiry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseExpiry() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_reapExpired(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	for _, req := range []*volume.CreateRequest{
+		{Name: "ttl", Options: map[string]string{"ttl": "1h"}},
+		{Name: "ttl-in-use", Options: map[string]string{"ttl": "1h"}},
+		{Name: "ttl-viewed", Options: map[string]string{"ttl": "1h"}},
+		{Name: "view", Options: map[string]string{"view-of": "ttl-viewed"}},
+		{Name: "idle", Options: map[string]string{"idle-expiry": "2h"}},
+		{Name: "idle-in-use", Options: map[string]string{"idle-expiry": "2h"}},
+		{Name: "forever", Options: map[string]string{}},
+	} {
+		if err := driver.Create(req); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "invalid", Options: map[string]string{"ttl": "soon"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() with invalid ttl should give error")
+	}
+	for _, name := range []string{"ttl-in-use", "idle-in-use"} {
+		if _, err := driver.Mount(&volume.MountRequest{Name: name, ID: "one"}); err != nil {
+			t.Fatalf("localPersistDriver.Mount() error = %v", err)
+		}
+	}
+
+	got, err := driver.Get(&volume.GetRequest{Name: "idle"})
+	if err != nil {
+		t.Fatalf("localPersistDriver.Get() error = %v", err)
+	}
+	if next, ok := got.Volume.Status["expiration"].(*Expiration); !ok || next.Reason != EXPIRYIDLE {
+		t.Errorf("localPersistDriver.Get() expiration = %v, want idle expiration", got.Volume.Status["expiration"])
+	}
+
+	if reaped := driver.reapExpired(time.Now()); len(reaped) != 0 {
+		t.Errorf("reapExpired() = %v, want nothing before expiry", reaped)
+	}
+
+	reaped := driver.reapExpired(time.Now().Add(3 * time.Hour))
+	want := []string{"idle", "ttl"}
+	if len(reaped) != len(want) || reaped[0] != want[0] || reaped[1] != want[1] {
+		t.Errorf("reapExpired() = %v, want %v", reaped, want)
+	}
+	for _, name := range []string{"ttl-in-use", "ttl-viewed", "idle-in-use", "forever"} {
+		if _, ok := driver.volumes[name]; !ok {
+			t.Errorf("reapExpired() removed %s", name)
+		}
+	}
+}
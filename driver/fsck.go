@@ -0,0 +1,559 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Exit codes of fsck, the same as those of e2fsck.
+const (
+	FSCKCLEAN       = 0
+	FSCKREPAIRED    = 1
+	FSCKUNCORRECTED = 4
+	FSCKERROR       = 8
+)
+
+// FsckOptions select what Fsck does with the issues it finds.
+type FsckOptions struct {
+	// Repair applies the automatic repairs.
+	Repair bool
+	// DryRun only reports the repairs and the change of the state file they would make.
+	DryRun bool
+}
+
+// FsckIssue is an inconsistency between the state file and the data.
+type FsckIssue struct {
+	Volume  string `json:"volume,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Problem string `json:"problem"`
+	// Repair describes the automatic repair, it is empty when the issue needs an operator.
+	Repair   string `json:"repair,omitempty"`
+	Repaired bool   `json:"repaired"`
+
+	// state repairs the in-memory state, apply repairs the data.
+	state func()
+	apply func() error
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Issues []FsckIssue `json:"issues"`
+	// Diff is the change of the state file made, or with DryRun to be made, by the repairs.
+	Diff string `json:"diff,omitempty"`
+}
+
+// ExitCode returns FSCKCLEAN without issues, FSCKREPAIRED when every issue was repaired and
+// FSCKUNCORRECTED otherwise.
+func (r *FsckReport) ExitCode() int {
+	code := FSCKCLEAN
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return FSCKUNCORRECTED
+		}
+		code = FSCKREPAIRED
+	}
+	return code
+}
+
+// WriteText prints the report in a human readable form.
+func (r *FsckReport) WriteText(w io.Writer) error {
+	if len(r.Issues) == 0 {
+		_, err := fmt.Fprintln(w, "No issues found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "VOLUME\tPROBLEM\tREPAIR\n")
+	for _, issue := range r.Issues {
+		repair := issue.Repair
+		switch {
+		case repair == "":
+			repair = "needs an operator"
+		case issue.Repaired:
+			repair += " (done)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", issue.Volume, issue.Problem, repair)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if r.Diff != "" {
+		fmt.Fprintf(w, "\n--- %s\n+++ %s (repaired)\n%s", STATEFILE, STATEFILE, r.Diff)
+	}
+	return nil
+}
+
+// Fsck checks the state file in statePath against the configuration and the data of a stopped
+// plugin: the structure of the state, the location, type and ownership of every mountpoint,
+// duplicated and nested mountpoints, references to other volumes, snapshots, images and archives
+// that no longer exist, and sidecars of volumes that no longer exist.
+func Fsck(statePath string, dataPath string, opts FsckOptions) (*FsckReport, error) {
+	log.Debug("Fsck called")
+
+	if opts.Repair && !opts.DryRun {
+		release, err := LockState(statePath)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	config, err := loadConfig(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := &localPersistDriver{
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: path.Join(statePath, STATEFILE),
+		dataPath:      dataPath,
+		config:        config,
+	}
+	report := &FsckReport{Issues: []FsckIssue{}}
+
+	raw, err := os.ReadFile(driver.stateFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lenient, rewrite := false, false
+	if err == nil {
+		if err := decodeState(raw, &driver.volumes); err != nil {
+			// Unknown fields are dropped by a lenient decode, anything else cannot be repaired
+			driver.volumes = map[string]*localPersistVolume{}
+			if json.Unmarshal(raw, &driver.volumes) != nil {
+				report.Issues = append(report.Issues, FsckIssue{Path: driver.stateFilePath, Problem: err.Error()})
+				return report, nil
+			}
+			lenient = true
+			report.Issues = append(report.Issues, FsckIssue{
+				Path:    driver.stateFilePath,
+				Problem: err.Error(),
+				Repair:  "rewrite the state without unknown fields",
+				state:   func() { rewrite = true },
+			})
+		}
+	}
+
+	before, err := json.MarshalIndent(driver.volumes, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if lenient {
+		// Show the unknown fields that are dropped
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, bytes.TrimSpace(raw), "", "  "); err == nil {
+			before = indented.Bytes()
+		}
+	}
+
+	report.Issues = append(report.Issues, driver.fsckVolumes()...)
+	report.Issues = append(report.Issues, driver.fsckMountpoints()...)
+	report.Issues = append(report.Issues, driver.fsckSidecars()...)
+
+	if !opts.Repair && !opts.DryRun {
+		return report, nil
+	}
+
+	for _, issue := range report.Issues {
+		if issue.state != nil {
+			issue.state()
+		}
+	}
+	after, err := json.MarshalIndent(driver.volumes, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	report.Diff = lineDiff(string(before), string(after))
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		if issue.Repair == "" {
+			continue
+		}
+		if issue.apply != nil {
+			if err := issue.apply(); err != nil {
+				issue.Problem = fmt.Sprintf("%s, repair failed: %s", issue.Problem, err)
+				continue
+			}
+		}
+		issue.Repaired = true
+		log.Infof("Repaired %s: %s", issue.Problem, issue.Repair)
+	}
+
+	if report.Diff != "" || rewrite {
+		if err := driver.saveState(); err != nil {
+			return nil, fmt.Errorf("error %s", err)
+		}
+	}
+	return report, nil
+}
+
+// fsckVolumes checks every volume on its own, sorted by name.
+func (driver *localPersistDriver) fsckVolumes() []FsckIssue {
+	names := make([]string, 0, len(driver.volumes))
+	for name := range driver.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var issues []FsckIssue
+	for _, name := range names {
+		issues = append(issues, driver.fsckVolume(name, driver.volumes[name])...)
+	}
+	return issues
+}
+
+func (driver *localPersistDriver) fsckVolume(name string, v *localPersistVolume) []FsckIssue {
+	if v == nil {
+		return []FsckIssue{{Volume: name, Problem: "volume has no state", Repair: "remove the volume from the state",
+			state: func() { delete(driver.volumes, name) }}}
+	}
+
+	var issues []FsckIssue
+	issue := func(p string, problem string) {
+		issues = append(issues, FsckIssue{Volume: name, Path: p, Problem: problem})
+	}
+	repair := func(p string, problem string, repair string, state func(), apply func() error) {
+		issues = append(issues, FsckIssue{Volume: name, Path: p, Problem: problem, Repair: repair, state: state, apply: apply})
+	}
+
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		issue("", fmt.Sprintf("invalid volume name %q", name))
+	}
+	if _, err := driver.poolPath(v.Pool); err != nil {
+		issue("", err.Error())
+	}
+	if _, err := driver.backend(v.Backend); err != nil {
+		issue("", err.Error())
+	}
+
+	if v.Parent != "" && driver.volumes[v.Parent] == nil {
+		repair("", fmt.Sprintf("parent %s does not exist", v.Parent), "make the volume a standalone volume",
+			func() { v.Parent = "" }, nil)
+	}
+	if source := overlayOf(v); source != "" && driver.volumes[source] == nil {
+		issue("", fmt.Sprintf("overlay source %s does not exist", source))
+	}
+	if source := viewOf(v); source != "" && driver.volumes[source] == nil {
+		issue("", fmt.Sprintf("view source %s does not exist", source))
+	}
+
+	if hasRuntimeState(v) {
+		repair("", fmt.Sprintf("volume is marked as mounted, with %d mounts, while the plugin is stopped", len(v.Mounts)), "forget the mounts",
+			func() { clearRuntimeState(v) }, nil)
+	}
+
+	if v.Mountpoint == "" {
+		issue("", "volume has no mountpoint")
+		return issues
+	}
+
+	if _, err := time.Parse(time.RFC3339, v.CreatedAt); err != nil {
+		createdAt := time.Now()
+		if fi, err := os.Stat(v.Mountpoint); err == nil {
+			createdAt = fi.ModTime()
+		}
+		repair("", fmt.Sprintf("invalid CreatedAt %q", v.CreatedAt), "set it to the modification time of the mountpoint",
+			func() { v.CreatedAt = createdAt.Local().Format(time.RFC3339) }, nil)
+	}
+
+	if err := driver.checkContained(v.Mountpoint); err != nil {
+		issue(v.Mountpoint, err.Error())
+	} else if problem := ownershipProblem(driver.poolRoots(), v.Mountpoint); problem != "" {
+		issue(v.Mountpoint, problem)
+	}
+
+	fi, err := os.Lstat(v.Mountpoint)
+	switch {
+	case os.IsNotExist(err):
+		repair(v.Mountpoint, fmt.Sprintf("mountpoint %s does not exist", v.Mountpoint), "create an empty directory",
+			nil, func() error { return ensureDir(v.Mountpoint, 0755) })
+	case err != nil:
+		issue(v.Mountpoint, err.Error())
+	case !fi.IsDir():
+		issue(v.Mountpoint, fmt.Sprintf("mountpoint %s is a %s, not a directory", v.Mountpoint, fileType(fi.Mode())))
+	}
+
+	if v.Overlay != nil {
+		if _, err := os.Stat(v.Overlay.Lower); err != nil {
+			issue(v.Overlay.Lower, fmt.Sprintf("lower directory %s of the overlay does not exist", v.Overlay.Lower))
+		}
+		for _, dir := range []string{v.Overlay.Upper, v.Overlay.Work} {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				dir := dir
+				repair(dir, fmt.Sprintf("overlay directory %s does not exist", dir), "create an empty directory",
+					nil, func() error { return ensureDir(dir, 0755) })
+			}
+		}
+	}
+	if v.Image != nil {
+		if _, err := os.Stat(v.Image.Path); err != nil {
+			issue(v.Image.Path, fmt.Sprintf("image %s does not exist", v.Image.Path))
+		}
+	}
+	if v.Archive != nil {
+		if _, err := os.Stat(v.Archive.Path); err != nil {
+			issue(v.Archive.Path, fmt.Sprintf("archive %s does not exist", v.Archive.Path))
+		}
+	}
+
+	return issues
+}
+
+// ownershipProblem checks that the directories between the pool root and a mountpoint belong to
+// the plugin, so that nobody else can swap them for a symlink.
+func ownershipProblem(roots map[string]string, mountpoint string) string {
+	root := ""
+	for _, r := range roots {
+		if inside, _ := isSubDir(r, mountpoint); inside {
+			root = r
+			break
+		}
+	}
+	if root == "" {
+		return ""
+	}
+
+	uid := uint32(os.Geteuid())
+	absRoot, _ := filepath.Abs(root)
+	for dir := filepath.Dir(mountpoint); ; dir = filepath.Dir(dir) {
+		if abs, _ := filepath.Abs(dir); abs == absRoot || abs == filepath.Dir(abs) {
+			return ""
+		}
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Uid != uid {
+			return fmt.Sprintf("directory %s above the mountpoint is owned by uid %d", dir, st.Uid)
+		}
+	}
+}
+
+// fsckMountpoints finds volumes sharing a mountpoint, or nested in another volume without being
+// its child.
+func (driver *localPersistDriver) fsckMountpoints() []FsckIssue {
+	names := make([]string, 0, len(driver.volumes))
+	for name, v := range driver.volumes {
+		if v != nil && v.Mountpoint != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var issues []FsckIssue
+	for i, a := range names {
+		va := driver.volumes[a]
+		for _, b := range names[i+1:] {
+			vb := driver.volumes[b]
+			switch {
+			case filepath.Clean(va.Mountpoint) == filepath.Clean(vb.Mountpoint):
+				issues = append(issues, FsckIssue{Volume: a, Path: va.Mountpoint, Problem: fmt.Sprintf("mountpoint is shared with volume %s", b)})
+			case driver.nestedIn(a, b):
+				issues = append(issues, FsckIssue{Volume: a, Path: va.Mountpoint, Problem: fmt.Sprintf("mountpoint is inside volume %s", b)})
+			case driver.nestedIn(b, a):
+				issues = append(issues, FsckIssue{Volume: b, Path: vb.Mountpoint, Problem: fmt.Sprintf("mountpoint is inside volume %s", a)})
+			}
+		}
+	}
+	return issues
+}
+
+// nestedIn reports whether volume a is inside volume b without descending from it.
+func (driver *localPersistDriver) nestedIn(a string, b string) bool {
+	return driver.mountpointNestedIn(driver.volumes[a].Mountpoint, driver.volumes[a].Parent, b)
+}
+
+// mountpointNestedIn reports whether a mountpoint with the given parent is inside volume b without
+// descending from it.
+func (driver *localPersistDriver) mountpointNestedIn(mountpoint string, parent string, b string) bool {
+	if inside, _ := isSubDir(driver.volumes[b].Mountpoint, mountpoint); !inside {
+		return false
+	}
+	seen := map[string]bool{}
+	for p := parent; p != "" && !seen[p]; {
+		if p == b {
+			return false
+		}
+		seen[p] = true
+		if driver.volumes[p] == nil {
+			break
+		}
+		p = driver.volumes[p].Parent
+	}
+	return true
+}
+
+// fsckSidecars finds snapshots, overlay directories, images and archives of volumes that no
+// longer exist, and empty directories in the trash. Sidecars named after a volume in another pool
+// are only reported, they may belong to it.
+func (driver *localPersistDriver) fsckSidecars() []FsckIssue {
+	// The volumes by pool, the driver creates sidecars in the pool of their volume
+	inPool := map[string]map[string]bool{}
+	all := map[string]bool{}
+	for name, v := range driver.volumes {
+		pool := DEFAULTPOOL
+		if v != nil && v.Pool != "" {
+			pool = v.Pool
+		}
+		if inPool[pool] == nil {
+			inPool[pool] = map[string]bool{}
+		}
+		inPool[pool][name] = true
+		all[name] = true
+	}
+
+	var issues []FsckIssue
+	orphans := func(root string, dir string, suffix string, volumes map[string]bool) {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), suffix)
+			if volumes[name] || (suffix != "" && name == e.Name()) {
+				continue
+			}
+			p := filepath.Join(root, dir, e.Name())
+			if all[name] {
+				issues = append(issues, FsckIssue{
+					Volume:  name,
+					Path:    p,
+					Problem: fmt.Sprintf("%s belongs to volume %s, which is in another pool", p, name),
+				})
+				continue
+			}
+			base := e.Name()
+			issues = append(issues, FsckIssue{
+				Path:    p,
+				Problem: fmt.Sprintf("%s belongs to volume %s, which does not exist", p, name),
+				Repair:  "move it to the trash",
+				apply: func() error {
+					_, err := moveToTrash(root, base, p)
+					return err
+				},
+			})
+		}
+	}
+
+	roots := driver.poolRoots()
+	pools := make([]string, 0, len(roots))
+	for pool := range roots {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		root := roots[pool]
+		orphans(root, SNAPSHOTDIR, "", inPool[pool])
+		orphans(root, OVERLAYDIR, "", inPool[pool])
+		orphans(root, IMAGEDIR, ".img", inPool[pool])
+		if driver.config.Archive == nil || driver.config.Archive.Path == "" {
+			orphans(root, ARCHIVEDIR, ".tar.gz", inPool[pool])
+		}
+
+		entries, err := os.ReadDir(filepath.Join(root, TRASHDIR))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			p := filepath.Join(root, TRASHDIR, e.Name())
+			if trashed, err := os.ReadDir(p); err == nil && len(trashed) == 0 {
+				issues = append(issues, FsckIssue{
+					Path:    p,
+					Problem: fmt.Sprintf("trash directory %s is empty", p),
+					Repair:  "remove it",
+					apply:   func() error { return os.Remove(p) },
+				})
+			}
+		}
+	}
+	if driver.config.Archive != nil && driver.config.Archive.Path != "" {
+		orphans(driver.config.Archive.Path, "", ".tar.gz", all)
+	}
+	return issues
+}
+
+// lineDiff returns the changed lines between a and b, with two lines of context, in the style
+// of a unified diff.
+func lineDiff(a string, b string) string {
+	if a == b {
+		return ""
+	}
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, line{' ', x[i]})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', x[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', y[j]})
+			j++
+		}
+	}
+
+	const context = 2
+	var out bytes.Buffer
+	last := -1
+	for k, l := range lines {
+		near := false
+		for d := -context; d <= context; d++ {
+			if k+d >= 0 && k+d < len(lines) && lines[k+d].op != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && k != last+1 {
+			out.WriteString("@@\n")
+		}
+		fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		last = k
+	}
+	return out.String()
+}
@@ -0,0 +1,141 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_Fsck(t *testing.T) {
+	mountpoint := func(dir string) string {
+		abs, _ := os.Getwd()
+		return path.Join(abs, DATAPATH, dir)
+	}
+	volume := func(dir string, extra string) string {
+		return `{"Mountpoint": "` + mountpoint(dir) + `", "CreatedAt": "2024-01-01T00:00:00Z"` + extra + `}`
+	}
+
+	tests := []struct {
+		name        string
+		state       string
+		dirs        []string
+		opts        FsckOptions
+		wantIssues  int
+		wantCode    int
+		wantDiff    string
+		wantMissing string
+	}{
+		{name: "Clean state, should pass", state: `{"a": ` + volume("a", "") + `}`, dirs: []string{"a"}, wantCode: FSCKCLEAN},
+		{name: "Unparseable state, should fail", state: `{"a": `, wantIssues: 1, wantCode: FSCKUNCORRECTED},
+		{name: "Unknown field, should be repaired", state: `{"a": ` + volume("a", `, "Unknown": 1`) + `}`, dirs: []string{"a"}, opts: FsckOptions{Repair: true}, wantIssues: 1, wantCode: FSCKREPAIRED, wantDiff: `-    "Unknown": 1`},
+		{name: "Stale mounts in dry run, should be left", state: `{"a": ` + volume("a", `, "Mounts": ["x"]`) + `}`, dirs: []string{"a"}, opts: FsckOptions{DryRun: true}, wantIssues: 1, wantCode: FSCKUNCORRECTED, wantDiff: `-    "Mounts": [`},
+		{name: "Missing mountpoint, should be repaired", state: `{"a": ` + volume("a", "") + `}`, opts: FsckOptions{Repair: true}, wantIssues: 1, wantCode: FSCKREPAIRED},
+		{name: "Dangling parent, should be repaired", state: `{"a": ` + volume("a", `, "Parent": "gone"`) + `}`, dirs: []string{"a"}, opts: FsckOptions{Repair: true}, wantIssues: 1, wantCode: FSCKREPAIRED, wantDiff: `-    "Parent": "gone"`},
+		{name: "Shared mountpoint, should fail", state: `{"a": ` + volume("a", "") + `, "b": ` + volume("a", "") + `}`, dirs: []string{"a"}, opts: FsckOptions{Repair: true}, wantIssues: 1, wantCode: FSCKUNCORRECTED},
+		{name: "Nested mountpoint, should fail", state: `{"a": ` + volume("a", "") + `, "b": ` + volume("a/b", "") + `}`, dirs: []string{"a/b"}, wantIssues: 1, wantCode: FSCKUNCORRECTED},
+		{name: "Child mountpoint, should pass", state: `{"a": ` + volume("a", "") + `, "b": ` + volume("a/b", `, "Parent": "a"`) + `}`, dirs: []string{"a/b"}, wantCode: FSCKCLEAN},
+		{name: "Dangling overlay snapshot, should fail", state: `{"a": ` + volume("a", `, "Backend": "overlay", "Overlay": {"Source": "a", "Lower": "`+mountpoint(SNAPSHOTDIR+"/a/gone")+`", "Upper": "`+mountpoint("a")+`", "Work": "`+mountpoint("a")+`", "Mounted": false}`) + `}`, dirs: []string{"a"}, wantIssues: 1, wantCode: FSCKUNCORRECTED},
+		{name: "Orphaned snapshots, should be trashed", state: `{}`, dirs: []string{SNAPSHOTDIR + "/gone/first"}, opts: FsckOptions{Repair: true}, wantIssues: 1, wantCode: FSCKREPAIRED, wantMissing: SNAPSHOTDIR + "/gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDirs(t)
+			defer cleanupBaseDir()
+
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(path.Join(DATAPATH, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(path.Join(STATEPATH, STATEFILE), []byte(tt.state), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := Fsck(STATEPATH, DATAPATH, tt.opts)
+			if err != nil {
+				t.Fatalf("Fsck() error = %v", err)
+			}
+			if len(report.Issues) != tt.wantIssues {
+				t.Errorf("Fsck() issues = %+v, want %d", report.Issues, tt.wantIssues)
+			}
+			if code := report.ExitCode(); code != tt.wantCode {
+				t.Errorf("Fsck() exit code = %d, want %d", code, tt.wantCode)
+			}
+			if !strings.Contains(report.Diff, tt.wantDiff) {
+				t.Errorf("Fsck() diff = %s, want %s", report.Diff, tt.wantDiff)
+			}
+			if tt.wantMissing != "" {
+				if _, err := os.Stat(path.Join(DATAPATH, tt.wantMissing)); !os.IsNotExist(err) {
+					t.Errorf("%s still exists", tt.wantMissing)
+				}
+			}
+
+			if tt.opts.Repair && tt.wantCode == FSCKREPAIRED {
+				again, err := Fsck(STATEPATH, DATAPATH, FsckOptions{})
+				if err != nil {
+					t.Fatalf("Fsck() error = %v", err)
+				}
+				if len(again.Issues) != 0 {
+					t.Errorf("Fsck() after repair = %+v, want no issues", again.Issues)
+				}
+			}
+		})
+	}
+}
+
+func Test_lineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{name: "Equal, should be empty", a: "a\nb", b: "a\nb", want: ""},
+		{name: "Changed line, should pass", a: "a\nb\nc", b: "a\nx\nc", want: " a\n-b\n+x\n c\n"},
+		{name: "Distant changes, should be split", a: "1\n2\n3\n4\n5\n6\n7\n8", b: "0\n2\n3\n4\n5\n6\n7\n9", want: "-1\n+0\n 2\n 3\n@@\n 6\n 7\n-8\n+9\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineDiff(tt.a, tt.b); got != tt.want {
+				t.Errorf("lineDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Fsck_sidecarInOtherPool(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	abs, _ := os.Getwd()
+	pool := path.Join(abs, POOLPATH)
+	snapshot := path.Join(DATAPATH, SNAPSHOTDIR, "a", "first")
+	for _, dir := range []string{path.Join(pool, "a"), snapshot} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := `{"poolsMount": "` + path.Join(abs, BASEDIR) + `", "pools": {"ssd": {"path": "` + pool + `"}}}`
+	if err := os.WriteFile(path.Join(STATEPATH, CONFIGFILE), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state := `{"a": {"Mountpoint": "` + path.Join(pool, "a") + `", "CreatedAt": "2024-01-01T00:00:00Z", "Pool": "ssd"}}`
+	if err := os.WriteFile(path.Join(STATEPATH, STATEFILE), []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(STATEPATH, DATAPATH, FsckOptions{Repair: true})
+	if err != nil {
+		t.Fatalf("Fsck() error = %v", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Repair != "" {
+		t.Errorf("Fsck() issues = %+v, want 1 without repair", report.Issues)
+	}
+	if code := report.ExitCode(); code != FSCKUNCORRECTED {
+		t.Errorf("Fsck() exit code = %d, want %d", code, FSCKUNCORRECTED)
+	}
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Errorf("Fsck() moved the snapshot of a volume in another pool: %v", err)
+	}
+}
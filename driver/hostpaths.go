@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HOSTMOUNT is the default path inside the plugin at which the host directory containing the
+// allowed prefixes is mounted.
+const HOSTMOUNT = "/local-persist/host"
+
+// hostMountpoint maps an absolute host path under one of the allowed prefixes to the path
+// inside the plugin and the directory it has to stay contained in. ok is false when the
+// path is not under any allowed prefix. The prefix itself is returned as its own base, so it
+// fails the containment check.
+func (driver *localPersistDriver) hostMountpoint(hostPath string) (mountpoint string, base string, ok bool) {
+	hostPath = filepath.Clean(hostPath)
+
+	for _, prefix := range driver.config.AllowedPrefixes {
+		if _, err := hostRel(prefix, hostPath); err != nil {
+			continue
+		}
+
+		prefixRel, err := hostRel(driver.config.HostPath, prefix)
+		if err != nil {
+			continue
+		}
+		rel, err := hostRel(driver.config.HostPath, hostPath)
+		if err != nil {
+			continue
+		}
+
+		base = filepath.Join(driver.config.HostMount, prefixRel)
+		mountpoint = filepath.Join(driver.config.HostMount, rel)
+		log.Debugf("Host path %s is under allowed prefix %s and maps to %s", hostPath, prefix, mountpoint)
+		return mountpoint, base, true
+	}
+
+	return "", "", false
+}
+
+// hostRel returns target relative to base, if target is base or below it.
+func hostRel(base string, target string) (string, error) {
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is not inside %s", target, base)
+	}
+	return rel, nil
+}
+
+// hostPathOf maps a path inside the host mount back to the host path.
+func (driver *localPersistDriver) hostPathOf(mountpoint string) string {
+	if driver.config.HostMount == "" {
+		return ""
+	}
+	rel, err := hostRel(driver.config.HostMount, filepath.Clean(mountpoint))
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(driver.config.HostPath, rel)
+}
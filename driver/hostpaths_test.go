@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const HOSTMOUNTPATH = "./test/host"
+
+func Test_localPersistDriver_Create_hostPath(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := ensureDir(path.Join(HOSTMOUNTPATH, "docker"), 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", HOSTMOUNTPATH)
+	}
+	// A symlink inside the allowed prefix pointing outside of it
+	if err := os.Symlink("../../data", path.Join(HOSTMOUNTPATH, "docker", "escape")); err != nil {
+		t.Fatalf("Could not create symlink: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		mountpoint string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "Create volume under allowed prefix, should pass",
+			mountpoint: "/srv/docker/app",
+			want:       path.Join(HOSTMOUNTPATH, "docker", "app"),
+		},
+		{
+			name:       "Create volume outside allowed prefixes, should be relative to data path",
+			mountpoint: "/srv/other/app",
+			want:       path.Join(DATAPATH, "srv", "other", "app"),
+		},
+		{
+			name:       "Create volume on allowed prefix itself, should fail",
+			mountpoint: "/srv/docker",
+			wantErr:    true,
+		},
+		{
+			name:       "Create volume under allowed prefix with path traversal, should be relative to data path",
+			mountpoint: "/srv/docker/../../etc",
+			want:       path.Join(DATAPATH, "etc"),
+		},
+		{
+			name:       "Create volume through symlink escaping allowed prefix, should fail",
+			mountpoint: "/srv/docker/escape/app",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &localPersistDriver{
+				Name:          "local-persist-test",
+				volumes:       map[string]*localPersistVolume{},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+				config: Config{
+					AllowedPrefixes: []string{"/srv/docker"},
+					HostPath:        "/srv",
+					HostMount:       HOSTMOUNTPATH,
+				},
+			}
+			err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"mountpoint": tt.mountpoint}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := driver.volumes["test-volume"].Mountpoint; got != tt.want {
+				t.Errorf("localPersistDriver.Create() mountpoint = %s, want %s", got, tt.want)
+			}
+			if _, err := os.Stat(tt.want); err != nil {
+				t.Errorf("localPersistDriver.Create() error directory %s does not exist", tt.want)
+			}
+		})
+	}
+}
+
+func Test_Config_validate_allowedPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "Prefix inside host path, should pass", config: Config{AllowedPrefixes: []string{"/srv/docker/"}, HostPath: "/srv"}},
+		{name: "Prefix equal to host path, should pass", config: Config{AllowedPrefixes: []string{"/srv"}, HostPath: "/srv"}},
+		{name: "Prefix outside host path, should fail", config: Config{AllowedPrefixes: []string{"/mnt"}, HostPath: "/srv"}, wantErr: true},
+		{name: "Relative prefix, should fail", config: Config{AllowedPrefixes: []string{"docker"}, HostPath: "/srv"}, wantErr: true},
+		{name: "Prefix without host path, should fail", config: Config{AllowedPrefixes: []string{"/srv/docker"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tt.config.HostMount != HOSTMOUNT {
+				t.Errorf("Config.validate() host mount = %s, want %s", tt.config.HostMount, HOSTMOUNT)
+			}
+		})
+	}
+}
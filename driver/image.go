@@ -0,0 +1,462 @@
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// IMAGEDIR is the directory inside every pool containing the images of image backed volumes.
+const IMAGEDIR = ".local-persist-images"
+
+// BACKENDIMAGE is the backend option of volumes stored in a loop mounted filesystem image.
+const BACKENDIMAGE = "image"
+
+// imageState is the state of an image backed volume.
+type imageState struct {
+	Path       string
+	FsType     string
+	Size       uint64
+	LoopDevice string `json:",omitempty"`
+	Mounted    bool   `json:",omitempty"`
+}
+
+// imageOptions validates the options of an image backed volume and returns its initial state.
+func imageOptions(root string, name string, options map[string]string) (*imageState, error) {
+	if options["size"] == "" {
+		return nil, fmt.Errorf("the %s backend needs a size option", BACKENDIMAGE)
+	}
+	size, err := ParseSize(options["size"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid size option: %s", err)
+	}
+
+	fstype := options["fstype"]
+	switch fstype {
+	case "":
+		fstype = "ext4"
+	case "ext4", "xfs":
+	default:
+		return nil, fmt.Errorf("unsupported fstype %s, use ext4 or xfs", fstype)
+	}
+
+	image := filepath.Join(root, IMAGEDIR, name+".img")
+	if _, err := isSubDir(filepath.Join(root, IMAGEDIR), image); err != nil {
+		return nil, err
+	}
+
+	return &imageState{Path: image, FsType: fstype, Size: size}, nil
+}
+
+// createImage allocates a sparse image file and formats it. An existing image is reused, so that
+// the data of a removed volume persists when it is created again, but only when it has the
+// requested size and filesystem.
+func createImage(image *imageState) error {
+	fi, err := os.Stat(image.Path)
+	switch {
+	case err == nil && fi.Mode().IsRegular():
+		if uint64(fi.Size()) != image.Size {
+			return fmt.Errorf("existing image %s has a size of %d bytes, not %d", image.Path, fi.Size(), image.Size)
+		}
+		fstype, err := imageFsType(image.Path)
+		if err != nil {
+			return err
+		}
+		if fstype != image.FsType {
+			return fmt.Errorf("existing image %s has a %s filesystem, not %s", image.Path, fstype, image.FsType)
+		}
+		log.Infof("Reusing existing image %s", image.Path)
+		return nil
+	case err == nil:
+		return fmt.Errorf("image %s is a %s, not a file", image.Path, fileType(fi.Mode()))
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	if err := ensureDir(filepath.Dir(image.Path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(image.Path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(int64(image.Size))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(image.Path)
+		return fmt.Errorf("could not allocate image %s: %s", image.Path, err)
+	}
+
+	log.Debugf("Formatting image %s as %s", image.Path, image.FsType)
+
+	out, err := exec.Command("mkfs."+image.FsType, "-q", image.Path).CombinedOutput()
+	if err != nil {
+		os.Remove(image.Path)
+		return fmt.Errorf("could not format image %s as %s: %s: %s", image.Path, image.FsType, err, strings.TrimSpace(string(out)))
+	}
+
+	log.Infof("Created %s image %s of %d bytes", image.FsType, image.Path, image.Size)
+
+	return nil
+}
+
+// imageFsType detects the filesystem of an image by its superblock magic: ext4 (which covers
+// ext2 and ext3 as well) or xfs.
+func imageFsType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 1082)
+	if _, err := io.ReadFull(f, buf); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	switch {
+	case string(buf[:4]) == "XFSB":
+		return "xfs", nil
+	case buf[1080] == 0x53 && buf[1081] == 0xef:
+		return "ext4", nil
+	}
+	return "", fmt.Errorf("image %s has no ext4 or xfs filesystem", path)
+}
+
+// mountImage attaches the image to a free loop device and mounts it on the mountpoint.
+func mountImage(image *imageState, mountpoint string) error {
+	device, err := attachLoop(image.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mount(device, mountpoint, image.FsType, 0, ""); err != nil {
+		detachLoop(device)
+		return fmt.Errorf("could not mount %s on %s: %s", device, mountpoint, err)
+	}
+
+	image.LoopDevice = device
+	image.Mounted = true
+
+	log.Infof("Mounted image %s on %s using %s", image.Path, mountpoint, device)
+
+	return nil
+}
+
+// unmountImage unmounts the image and detaches its loop device.
+func unmountImage(image *imageState, mountpoint string) error {
+	if err := unix.Unmount(mountpoint, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("could not unmount %s: %s", mountpoint, err)
+	}
+
+	if image.LoopDevice != "" {
+		detachLoop(image.LoopDevice)
+	}
+
+	log.Infof("Unmounted image %s from %s", image.Path, mountpoint)
+
+	image.LoopDevice = ""
+	image.Mounted = false
+
+	return nil
+}
+
+func attachLoop(image string) (string, error) {
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer ctl.Close()
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Another process can claim the free loop device before it is configured
+	for attempt := 0; attempt < 5; attempt++ {
+		n, err := unix.IoctlRetInt(int(ctl.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("could not find a free loop device: %s", err)
+		}
+
+		device := fmt.Sprintf("/dev/loop%d", n)
+		if err := ensureLoopDevice(device, n); err != nil {
+			return "", err
+		}
+
+		loop, err := os.OpenFile(device, os.O_RDWR, 0)
+		if err != nil {
+			return "", err
+		}
+
+		// No autoclear: it would detach the device as soon as it is closed, before it is mounted.
+		// Stale devices after a crash are detached by imageBackend.Recover.
+		config := unix.LoopConfig{Fd: uint32(f.Fd())}
+		copy(config.Info.File_name[:], image)
+		err = unix.IoctlLoopConfigure(int(loop.Fd()), &config)
+		loop.Close()
+
+		if errors.Is(err, unix.EBUSY) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not attach %s to %s: %s", image, device, err)
+		}
+
+		log.Debugf("Attached %s to %s", image, device)
+		return device, nil
+	}
+
+	return "", fmt.Errorf("could not attach %s to a loop device: all free loop devices were busy", image)
+}
+
+// ensureLoopDevice creates the device node of a loop device, which does not exist inside the
+// plugin until it is needed.
+func ensureLoopDevice(device string, n int) error {
+	if _, err := os.Stat(device); err == nil {
+		return nil
+	}
+	return unix.Mknod(device, unix.S_IFBLK|0660, int(unix.Mkdev(7, uint32(n))))
+}
+
+func detachLoop(device string) {
+	loop, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		log.Warnf("Could not open loop device %s: %s", device, err)
+		return
+	}
+	defer loop.Close()
+
+	if err := unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0); err != nil && !errors.Is(err, unix.ENXIO) {
+		log.Warnf("Could not detach loop device %s: %s", device, err)
+		return
+	}
+
+	log.Debugf("Detached loop device %s", device)
+}
+
+// loopDevicesOf returns the loop devices backed by the image.
+func loopDevicesOf(image string) ([]string, error) {
+	abs, err := filepath.Abs(image)
+	if err != nil {
+		return nil, err
+	}
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, backingFile := range backingFiles {
+		data, err := os.ReadFile(backingFile)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) == abs {
+			devices = append(devices, "/dev/"+filepath.Base(filepath.Dir(filepath.Dir(backingFile))))
+		}
+	}
+	return devices, nil
+}
+
+// isMounted reports whether a filesystem is mounted on path, according to /proc/self/mountinfo.
+func isMounted(path string) (bool, error) {
+	options, err := mountOptions(path)
+	return options != nil, err
+}
+
+// mountOptions returns the options of the topmost mount on path, or nil if nothing is mounted on it.
+func mountOptions(path string) ([]string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Later mounts on the same path are listed after, and hide, earlier ones
+	var options []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 5 && unescapeMountinfo(fields[4]) == abs {
+			options = strings.Split(fields[5], ",")
+		}
+	}
+	return options, scanner.Err()
+}
+
+// unescapeMountinfo decodes the octal escapes (e.g. \040 for a space) used in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// imageBackend stores volumes in a filesystem image, which is loop mounted on the mountpoint
+// while the volume is in use.
+type imageBackend struct {
+	driver *localPersistDriver
+}
+
+func (b imageBackend) Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error {
+	if options["clone-of"] != "" {
+		return fmt.Errorf("the %s backend cannot clone volumes", BACKENDIMAGE)
+	}
+
+	root, err := b.driver.poolPath(v.Pool)
+	if err != nil {
+		return err
+	}
+	image, err := imageOptions(root, name, options)
+	if err != nil {
+		return err
+	}
+
+	err = ensureDir(v.Mountpoint, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create directory %s: %s", v.Mountpoint, err)
+	}
+
+	err = createImage(image)
+	if err != nil {
+		return err
+	}
+
+	v.Image = image
+	return nil
+}
+
+func (b imageBackend) Mount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Image == nil {
+		return fmt.Errorf("volume %s has no image", name)
+	}
+	if v.Image.Mounted {
+		return nil
+	}
+	return mountImage(v.Image, v.Mountpoint)
+}
+
+func (b imageBackend) Unmount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Image == nil || !v.Image.Mounted {
+		return nil
+	}
+	return unmountImage(v.Image, v.Mountpoint)
+}
+
+func (b imageBackend) Remove(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Image != nil && v.Image.Mounted {
+		return fmt.Errorf("the image of volume %s is still mounted", name)
+	}
+	return nil
+}
+
+func (b imageBackend) Purge(name string, v *localPersistVolume) error {
+	if v.Image != nil {
+		if err := os.Remove(v.Image.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(v.Mountpoint)
+}
+
+func (b imageBackend) Usage(name string, v *localPersistVolume) (uint64, uint64, error) {
+	if v.Image == nil {
+		return 0, 0, fmt.Errorf("volume %s has no image", name)
+	}
+	if v.Image.Mounted {
+		return statfsUsage(v.Mountpoint)
+	}
+
+	// The allocated blocks of the sparse image are the best estimate while it is not mounted
+	var stat unix.Stat_t
+	if err := unix.Stat(v.Image.Path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Blocks) * 512, v.Image.Size, nil
+}
+
+func (b imageBackend) Snapshot(name string, v *localPersistVolume, dst string) error {
+	return ErrSnapshotNotSupported
+}
+
+// Recover mounts the image of a volume that is still in use again and detaches stale loop devices
+// of a volume that is not in use.
+func (b imageBackend) Recover(name string, v *localPersistVolume) (bool, error) {
+	if v.Image == nil {
+		return false, nil
+	}
+
+	mounted, err := isMounted(v.Mountpoint)
+	if err != nil {
+		return false, err
+	}
+	devices, err := loopDevicesOf(v.Image.Path)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case len(v.Mounts) > 0 && mounted:
+		if len(devices) > 0 && v.Image.LoopDevice != devices[0] {
+			v.Image.LoopDevice = devices[0]
+			return true, nil
+		}
+		return false, nil
+
+	case len(v.Mounts) > 0:
+		log.Warnf("Volume %s is in use, but its image is not mounted. Mounting it again", name)
+		for _, device := range devices {
+			detachLoop(device)
+		}
+		v.Image.Mounted = false
+		return true, mountImage(v.Image, v.Mountpoint)
+
+	default:
+		if mounted {
+			log.Warnf("Volume %s is not in use, but its image is mounted. Unmounting it", name)
+			if err := unix.Unmount(v.Mountpoint, 0); err != nil {
+				return false, fmt.Errorf("could not unmount %s: %s", v.Mountpoint, err)
+			}
+		}
+		for _, device := range devices {
+			log.Warnf("Detaching stale loop device %s of volume %s", device, name)
+			detachLoop(device)
+		}
+		if v.Image.Mounted || v.Image.LoopDevice != "" {
+			v.Image.Mounted, v.Image.LoopDevice = false, ""
+			return true, nil
+		}
+		return false, nil
+	}
+}
@@ -0,0 +1,225 @@
+package driver
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_imageOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    *imageState
+		wantErr bool
+	}{
+		{
+			name:    "Size only, should default to ext4",
+			options: map[string]string{"size": "1G"},
+			want:    &imageState{Path: path.Join(DATAPATH, IMAGEDIR, "test-volume.img"), FsType: "ext4", Size: 1 << 30},
+		},
+		{
+			name:    "Size and xfs, should pass",
+			options: map[string]string{"size": "1G", "fstype": "xfs"},
+			want:    &imageState{Path: path.Join(DATAPATH, IMAGEDIR, "test-volume.img"), FsType: "xfs", Size: 1 << 30},
+		},
+		{name: "No size, should fail", options: map[string]string{}, wantErr: true},
+		{name: "Unsupported fstype, should fail", options: map[string]string{"size": "1G", "fstype": "vfat"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := imageOptions(DATAPATH, "test-volume", tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("imageOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("imageOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := imageOptions(DATAPATH, "../../escape", map[string]string{"size": "1G"}); err == nil {
+		t.Errorf("imageOptions() with path traversal in the name should give error")
+	}
+}
+
+func Test_createImage_existing(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	existing := path.Join(DATAPATH, "existing.img")
+	data := make([]byte, 1<<20)
+	copy(data, "XFSB")
+	if err := os.WriteFile(existing, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		image   imageState
+		wantErr bool
+	}{
+		{name: "Same size and fstype, should be reused", image: imageState{Path: existing, FsType: "xfs", Size: 1 << 20}},
+		{name: "Other fstype, should fail", image: imageState{Path: existing, FsType: "ext4", Size: 1 << 20}, wantErr: true},
+		{name: "Other size, should fail", image: imageState{Path: existing, FsType: "xfs", Size: 2 << 20}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := createImage(&tt.image); (err != nil) != tt.wantErr {
+				t.Errorf("createImage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Create_image(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not available")
+	}
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"backend": "image", "size": "16M"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+
+	v := driver.volumes["test-volume"]
+	if v.Backend != BACKENDIMAGE || v.Image == nil || v.ProjectID != 0 {
+		t.Fatalf("localPersistDriver.Create() volume = %+v, want an image backed volume", v)
+	}
+	fi, err := os.Stat(v.Image.Path)
+	if err != nil || fi.Size() != 16<<20 {
+		t.Errorf("localPersistDriver.Create() image %s = %v, %v, want a file of 16M", v.Image.Path, fi, err)
+	}
+
+	// The image persists when the volume is removed and is reused when it is created again
+	if err := driver.Remove(&volume.RemoveRequest{Name: "test-volume"}); err != nil {
+		t.Fatalf("localPersistDriver.Remove() error = %v", err)
+	}
+	if err := os.WriteFile(path.Join(DATAPATH, "marker"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"backend": "image", "size": "32M"}}); err == nil {
+		t.Fatalf("localPersistDriver.Create() with another size should not reuse the image")
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"backend": "image", "size": "16M"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if fi, err := os.Stat(v.Image.Path); err != nil || fi.Size() != 16<<20 {
+		t.Errorf("localPersistDriver.Create() did not reuse image %s", v.Image.Path)
+	}
+}
+
+func Test_localPersistDriver_Mount_image(t *testing.T) {
+	// Only run where loop devices can be mounted
+	mountLoopbackImage(t, "ext4", "")
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"backend": "image", "size": "16M"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["test-volume"]
+
+	for _, id := range []string{"one", "two"} {
+		if _, err := driver.Mount(&volume.MountRequest{Name: "test-volume", ID: id}); err != nil {
+			t.Fatalf("localPersistDriver.Mount() error = %v", err)
+		}
+	}
+	if mounted, _ := isMounted(v.Mountpoint); !mounted || v.Image.LoopDevice == "" {
+		t.Fatalf("localPersistDriver.Mount() did not mount image on %s", v.Mountpoint)
+	}
+	if err := driver.Remove(&volume.RemoveRequest{Name: "test-volume"}); err == nil {
+		t.Errorf("localPersistDriver.Remove() of mounted image should give error")
+	}
+
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	if mounted, _ := isMounted(v.Mountpoint); !mounted {
+		t.Errorf("localPersistDriver.Unmount() unmounted image with remaining users")
+	}
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "two"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	if mounted, _ := isMounted(v.Mountpoint); mounted || v.Image.Mounted {
+		t.Errorf("localPersistDriver.Unmount() did not unmount image after last user")
+	}
+
+	// Simulate a crash while the volume was in use
+	v.Mounts = []string{"three"}
+	if err := driver.Recover(); err != nil {
+		t.Fatalf("localPersistDriver.Recover() error = %v", err)
+	}
+	if mounted, _ := isMounted(v.Mountpoint); !mounted {
+		t.Errorf("localPersistDriver.Recover() did not mount image of volume in use")
+	}
+	v.Mounts = nil
+	if err := driver.Recover(); err != nil {
+		t.Fatalf("localPersistDriver.Recover() error = %v", err)
+	}
+	if devices, _ := loopDevicesOf(v.Image.Path); len(devices) != 0 {
+		t.Errorf("localPersistDriver.Recover() did not detach stale loop devices %v", devices)
+	}
+}
+
+func Test_localPersistDriver_Mount_references(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	mountpoint := path.Join(DATAPATH, "test-volume")
+	if err := ensureDir(mountpoint, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", mountpoint)
+	}
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{"test-volume": {Mountpoint: mountpoint}},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+
+	for _, id := range []string{"one", "two", "one"} {
+		if _, err := driver.Mount(&volume.MountRequest{Name: "test-volume", ID: id}); err != nil {
+			t.Fatalf("localPersistDriver.Mount() error = %v", err)
+		}
+	}
+	if got := driver.volumes["test-volume"].Mounts; !testEq(got, []string{"one", "two"}) {
+		t.Errorf("localPersistDriver.Mount() mounts = %v, want [one two]", got)
+	}
+
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	if got := driver.volumes["test-volume"].Mounts; !testEq(got, []string{"two"}) {
+		t.Errorf("localPersistDriver.Unmount() mounts = %v, want [two]", got)
+	}
+}
+
+func Test_unescapeMountinfo(t *testing.T) {
+	for in, want := range map[string]string{
+		"/data":           "/data",
+		`/data\040volume`: "/data volume",
+		`/data\134volume`: `/data\volume`,
+		`/data\04`:        `/data\04`,
+	} {
+		if got := unescapeMountinfo(in); got != want {
+			t.Errorf("unescapeMountinfo(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package driver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// instrumentedDriver records the metrics of every volume plugin request and logs it with
+// correlation fields: a request ID, the method, the volume name, the mount ID, the duration and
+// the error. Requests that change volumes are recorded in the audit log.
+type instrumentedDriver struct {
+	driver *localPersistDriver
+	// actor is the audit log actor of the requests, empty when the caller records them itself
+	actor string
+}
+
+// Instrumented returns the driver as a volume.Driver that records request metrics and logs.
+func (driver *localPersistDriver) Instrumented() volume.Driver {
+	return &instrumentedDriver{driver: driver, actor: AUDITACTORDOCKER}
+}
+
+// request is a single volume plugin request.
+type request struct {
+	d       *instrumentedDriver
+	method  string
+	mutates bool
+	volume  string
+	args    map[string]string
+	start   time.Time
+	entry   *log.Entry
+}
+
+// begin starts a request of method on a volume. The mount ID is empty for methods without one.
+func (d *instrumentedDriver) begin(method string, mutates bool, name string, mountID string) *request {
+	var args map[string]string
+	if mountID != "" {
+		args = map[string]string{"id": mountID}
+	}
+
+	fields := log.Fields{"request_id": d.driver.requests.Add(1), "method": method}
+	if name != "" {
+		fields["volume"] = name
+	}
+	if mountID != "" {
+		fields["mount_id"] = mountID
+	}
+	entry := log.WithFields(fields)
+	entry.Debug("Request started")
+
+	return &request{d: d, method: method, mutates: mutates, volume: name, args: args, start: time.Now(), entry: entry}
+}
+
+// end records the metrics of the request and logs its outcome. Requests that change volumes are
+// logged at info level, failed ones at error level. Other requests are logged at debug level.
+func (r *request) end(err error) {
+	duration := time.Since(r.start)
+	r.d.driver.metrics.request(r.method, duration, err)
+	if r.mutates && r.d.actor != "" {
+		r.d.driver.audit(r.d.actor, strings.ToLower(r.method), r.volume, r.args, err)
+	}
+
+	entry := r.entry.WithField("duration_ms", float64(duration.Microseconds())/1000)
+	switch {
+	case !r.mutates:
+		if err != nil {
+			entry = entry.WithError(err)
+		}
+		entry.Debug("Request finished")
+	case err != nil:
+		entry.WithError(err).Error("Request failed")
+	default:
+		entry.Info("Request finished")
+	}
+}
+
+func (d *instrumentedDriver) Create(req *volume.CreateRequest) error {
+	r := d.begin("Create", true, req.Name, "")
+	r.args = map[string]string{}
+	for k, v := range req.Options {
+		r.args[k] = v
+	}
+	err := d.driver.create(r.entry, req)
+	r.end(err)
+	return err
+}
+
+func (d *instrumentedDriver) List() (*volume.ListResponse, error) {
+	r := d.begin("List", false, "", "")
+	res, err := d.driver.List()
+	r.end(err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	r := d.begin("Get", false, req.Name, "")
+	res, err := d.driver.Get(req)
+	r.end(err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Remove(req *volume.RemoveRequest) error {
+	r := d.begin("Remove", true, req.Name, "")
+	err := d.driver.remove(r.entry, req)
+	r.end(err)
+	return err
+}
+
+func (d *instrumentedDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
+	r := d.begin("Path", false, req.Name, "")
+	res, err := d.driver.Path(req)
+	r.end(err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	r := d.begin("Mount", true, req.Name, req.ID)
+	res, err := d.driver.mount(r.entry, req)
+	r.end(err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Unmount(req *volume.UnmountRequest) error {
+	r := d.begin("Unmount", true, req.Name, req.ID)
+	err := d.driver.unmount(r.entry, req)
+	r.end(err)
+	return err
+}
+
+func (d *instrumentedDriver) Capabilities() *volume.CapabilitiesResponse {
+	r := d.begin("Capabilities", false, "", "")
+	res := d.driver.Capabilities()
+	r.end(nil)
+	return res
+}
@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LABELOPTION is the prefix of create options made available to layout templates as labels.
+// Docker does not pass volume labels to plugins, so they have to be repeated as options.
+const LABELOPTION = "label."
+
+// layoutData is the data a layout template is executed with.
+type layoutData struct {
+	Name    string
+	Pool    string
+	Created time.Time
+	options map[string]string
+}
+
+// Labels returns the value of the label.<key> create option.
+func (d layoutData) Labels(key string) string {
+	return d.options[LABELOPTION+key]
+}
+
+// Option returns the value of a create option.
+func (d layoutData) Option(key string) string {
+	return d.options[key]
+}
+
+// Hash returns the hex encoded SHA-256 of the volume name, e.g. for sharding with {{slice .Hash 0 2}}.
+func (d layoutData) Hash() string {
+	sum := sha256.Sum256([]byte(d.Name))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseLayout(layout string) (*template.Template, error) {
+	return template.New("layout").Option("missingkey=error").Parse(layout)
+}
+
+// layout returns the layout template of the named pool, falling back to the global layout.
+func (driver *localPersistDriver) layout(pool string) string {
+	if pool == "" {
+		pool = DEFAULTPOOL
+	}
+	if p, ok := driver.config.Pools[pool]; ok && p.Layout != "" {
+		return p.Layout
+	}
+	return driver.config.Layout
+}
+
+// layoutMountpoint executes the layout template for a new volume and returns the resulting
+// mountpoint inside root. The mountpoint may not overlap with the mountpoint of another volume.
+func (driver *localPersistDriver) layoutMountpoint(root string, layout string, name string, pool string, options map[string]string) (string, error) {
+	tmpl, err := parseLayout(layout)
+	if err != nil {
+		return "", fmt.Errorf("invalid layout %q: %s", layout, err)
+	}
+
+	var b strings.Builder
+	data := layoutData{Name: name, Pool: pool, Created: time.Now().Local(), options: options}
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("could not apply layout %q to volume %s: %s", layout, name, err)
+	}
+
+	rel := b.String()
+	if strings.TrimSpace(rel) == "" {
+		return "", fmt.Errorf("layout %q results in an empty path for volume %s", layout, name)
+	}
+	for _, element := range strings.Split(rel, "/") {
+		if element == "" {
+			return "", fmt.Errorf("layout %q results in path %q with an empty element for volume %s", layout, rel, name)
+		}
+	}
+
+	mountpoint := filepath.Join(root, rel)
+	if _, err := isSubDir(root, mountpoint); err != nil {
+		return "", err
+	}
+
+	for other, v := range driver.volumes {
+		existing := filepath.Clean(v.Mountpoint)
+		if existing == mountpoint {
+			return "", fmt.Errorf("layout results in mountpoint %s, which is already used by volume %s", mountpoint, other)
+		}
+		if inside, _ := isSubDir(existing, mountpoint); inside {
+			return "", fmt.Errorf("layout results in mountpoint %s, which is inside volume %s", mountpoint, other)
+		}
+		if inside, _ := isSubDir(mountpoint, existing); inside {
+			return "", fmt.Errorf("layout results in mountpoint %s, which contains volume %s", mountpoint, other)
+		}
+	}
+
+	log.Debugf("Layout %q results in mountpoint %s", layout, mountpoint)
+
+	return mountpoint, nil
+}
@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Create_layout(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	tests := []struct {
+		name    string
+		layout  string
+		volume  string
+		options map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Create volume with label layout, should pass",
+			layout:  `{{.Labels "com.docker.compose.project"}}/{{.Name}}`,
+			volume:  "app_data",
+			options: map[string]string{"label.com.docker.compose.project": "app"},
+			want:    path.Join(DATAPATH, "app", "app_data"),
+		},
+		{
+			name:   "Create volume with hash sharded layout, should pass",
+			layout: `{{slice .Hash 0 2}}/{{.Name}}`,
+			volume: "test-volume",
+			want:   path.Join(DATAPATH, layoutData{Name: "test-volume"}.Hash()[0:2], "test-volume"),
+		},
+		{
+			name:   "Create volume with date layout, should pass",
+			layout: `{{.Created.Format "2006"}}/{{.Name}}`,
+			volume: "test-volume",
+			want:   path.Join(DATAPATH, time.Now().Format("2006"), "test-volume"),
+		},
+		{
+			name:   "Create volume with missing label, should fail",
+			layout: `{{.Labels "com.docker.compose.project"}}/{{.Name}}`,
+			volume: "test-volume",
+			// Results in an empty path element
+			wantErr: true,
+		},
+		{
+			name:    "Create volume with path traversal in layout, should fail",
+			layout:  `../{{.Name}}`,
+			volume:  "test-volume",
+			wantErr: true,
+		},
+		{
+			name:    "Create volume with layout colliding with existing volume, should fail",
+			layout:  `existing/{{.Name}}`,
+			volume:  "test-volume",
+			wantErr: true,
+		},
+		{
+			name:    "Create volume with layout equal to existing volume, should fail",
+			layout:  `existing`,
+			volume:  "test-volume",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := &localPersistDriver{
+				Name: "local-persist-test",
+				volumes: map[string]*localPersistVolume{
+					"existing": {Mountpoint: path.Join(DATAPATH, "existing")},
+				},
+				stateFilePath: STATEFILEPATH,
+				dataPath:      DATAPATH,
+				config:        Config{Layout: tt.layout},
+			}
+			err := driver.Create(&volume.CreateRequest{Name: tt.volume, Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := driver.volumes[tt.volume].Mountpoint; got != tt.want {
+				t.Errorf("localPersistDriver.Create() mountpoint = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_layout(t *testing.T) {
+	driver := &localPersistDriver{
+		config: Config{
+			Layout: "global",
+			Pools: map[string]*Pool{
+				"ssd": {Path: "/ssd", Layout: "ssd"},
+				"hdd": {Path: "/hdd"},
+			},
+		},
+	}
+
+	for pool, want := range map[string]string{"": "global", "ssd": "ssd", "hdd": "global"} {
+		if got := driver.layout(pool); got != want {
+			t.Errorf("localPersistDriver.layout(%q) = %s, want %s", pool, got, want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables configuring the log output.
+const (
+	LOGLEVELENV  = "LOG_LEVEL"
+	LOGFORMATENV = "LOG_FORMAT"
+	// DEBUGENV is the older boolean switch for debug logs, LOGLEVELENV takes precedence.
+	DEBUGENV = "DEBUG"
+)
+
+// Log formats of LOGFORMATENV.
+const (
+	LOGFORMATTEXT = "text"
+	LOGFORMATJSON = "json"
+)
+
+// defaultLogger returns the logger of calls that are not part of a volume plugin request.
+func defaultLogger() *log.Entry {
+	return log.NewEntry(log.StandardLogger())
+}
+
+// ConfigureLogging sets the log level and format from the environment. LOG_LEVEL is one of
+// trace, debug, info, warn or error and LOG_FORMAT is text or json. Without LOG_LEVEL, DEBUG=1
+// selects the debug level.
+func ConfigureLogging() error {
+	level := log.InfoLevel
+	if name := os.Getenv(LOGLEVELENV); name != "" {
+		parsed, err := log.ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("invalid %s %s", LOGLEVELENV, name)
+		}
+		level = parsed
+	} else if ok, _ := strconv.ParseBool(os.Getenv(DEBUGENV)); ok {
+		level = log.DebugLevel
+	}
+	log.SetLevel(level)
+
+	switch format := strings.ToLower(os.Getenv(LOGFORMATENV)); format {
+	case "", LOGFORMATTEXT:
+		log.SetFormatter(&log.TextFormatter{})
+	case LOGFORMATJSON:
+		log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("invalid %s %s, must be %s or %s", LOGFORMATENV, format, LOGFORMATTEXT, LOGFORMATJSON)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_ConfigureLogging(t *testing.T) {
+	defer log.SetFormatter(&log.TextFormatter{})
+	defer log.SetLevel(log.GetLevel())
+
+	tests := []struct {
+		name      string
+		level     string
+		format    string
+		debug     string
+		wantLevel log.Level
+		wantErr   bool
+	}{
+		{name: "Defaults, should pass", wantLevel: log.InfoLevel},
+		{name: "Debug flag, should pass", debug: "1", wantLevel: log.DebugLevel},
+		{name: "Level over debug flag, should pass", level: "warn", debug: "1", wantLevel: log.WarnLevel},
+		{name: "JSON format, should pass", level: "trace", format: "json", wantLevel: log.TraceLevel},
+		{name: "Invalid level, should fail", level: "loud", wantErr: true},
+		{name: "Invalid format, should fail", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(LOGLEVELENV, tt.level)
+			t.Setenv(LOGFORMATENV, tt.format)
+			t.Setenv(DEBUGENV, tt.debug)
+
+			err := ConfigureLogging()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigureLogging() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && log.GetLevel() != tt.wantLevel {
+				t.Errorf("ConfigureLogging() level = %s, want %s", log.GetLevel(), tt.wantLevel)
+			}
+		})
+	}
+}
+
+func Test_instrumentedDriver_logs(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	instrumented := driver.Instrumented()
+	if err := instrumented.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"ephemeral": "true"}}); err != nil {
+		t.Fatalf("instrumentedDriver.Create() error = %v", err)
+	}
+	if _, err := instrumented.Mount(&volume.MountRequest{Name: "missing", ID: "first"}); err == nil {
+		t.Fatalf("instrumentedDriver.Mount() of a missing volume should fail")
+	}
+	if _, err := instrumented.Mount(&volume.MountRequest{Name: "test-volume", ID: "second"}); err != nil {
+		t.Fatalf("instrumentedDriver.Mount() error = %v", err)
+	}
+	if err := instrumented.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "second"}); err != nil {
+		t.Fatalf("instrumentedDriver.Unmount() error = %v", err)
+	}
+	server := httptest.NewServer(driver.AdminHandler())
+	defer server.Close()
+	res, err := http.Post(server.URL+"/v1/volumes", "application/json", strings.NewReader(`{"name":"admin-volume"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var finished []map[string]interface{}
+	messages := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["request_id"] != nil && entry["duration_ms"] != nil {
+			finished = append(finished, entry)
+		}
+		if msg, ok := entry["msg"].(string); ok {
+			messages[msg] = entry
+		}
+	}
+	if len(finished) != 5 {
+		t.Fatalf("finished requests = %v, want 5", finished)
+	}
+
+	tests := []struct {
+		name  string
+		entry map[string]interface{}
+		want  map[string]interface{}
+	}{
+		{name: "Create, should be logged", entry: finished[0], want: map[string]interface{}{"request_id": 1.0, "method": "Create", "volume": "test-volume", "level": "info"}},
+		{name: "Failed mount, should be logged", entry: finished[1], want: map[string]interface{}{"request_id": 2.0, "method": "Mount", "volume": "missing", "mount_id": "first", "level": "error", "error": "volume missing not found"}},
+		{name: "Create through the admin API, should be logged", entry: finished[4], want: map[string]interface{}{"request_id": 5.0, "method": "Create", "volume": "admin-volume", "level": "info"}},
+		{name: "Logs of a call, should have the fields of its request", entry: messages["Cleared ephemeral volume test-volume"], want: map[string]interface{}{"request_id": 4.0, "method": "Unmount", "volume": "test-volume", "mount_id": "second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, want := range tt.want {
+				if tt.entry[key] != want {
+					t.Errorf("log entry %s = %v, want %v", key, tt.entry[key], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// METRICSPATH is the path the Prometheus metrics are served on.
+const METRICSPATH = "/metrics"
+
+// METRICSCONTENTTYPE is the content type of the Prometheus text exposition format.
+const METRICSCONTENTTYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Job results of the background and snapshot jobs.
+const (
+	JOBSUCCESS = "success"
+	JOBFAILURE = "failure"
+)
+
+// requestMethods are the volume plugin methods with request metrics.
+var requestMethods = []string{"Create", "Get", "List", "Remove", "Path", "Mount", "Unmount"}
+
+// durationBuckets are the upper bounds in seconds of the duration histograms.
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	// counts are the observations per bucket, the exposition makes them cumulative
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type jobKey struct {
+	job    string
+	result string
+}
+
+// metricsRegistry holds the counters and histograms of the driver. A nil registry records nothing,
+// so drivers created without NewLocalPersistDriver work without metrics.
+type metricsRegistry struct {
+	sync.Mutex
+
+	requests          map[string]uint64
+	requestErrors     map[string]uint64
+	requestDurations  map[string]*histogram
+	stateSaves        histogram
+	stateSaveFailures uint64
+	jobs              map[jobKey]uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{
+		requests:         map[string]uint64{},
+		requestErrors:    map[string]uint64{},
+		requestDurations: map[string]*histogram{},
+		jobs:             map[jobKey]uint64{},
+	}
+	for _, method := range requestMethods {
+		m.requests[method] = 0
+		m.requestErrors[method] = 0
+		m.requestDurations[method] = &histogram{}
+	}
+	return m
+}
+
+// request records a volume plugin request.
+func (m *metricsRegistry) request(method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	m.requests[method]++
+	if err != nil {
+		m.requestErrors[method]++
+	}
+	if m.requestDurations[method] == nil {
+		m.requestDurations[method] = &histogram{}
+	}
+	m.requestDurations[method].observe(duration.Seconds())
+}
+
+// stateSave records a write of the state file.
+func (m *metricsRegistry) stateSave(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	m.stateSaves.observe(duration.Seconds())
+	if err != nil {
+		m.stateSaveFailures++
+	}
+}
+
+// job records the result of a snapshot, archive, restore or expiry job.
+func (m *metricsRegistry) job(job string, err error) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	result := JOBSUCCESS
+	if err != nil {
+		result = JOBFAILURE
+	}
+	m.jobs[jobKey{job, result}]++
+}
+
+// ServeMetrics serves the Prometheus metrics on the configured metricsListen address, a unix
+// socket when it is a path. It returns immediately when no address is configured.
+func (driver *localPersistDriver) ServeMetrics() error {
+	if driver.config.MetricsListen == "" {
+		return nil
+	}
+
+	network := "tcp"
+	if filepath.IsAbs(driver.config.MetricsListen) {
+		network = "unix"
+		if err := os.Remove(driver.config.MetricsListen); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l, err := net.Listen(network, driver.config.MetricsListen)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Serving metrics on %s%s", l.Addr(), METRICSPATH)
+
+	return http.Serve(l, driver.MetricsHandler())
+}
+
+// MetricsHandler returns the handler of the metrics endpoint.
+func (driver *localPersistDriver) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+METRICSPATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", METRICSCONTENTTYPE)
+		if err := driver.WriteMetrics(w); err != nil {
+			log.Warnf("Could not write metrics: %s", err)
+		}
+	})
+	return mux
+}
+
+// WriteMetrics writes the metrics in the Prometheus text exposition format.
+func (driver *localPersistDriver) WriteMetrics(w io.Writer) error {
+	e := &exposition{w: w}
+
+	driver.RLock()
+	volumes, mounts := len(driver.volumes), 0
+	for _, v := range driver.volumes {
+		mounts += len(v.Mounts)
+	}
+	driver.RUnlock()
+
+	e.header("local_persist_volumes", "gauge", "Number of volumes.")
+	e.sample("local_persist_volumes", nil, float64(volumes))
+	e.header("local_persist_active_mounts", "gauge", "Number of active mounts of all volumes.")
+	e.sample("local_persist_active_mounts", nil, float64(mounts))
+
+	driver.usageLock.Lock()
+	names := make([]string, 0, len(driver.usage))
+	for name := range driver.usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.header("local_persist_volume_usage_bytes", "gauge", "Bytes used by a volume at its last usage scan.")
+	for _, name := range names {
+		e.sample("local_persist_volume_usage_bytes", []string{"volume", name}, float64(driver.usage[name].Used))
+	}
+	driver.usageLock.Unlock()
+
+	m := driver.metrics
+	if m == nil {
+		return e.err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	methods := make([]string, 0, len(m.requests))
+	for method := range m.requests {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	e.header("local_persist_requests_total", "counter", "Volume plugin requests by method.")
+	for _, method := range methods {
+		e.sample("local_persist_requests_total", []string{"method", method}, float64(m.requests[method]))
+	}
+	e.header("local_persist_request_errors_total", "counter", "Volume plugin requests that returned an error by method.")
+	for _, method := range methods {
+		e.sample("local_persist_request_errors_total", []string{"method", method}, float64(m.requestErrors[method]))
+	}
+	e.header("local_persist_request_duration_seconds", "histogram", "Duration of volume plugin requests by method.")
+	for _, method := range methods {
+		e.histogram("local_persist_request_duration_seconds", []string{"method", method}, m.requestDurations[method])
+	}
+
+	e.header("local_persist_state_save_duration_seconds", "histogram", "Duration of writing the state file.")
+	e.histogram("local_persist_state_save_duration_seconds", nil, &m.stateSaves)
+	e.header("local_persist_state_save_failures_total", "counter", "Writes of the state file that failed.")
+	e.sample("local_persist_state_save_failures_total", nil, float64(m.stateSaveFailures))
+
+	keys := make([]jobKey, 0, len(m.jobs))
+	for key := range m.jobs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].job != keys[j].job {
+			return keys[i].job < keys[j].job
+		}
+		return keys[i].result < keys[j].result
+	})
+	e.header("local_persist_jobs_total", "counter", "Results of snapshot, archive, restore and expiry jobs.")
+	for _, key := range keys {
+		e.sample("local_persist_jobs_total", []string{"job", key.job, "result", key.result}, float64(m.jobs[key]))
+	}
+
+	return e.err
+}
+
+// exposition writes the Prometheus text format and keeps the first write error.
+type exposition struct {
+	w   io.Writer
+	err error
+}
+
+func (e *exposition) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = fmt.Fprintf(e.w, format, args...)
+}
+
+func (e *exposition) header(name, kind, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a single sample, labels are pairs of names and values.
+func (e *exposition) sample(name string, labels []string, value float64) {
+	e.printf("%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+func (e *exposition) histogram(name string, labels []string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		e.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", formatValue(bound)), float64(cumulative))
+	}
+	e.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	e.sample(name+"_sum", labels, h.sum)
+	e.sample(name+"_count", labels, float64(h.count))
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+labelValueEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
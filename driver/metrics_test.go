@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_WriteMetrics(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{MetricsListen: "127.0.0.1:0"},
+		metrics:       newMetricsRegistry(),
+	}
+	instrumented := driver.Instrumented()
+	if err := instrumented.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{}}); err != nil {
+		t.Fatalf("instrumentedDriver.Create() error = %v", err)
+	}
+	if err := instrumented.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"mountpoint": path.Join(DATAPATH, "other")}}); err == nil {
+		t.Fatalf("instrumentedDriver.Create() of an existing volume should fail")
+	}
+	if _, err := instrumented.Mount(&volume.MountRequest{Name: "test-volume", ID: "first"}); err != nil {
+		t.Fatalf("instrumentedDriver.Mount() error = %v", err)
+	}
+	if _, err := driver.Snapshot("test-volume", ""); err == nil {
+		t.Fatalf("localPersistDriver.Snapshot() of a directory volume should fail")
+	}
+	if err := driver.scanVolume("test-volume"); err != nil {
+		t.Fatalf("localPersistDriver.scanVolume() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	driver.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, METRICSPATH, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != METRICSCONTENTTYPE {
+		t.Fatalf("GET %s = %d %s", METRICSPATH, rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Volumes, should be counted", want: "local_persist_volumes 1\n"},
+		{name: "Mounts, should be counted", want: "local_persist_active_mounts 1\n"},
+		{name: "Usage, should be reported", want: `local_persist_volume_usage_bytes{volume="test-volume"} 0` + "\n"},
+		{name: "Requests, should be counted", want: `local_persist_requests_total{method="Create"} 2` + "\n"},
+		{name: "Errors, should be counted", want: `local_persist_request_errors_total{method="Create"} 1` + "\n"},
+		{name: "Unused methods, should be zero", want: `local_persist_requests_total{method="Path"} 0` + "\n"},
+		{name: "Durations, should be observed", want: `local_persist_request_duration_seconds_bucket{method="Mount",le="+Inf"} 1` + "\n"},
+		{name: "State saves, should be observed", want: "local_persist_state_save_duration_seconds_count 2\n"},
+		{name: "State save failures, should be zero", want: "local_persist_state_save_failures_total 0\n"},
+		{name: "Failed snapshot, should be counted", want: `local_persist_jobs_total{job="snapshot",result="failure"} 1` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("metrics do not contain %q:\n%s", tt.want, body)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_ServeMetrics_unix(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	abs, _ := os.Getwd()
+	socket := path.Join(abs, STATEPATH, "metrics.sock")
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{MetricsListen: socket},
+		metrics:       newMetricsRegistry(),
+	}
+	go driver.ServeMetrics()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var res *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://local-persist" + METRICSPATH); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET %s on %s error = %v", METRICSPATH, socket, err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "local_persist_volumes 0\n") {
+		t.Errorf("GET %s on %s = %d:\n%s", METRICSPATH, socket, res.StatusCode, body)
+	}
+}
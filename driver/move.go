@@ -0,0 +1,328 @@
+package driver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Move relocates a volume to another mountpoint, optionally in another pool. The mountpoint is
+// interpreted like the mountpoint create option. Within a filesystem the directory is renamed,
+// otherwise its contents are copied, verified and then deleted from the old location.
+func (driver *localPersistDriver) Move(name string, poolName string, mountpoint string) (string, error) {
+	log.Debug("Move called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("volume %s not found", name)
+	}
+	if err := driver.checkMovable(name, v); err != nil {
+		return "", err
+	}
+
+	if poolName == DEFAULTPOOL {
+		poolName = ""
+	}
+	root, err := driver.poolPath(poolName)
+	if err != nil {
+		return "", err
+	}
+	if poolName != v.Pool {
+		// Snapshots are in the pool the volume is moved out of
+		dir, err := driver.snapshotDir(name, v)
+		if err != nil {
+			return "", err
+		}
+		if snapshots, _ := os.ReadDir(dir); len(snapshots) > 0 {
+			return "", fmt.Errorf("volume %s has snapshots, it cannot move to another pool", name)
+		}
+	}
+
+	options := driver.poolOptions(poolName, map[string]string{"mountpoint": mountpoint})
+	dst, root, err := driver.resolveMountpoint(name, poolName, root, options)
+	if err != nil {
+		return "", err
+	}
+	if _, err := isSubDir(root, dst); err != nil {
+		return "", err
+	}
+	src := filepath.Clean(v.Mountpoint)
+	dst = filepath.Clean(dst)
+	if dst == src {
+		return "", fmt.Errorf("volume %s is already at %s", name, dst)
+	}
+	if inside, _ := isSubDir(src, dst); inside {
+		return "", fmt.Errorf("cannot move volume %s into itself", name)
+	}
+	for other, ov := range driver.volumes {
+		if filepath.Clean(ov.Mountpoint) == dst {
+			return "", fmt.Errorf("mountpoint %s is used by volume %s", dst, other)
+		}
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("%s already exists", dst)
+	}
+	if err := ensureDir(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+
+	copied := false
+	err = os.Rename(src, dst)
+	if errors.Is(err, unix.EXDEV) {
+		if v.ProjectID != 0 {
+			return "", fmt.Errorf("volume %s has a quota, it cannot move to another filesystem", name)
+		}
+		if v.Backend == BACKENDBTRFS {
+			return "", fmt.Errorf("volume %s is a btrfs subvolume, it cannot move to another filesystem", name)
+		}
+		if err := checkCopyable(src); err != nil {
+			return "", fmt.Errorf("volume %s cannot move to another filesystem: %s", name, err)
+		}
+		log.Infof("Copying volume %s from %s to %s", name, src, dst)
+		if err = copyTree(src, dst); err == nil {
+			err = verifyTree(src, dst)
+		}
+		if err != nil {
+			os.RemoveAll(dst)
+			return "", fmt.Errorf("could not copy volume %s: %s", name, err)
+		}
+		copied = true
+	} else if err != nil {
+		return "", fmt.Errorf("could not move volume %s: %s", name, err)
+	}
+
+	oldPool := v.Pool
+	v.Mountpoint, v.Pool = dst, poolName
+	if err := driver.saveState(); err != nil {
+		v.Mountpoint, v.Pool = src, oldPool
+		if copied {
+			os.RemoveAll(dst)
+		} else if err := os.Rename(dst, src); err != nil {
+			log.Errorf("Could not move volume %s back to %s: %s", name, src, err)
+		}
+		return "", fmt.Errorf("error %s", err)
+	}
+
+	if copied {
+		// Only what was copied is deleted, filesystems mounted in the meantime are left alone
+		err := emptyDir(defaultLogger(), src, nil)
+		if err == nil {
+			err = os.Remove(src)
+		}
+		if err != nil {
+			log.Warnf("Moved volume %s, but could not delete the old copy in %s: %s", name, src, err)
+		}
+	}
+
+	log.Infof("Moved volume %s from %s to %s", name, src, dst)
+
+	return dst, nil
+}
+
+// checkMovable returns an error unless a volume can be moved: it is a plain directory or btrfs
+// volume that is not in use, not archived and not related to other volumes.
+func (driver *localPersistDriver) checkMovable(name string, v *localPersistVolume) error {
+	switch {
+	case len(v.Mounts) > 0:
+		return fmt.Errorf("volume %s is in use", name)
+	case v.Backend != BACKENDDIRECTORY && v.Backend != BACKENDBTRFS:
+		return fmt.Errorf("volumes with the %s backend cannot be moved", v.Backend)
+	case v.Archive != nil:
+		return fmt.Errorf("volume %s is archived, mount it to restore it first", name)
+	case v.Parent != "":
+		return fmt.Errorf("volume %s is a child of %s", name, v.Parent)
+	}
+	if dependents := driver.dependents(name); len(dependents) > 0 {
+		return fmt.Errorf("volume %s is used by %s", name, strings.Join(dependents, ", "))
+	}
+	return nil
+}
+
+// checkCopyable returns an error when copyTree cannot copy everything below src: sockets, named
+// pipes, devices and other filesystems mounted below it.
+func checkCopyable(src string) error {
+	var root unix.Stat_t
+	if err := unix.Lstat(src, &root); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return copyable(root, p, d)
+	})
+}
+
+// copyable returns an error unless the entry p below root is a directory, symlink or regular file
+// on the filesystem of root.
+func copyable(root unix.Stat_t, p string, d fs.DirEntry) error {
+	var stat unix.Stat_t
+	if err := unix.Lstat(p, &stat); err != nil {
+		return err
+	}
+	if stat.Dev != root.Dev {
+		return fmt.Errorf("%s is on another filesystem", p)
+	}
+	if !d.IsDir() && !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+		return fmt.Errorf("%s is a %s", p, fileType(d.Type()))
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst, which must not exist, keeping modes, ownership,
+// modification times and symlinks. Entries it cannot copy, see checkCopyable, are refused.
+func copyTree(src string, dst string) error {
+	var root unix.Stat_t
+	if err := unix.Lstat(src, &root); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if err := copyable(root, p, d); err != nil {
+			return err
+		}
+		var stat unix.Stat_t
+		if err := unix.Lstat(p, &stat); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			if err := copyFile(p, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+
+		// Only root can give files away, the ownership is kept where possible
+		os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		if !d.IsDir() && d.Type()&fs.ModeSymlink == 0 {
+			os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+}
+
+func copyFile(src string, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// verifyTree checks that every directory, symlink and regular file below src exists in dst with
+// the same contents.
+func verifyTree(src string, dst string) error {
+	var root unix.Stat_t
+	if err := unix.Lstat(src, &root); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			var stat unix.Stat_t
+			if err := unix.Lstat(p, &stat); err != nil {
+				return err
+			}
+			if stat.Dev != root.Dev {
+				return filepath.SkipDir
+			}
+			if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+				return fmt.Errorf("directory %s is missing in the copy", rel)
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			want, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if got, err := os.Readlink(target); err != nil || got != want {
+				return fmt.Errorf("symlink %s differs in the copy", rel)
+			}
+		case d.Type().IsRegular():
+			want, err := fileHash(p)
+			if err != nil {
+				return err
+			}
+			if got, err := fileHash(target); err != nil || !bytes.Equal(got, want) {
+				return fmt.Errorf("file %s differs in the copy", rel)
+			}
+		}
+		return nil
+	})
+}
+
+func fileHash(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
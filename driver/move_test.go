@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/sys/unix"
+)
+
+func Test_localPersistDriver_Move(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := ensureDir(POOLPATH, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", POOLPATH)
+	}
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{Pools: map[string]*Pool{"ssd": {Path: POOLPATH}}},
+	}
+	for _, req := range []*volume.CreateRequest{
+		{Name: "test-volume", Options: map[string]string{}},
+		{Name: "in-use", Options: map[string]string{}},
+		{Name: "other", Options: map[string]string{}},
+	} {
+		if err := driver.Create(req); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	if err := os.WriteFile(path.Join(DATAPATH, "test-volume", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "in-use", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	// Snapshots need btrfs, a snapshot directory in the pool of the volume stands in for one
+	if err := os.MkdirAll(path.Join(DATAPATH, SNAPSHOTDIR, "other", "first"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		volume     string
+		pool       string
+		mountpoint string
+		want       string
+		wantErr    bool
+	}{
+		{name: "Move within the data root, should pass", volume: "test-volume", mountpoint: "moved/test-volume", want: path.Join(DATAPATH, "moved", "test-volume")},
+		{name: "Move to another pool, should pass", volume: "test-volume", pool: "ssd", want: path.Join(POOLPATH, "test-volume")},
+		{name: "Move volume with snapshots to another pool, should fail", volume: "other", pool: "ssd", wantErr: true},
+		{name: "Move volume in use, should fail", volume: "in-use", mountpoint: "elsewhere", wantErr: true},
+		{name: "Move onto other volume, should fail", volume: "test-volume", mountpoint: "other", wantErr: true},
+		{name: "Move outside the data root, should fail", volume: "other", mountpoint: "../../escape", wantErr: true},
+		{name: "Move unknown volume, should fail", volume: "unknown", mountpoint: "elsewhere", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := driver.Move(tt.volume, tt.pool, tt.mountpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Move() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("localPersistDriver.Move() = %s, want %s", got, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+			if v := driver.volumes[tt.volume]; v.Mountpoint != tt.want {
+				t.Errorf("localPersistDriver.Move() state mountpoint = %s, want %s", v.Mountpoint, tt.want)
+			}
+			if data, err := os.ReadFile(path.Join(tt.want, "file")); err != nil || string(data) != "data" {
+				t.Errorf("localPersistDriver.Move() moved %q, %v, want data", data, err)
+			}
+		})
+	}
+}
+
+func Test_copyTree(t *testing.T) {
+	src := path.Join(t.TempDir(), "src")
+	dst := path.Join(t.TempDir(), "dst")
+	if err := os.MkdirAll(path.Join(src, "dir"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(src, "dir", "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", path.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+	if err := verifyTree(src, dst); err != nil {
+		t.Errorf("verifyTree() error = %v", err)
+	}
+	if fi, err := os.Stat(path.Join(dst, "dir", "file")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("copyTree() copied file with mode %v, %v, want 0600", fi.Mode(), err)
+	}
+
+	if err := os.WriteFile(path.Join(dst, "dir", "file"), []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTree(src, dst); err == nil {
+		t.Errorf("verifyTree() of different copy should give error")
+	}
+
+	if err := unix.Mkfifo(path.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCopyable(src); err == nil {
+		t.Errorf("checkCopyable() of a directory with a named pipe should give error")
+	}
+	if err := copyTree(src, path.Join(t.TempDir(), "dst")); err == nil {
+		t.Errorf("copyTree() of a directory with a named pipe should give error")
+	}
+}
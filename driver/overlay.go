@@ -0,0 +1,258 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// OVERLAYDIR is the directory inside every pool containing the upper and work directories of
+// overlay volumes, in <OVERLAYDIR>/<volume>/{upper,work}.
+const OVERLAYDIR = ".local-persist-overlays"
+
+// BACKENDOVERLAY is the backend option of copy-on-write clones of other volumes.
+const BACKENDOVERLAY = "overlay"
+
+// overlayState is the state of an overlay volume.
+type overlayState struct {
+	Source   string
+	Snapshot string `json:",omitempty"`
+	Lower    string
+	Upper    string
+	Work     string
+	Mounted  bool
+}
+
+// options returns the mount options of the overlay.
+func (o *overlayState) options() string {
+	return fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", o.Lower, o.Upper, o.Work)
+}
+
+// overlayOptions resolves the overlay-of option (volume or volume@snapshot) of a new volume.
+func (driver *localPersistDriver) overlayOptions(name string, v *localPersistVolume, options map[string]string) (*overlayState, error) {
+	source, snapshot, _ := strings.Cut(options["overlay-of"], "@")
+	if source == "" {
+		return nil, fmt.Errorf("the %s backend needs the overlay-of option", BACKENDOVERLAY)
+	}
+
+	sv, ok := driver.volumes[source]
+	if !ok {
+		return nil, fmt.Errorf("volume %s to overlay not found", source)
+	}
+	if sv.Backend == BACKENDIMAGE || sv.Backend == BACKENDOVERLAY {
+		return nil, fmt.Errorf("volumes with the %s backend cannot be overlaid", sv.Backend)
+	}
+	if err := requireHot(source, sv); err != nil {
+		return nil, err
+	}
+
+	lower := sv.Mountpoint
+	if snapshot != "" {
+		var err error
+		lower, err = driver.snapshotPath(source, sv, snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fi, err := os.Stat(lower); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("lower directory %s of the overlay does not exist", lower)
+	}
+
+	root, err := driver.poolPath(v.Pool)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, OVERLAYDIR, name)
+	if _, err := isSubDir(filepath.Join(root, OVERLAYDIR), dir); err != nil {
+		return nil, err
+	}
+
+	o := &overlayState{Source: source, Snapshot: snapshot}
+	for _, p := range []struct {
+		path   string
+		target *string
+	}{{lower, &o.Lower}, {filepath.Join(dir, "upper"), &o.Upper}, {filepath.Join(dir, "work"), &o.Work}} {
+		abs, err := filepath.Abs(p.path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(abs, ",:") {
+			return nil, fmt.Errorf("path %s of the overlay cannot contain ',' or ':'", abs)
+		}
+		*p.target = abs
+	}
+	return o, nil
+}
+
+// Reset discards the changes of an overlay volume, so it equals its lower directory again.
+func (driver *localPersistDriver) Reset(name string) error {
+	log.Debug("Reset called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if v.Overlay == nil {
+		return fmt.Errorf("volume %s is not an overlay", name)
+	}
+	if len(v.Mounts) > 0 || v.Overlay.Mounted {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+
+	if err := resetOverlay(v.Overlay); err != nil {
+		return fmt.Errorf("could not reset volume %s: %s", name, err)
+	}
+
+	log.Infof("Reset volume %s to %s", name, v.Overlay.Lower)
+
+	return nil
+}
+
+// resetOverlay empties the upper and work directory of an overlay that is not mounted.
+func resetOverlay(o *overlayState) error {
+	for _, dir := range []string{o.Upper, o.Work} {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := ensureDir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountOverlay assembles the overlay on the mountpoint.
+func mountOverlay(o *overlayState, mountpoint string) error {
+	if err := unix.Mount("overlay", mountpoint, "overlay", 0, o.options()); err != nil {
+		return fmt.Errorf("could not mount overlay on %s: %s", mountpoint, err)
+	}
+	o.Mounted = true
+
+	log.Infof("Mounted overlay of %s on %s", o.Lower, mountpoint)
+
+	return nil
+}
+
+// unmountOverlay unmounts the overlay from the mountpoint.
+func unmountOverlay(o *overlayState, mountpoint string) error {
+	if err := unix.Unmount(mountpoint, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("could not unmount %s: %s", mountpoint, err)
+	}
+	o.Mounted = false
+
+	log.Infof("Unmounted overlay of %s from %s", o.Lower, mountpoint)
+
+	return nil
+}
+
+// overlayBackend stores the changes to another volume in a private upper directory, which is
+// combined with the volume using overlayfs while the volume is mounted.
+type overlayBackend struct {
+	driver *localPersistDriver
+}
+
+func (b overlayBackend) Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error {
+	if options["clone-of"] != "" || options["size"] != "" {
+		return fmt.Errorf("the %s backend does not support the clone-of and size options", BACKENDOVERLAY)
+	}
+
+	o, err := b.driver.overlayOptions(name, v, options)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{v.Mountpoint, o.Upper, o.Work} {
+		if err := ensureDir(dir, 0755); err != nil {
+			return fmt.Errorf("could not create directory %s: %s", dir, err)
+		}
+	}
+
+	v.Overlay = o
+	return nil
+}
+
+func (b overlayBackend) Mount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Overlay == nil {
+		return fmt.Errorf("volume %s has no overlay", name)
+	}
+	if v.Overlay.Mounted {
+		return nil
+	}
+	return mountOverlay(v.Overlay, v.Mountpoint)
+}
+
+func (b overlayBackend) Unmount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Overlay == nil || !v.Overlay.Mounted {
+		return nil
+	}
+	return unmountOverlay(v.Overlay, v.Mountpoint)
+}
+
+func (b overlayBackend) Remove(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.Overlay != nil && v.Overlay.Mounted {
+		return fmt.Errorf("the overlay of volume %s is still mounted", name)
+	}
+	return nil
+}
+
+func (b overlayBackend) Purge(name string, v *localPersistVolume) error {
+	if v.Overlay != nil {
+		if err := os.RemoveAll(filepath.Dir(v.Overlay.Upper)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(v.Mountpoint)
+}
+
+func (b overlayBackend) Usage(name string, v *localPersistVolume) (uint64, uint64, error) {
+	if v.Overlay == nil {
+		return 0, 0, fmt.Errorf("volume %s has no overlay", name)
+	}
+	size, err := dirSize(v.Overlay.Upper)
+	return uint64(size), 0, err
+}
+
+func (b overlayBackend) Snapshot(name string, v *localPersistVolume, dst string) error {
+	return ErrSnapshotNotSupported
+}
+
+// Recover mounts the overlay of a volume that is still in use again and unmounts the overlay of a
+// volume that is not in use.
+func (b overlayBackend) Recover(name string, v *localPersistVolume) (bool, error) {
+	if v.Overlay == nil {
+		return false, nil
+	}
+
+	mounted, err := isMounted(v.Mountpoint)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case len(v.Mounts) > 0 && mounted:
+		return false, nil
+
+	case len(v.Mounts) > 0:
+		log.Warnf("Volume %s is in use, but its overlay is not mounted. Mounting it again", name)
+		v.Overlay.Mounted = false
+		return true, mountOverlay(v.Overlay, v.Mountpoint)
+
+	default:
+		if mounted {
+			log.Warnf("Volume %s is not in use, but its overlay is mounted. Unmounting it", name)
+			if err := unix.Unmount(v.Mountpoint, 0); err != nil {
+				return false, fmt.Errorf("could not unmount %s: %s", v.Mountpoint, err)
+			}
+		}
+		changed := v.Overlay.Mounted
+		v.Overlay.Mounted = false
+		return changed, nil
+	}
+}
@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/sys/unix"
+)
+
+// skipWithoutOverlay skips the test when overlayfs cannot be mounted.
+func skipWithoutOverlay(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, d := range []string{"lower", "upper", "work", "mnt"} {
+		if err := os.Mkdir(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := &overlayState{Lower: path.Join(dir, "lower"), Upper: path.Join(dir, "upper"), Work: path.Join(dir, "work")}
+	if err := unix.Mount("overlay", path.Join(dir, "mnt"), "overlay", 0, o.options()); err != nil {
+		t.Skipf("overlayfs is not available: %s", err)
+	}
+	unix.Unmount(path.Join(dir, "mnt"), 0)
+}
+
+func Test_localPersistDriver_Create_overlay(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "source", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		volume  string
+		options map[string]string
+		wantErr bool
+	}{
+		{name: "Overlay of volume, should pass", volume: "clone", options: map[string]string{"overlay-of": "source"}},
+		{name: "Overlay of unknown volume, should fail", volume: "unknown-clone", options: map[string]string{"overlay-of": "unknown"}, wantErr: true},
+		{name: "Overlay of unknown snapshot, should fail", volume: "snapshot-clone", options: map[string]string{"overlay-of": "source@unknown"}, wantErr: true},
+		{name: "Overlay of overlay, should fail", volume: "clone-clone", options: map[string]string{"overlay-of": "clone"}, wantErr: true},
+		{name: "Overlay with other backend, should fail", volume: "directory-clone", options: map[string]string{"overlay-of": "source", "backend": "directory"}, wantErr: true},
+		{name: "Overlay backend without overlay-of, should fail", volume: "empty-clone", options: map[string]string{"backend": "overlay"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := driver.Create(&volume.CreateRequest{Name: tt.volume, Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	v := driver.volumes["clone"]
+	if v.Backend != BACKENDOVERLAY || v.Overlay == nil || v.Overlay.Source != "source" {
+		t.Fatalf("localPersistDriver.Create() volume = %+v, want an overlay of source", v)
+	}
+	if fi, err := os.Stat(v.Overlay.Upper); err != nil || !fi.IsDir() {
+		t.Errorf("localPersistDriver.Create() did not create upper directory %s", v.Overlay.Upper)
+	}
+	if err := driver.Purge("source"); err == nil {
+		t.Errorf("localPersistDriver.Purge() of overlaid volume should give error")
+	}
+}
+
+func Test_localPersistDriver_Mount_overlay(t *testing.T) {
+	skipWithoutOverlay(t)
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "source", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if err := os.WriteFile(path.Join(driver.volumes["source"].Mountpoint, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "clone", Options: map[string]string{"overlay-of": "source"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	v := driver.volumes["clone"]
+
+	for _, id := range []string{"one", "two"} {
+		if _, err := driver.Mount(&volume.MountRequest{Name: "clone", ID: id}); err != nil {
+			t.Fatalf("localPersistDriver.Mount() error = %v", err)
+		}
+	}
+	if data, err := os.ReadFile(path.Join(v.Mountpoint, "file")); err != nil || string(data) != "data" {
+		t.Fatalf("localPersistDriver.Mount() overlay contains %q, %v, want data", data, err)
+	}
+	if err := os.WriteFile(path.Join(v.Mountpoint, "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path.Join(driver.volumes["source"].Mountpoint, "file")); string(data) != "data" {
+		t.Errorf("writing to the overlay changed the source volume to %q", data)
+	}
+	if err := driver.Reset("clone"); err == nil {
+		t.Errorf("localPersistDriver.Reset() of mounted overlay should give error")
+	}
+
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "clone", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	if mounted, _ := isMounted(v.Mountpoint); !mounted {
+		t.Errorf("localPersistDriver.Unmount() unmounted overlay with remaining users")
+	}
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "clone", ID: "two"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	if mounted, _ := isMounted(v.Mountpoint); mounted || v.Overlay.Mounted {
+		t.Errorf("localPersistDriver.Unmount() did not unmount overlay after last user")
+	}
+
+	if err := driver.Reset("clone"); err != nil {
+		t.Fatalf("localPersistDriver.Reset() error = %v", err)
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "clone", ID: "three"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+	if data, _ := os.ReadFile(path.Join(v.Mountpoint, "file")); string(data) != "data" {
+		t.Errorf("localPersistDriver.Reset() did not discard changes, overlay contains %q", data)
+	}
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "clone", ID: "three"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+}
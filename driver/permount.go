@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// perMountOption parses the per-mount option of a new volume.
+func perMountOption(options map[string]string) (bool, error) {
+	value, ok := options["per-mount"]
+	if !ok {
+		return false, nil
+	}
+	perMount, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid per-mount option %q", value)
+	}
+	return perMount, nil
+}
+
+// mountDir returns the subdirectory of a per-mount volume for the mount with the given ID.
+func mountDir(v *localPersistVolume, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid mount ID %q", id)
+	}
+	dir := filepath.Join(v.Mountpoint, id)
+	if _, err := isSubDir(v.Mountpoint, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// ensureMountDir creates the subdirectory of a per-mount volume for a mount and records it.
+// It returns whether the state changed.
+func ensureMountDir(v *localPersistVolume, id string) (string, bool, error) {
+	dir, err := mountDir(v, id)
+	if err != nil {
+		return "", false, err
+	}
+	if err := ensureDir(dir, 0755); err != nil {
+		return "", false, fmt.Errorf("could not create directory %s: %s", dir, err)
+	}
+	if contains(v.MountDirs, id) {
+		return dir, false, nil
+	}
+	v.MountDirs = append(v.MountDirs, id)
+	return dir, true, nil
+}
+
+// CleanMountDirs deletes the subdirectories of a per-mount volume that belong to mounts which are
+// no longer active. It returns the deleted directories.
+func (driver *localPersistDriver) CleanMountDirs(name string) ([]string, error) {
+	log.Debug("CleanMountDirs called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", name)
+	}
+	if !v.PerMount {
+		return nil, fmt.Errorf("volume %s was created without per-mount", name)
+	}
+	if (v.Image != nil && !v.Image.Mounted) || (v.Overlay != nil && !v.Overlay.Mounted) {
+		return nil, fmt.Errorf("volume %s has to be mounted to clean it", name)
+	}
+
+	cleaned := []string{}
+	kept := []string{}
+	for _, id := range v.MountDirs {
+		if contains(v.Mounts, id) {
+			kept = append(kept, id)
+			continue
+		}
+		dir, err := mountDir(v, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("could not delete %s: %s", dir, err)
+		}
+		cleaned = append(cleaned, dir)
+		log.Infof("Deleted directory %s of mount %s of volume %s", dir, id, name)
+	}
+
+	v.MountDirs = kept
+	if err := driver.saveState(); err != nil {
+		return nil, fmt.Errorf("error %s", err)
+	}
+
+	return cleaned, nil
+}
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Mount_perMount(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"per-mount": "true"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "readonly", Options: map[string]string{"per-mount": "true", "readonly": "true"}}); err == nil {
+		t.Errorf("localPersistDriver.Create() of read-only per-mount volume should give error")
+	}
+	v := driver.volumes["test-volume"]
+
+	tests := []struct {
+		name    string
+		id      string
+		want    string
+		wantErr bool
+	}{
+		{name: "First mount, should get own directory", id: "one", want: path.Join(DATAPATH, "test-volume", "one")},
+		{name: "Second mount, should get own directory", id: "two", want: path.Join(DATAPATH, "test-volume", "two")},
+		{name: "Path traversal in ID, should fail", id: "../escape", wantErr: true},
+		{name: "Dot ID, should fail", id: "..", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := driver.Mount(&volume.MountRequest{Name: "test-volume", ID: tt.id})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Mount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Mountpoint != tt.want {
+				t.Errorf("localPersistDriver.Mount() = %s, want %s", got.Mountpoint, tt.want)
+			}
+		})
+	}
+	if len(v.MountDirs) != 2 || len(v.Mounts) != 2 {
+		t.Fatalf("localPersistDriver.Mount() state = %+v, want two mounts with directories", v)
+	}
+
+	if err := driver.Unmount(&volume.UnmountRequest{Name: "test-volume", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+	}
+	cleaned, err := driver.CleanMountDirs("test-volume")
+	if err != nil {
+		t.Fatalf("localPersistDriver.CleanMountDirs() error = %v", err)
+	}
+	if len(cleaned) != 1 || cleaned[0] != path.Join(DATAPATH, "test-volume", "one") {
+		t.Errorf("localPersistDriver.CleanMountDirs() = %v, want only the directory of mount one", cleaned)
+	}
+	if _, err := os.Stat(path.Join(DATAPATH, "test-volume", "two")); err != nil {
+		t.Errorf("localPersistDriver.CleanMountDirs() deleted the directory of an active mount")
+	}
+	if len(v.MountDirs) != 1 || v.MountDirs[0] != "two" {
+		t.Errorf("localPersistDriver.CleanMountDirs() mount directories = %v, want [two]", v.MountDirs)
+	}
+}
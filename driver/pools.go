@@ -0,0 +1,123 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DEFAULTPOOL is the name of the pool backed by the data path.
+const DEFAULTPOOL = "default"
+
+// POOLSMOUNT is the default path inside the plugin below which every pool has to be. It is part
+// of the propagated mount, so volumes created there are visible on the host.
+const POOLSMOUNT = "/local-persist/pools"
+
+// Pool is a named data root volumes can be created in.
+type Pool struct {
+	Path string `json:"path,omitempty"`
+	// Defaults are create options applied to volumes in this pool when not set explicitly.
+	Defaults map[string]string `json:"defaults,omitempty"`
+	// Layout overrides the layout template of the configuration for this pool.
+	Layout string `json:"layout,omitempty"`
+}
+
+// PoolInfo describes the usage of a pool.
+type PoolInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	Free    uint64 `json:"free"`
+	Volumes int    `json:"volumes"`
+}
+
+// poolPath returns the data root of the named pool. An empty name selects the default pool.
+func (driver *localPersistDriver) poolPath(name string) (string, error) {
+	if name == "" || name == DEFAULTPOOL {
+		return driver.dataPath, nil
+	}
+
+	p, ok := driver.config.Pools[name]
+	if !ok {
+		return "", fmt.Errorf("pool %s does not exist", name)
+	}
+	return p.Path, nil
+}
+
+// poolOptions returns the create options merged with the defaults of the named pool.
+func (driver *localPersistDriver) poolOptions(name string, options map[string]string) map[string]string {
+	if name == "" {
+		name = DEFAULTPOOL
+	}
+
+	merged := map[string]string{}
+	if p, ok := driver.config.Pools[name]; ok {
+		for k, v := range p.Defaults {
+			merged[k] = v
+		}
+	}
+	for k, v := range options {
+		merged[k] = v
+	}
+	return merged
+}
+
+// poolRoots returns the data root of every pool, keyed by pool name.
+func (driver *localPersistDriver) poolRoots() map[string]string {
+	roots := map[string]string{DEFAULTPOOL: filepath.Clean(driver.dataPath)}
+	for name, p := range driver.config.Pools {
+		if name != DEFAULTPOOL {
+			roots[name] = p.Path
+		}
+	}
+	return roots
+}
+
+// poolOf returns the name and root of the pool containing dir.
+func (driver *localPersistDriver) poolOf(dir string) (string, string, error) {
+	for name, root := range driver.poolRoots() {
+		if ok, _ := isSubDir(root, dir); ok {
+			return name, root, nil
+		}
+	}
+	return "", "", fmt.Errorf("path %s is not inside any pool", dir)
+}
+
+// Pools reports the size, free space and number of volumes of every pool.
+func (driver *localPersistDriver) Pools() ([]PoolInfo, error) {
+	log.Debug("Pools called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	counts := map[string]int{}
+	for _, v := range driver.volumes {
+		name := v.Pool
+		if name == "" {
+			name = DEFAULTPOOL
+		}
+		counts[name]++
+	}
+
+	var pools []PoolInfo
+	for name, root := range driver.poolRoots() {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(root, &stat); err != nil {
+			return nil, fmt.Errorf("could not stat pool %s: %s", name, err)
+		}
+		pools = append(pools, PoolInfo{
+			Name:    name,
+			Path:    root,
+			Size:    stat.Blocks * uint64(stat.Bsize),
+			Free:    stat.Bavail * uint64(stat.Bsize),
+			Volumes: counts[name],
+		})
+	}
+
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+
+	return pools, nil
+}
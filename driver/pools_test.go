@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const POOLPATH = "./test/pools/ssd"
+
+func returnPoolDriver() *localPersistDriver {
+	return &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config: Config{
+			Pools: map[string]*Pool{
+				"ssd":       {Path: POOLPATH, Defaults: map[string]string{"mountpoint": "fast"}},
+				DEFAULTPOOL: {Defaults: map[string]string{"mountpoint": "slow"}},
+			},
+		},
+	}
+}
+
+func Test_localPersistDriver_Create_pool(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := ensureDir(POOLPATH, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", POOLPATH)
+	}
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Create volume in pool with default mountpoint, should pass",
+			options: map[string]string{"pool": "ssd"},
+			want:    path.Join(POOLPATH, "fast"),
+		},
+		{
+			name:    "Create volume in pool with mountpoint option, should pass",
+			options: map[string]string{"pool": "ssd", "mountpoint": "custom"},
+			want:    path.Join(POOLPATH, "custom"),
+		},
+		{
+			name:    "Create volume in default pool, should pass",
+			options: map[string]string{},
+			want:    path.Join(DATAPATH, "slow"),
+		},
+		{
+			name:    "Create volume in non-existing pool, should fail",
+			options: map[string]string{"pool": "i-do-not-exist"},
+			wantErr: true,
+		},
+		{
+			name:    "Create volume in pool and try path traversal, should fail",
+			options: map[string]string{"pool": "ssd", "mountpoint": "../../data/escape"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := returnPoolDriver()
+			err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := driver.volumes["test-volume"].Mountpoint; got != tt.want {
+				t.Errorf("localPersistDriver.Create() mountpoint = %s, want %s", got, tt.want)
+			}
+			if _, err := os.Stat(tt.want); err != nil {
+				t.Errorf("localPersistDriver.Create() error directory %s does not exist", tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Pools(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := ensureDir(POOLPATH, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", POOLPATH)
+	}
+
+	driver := returnPoolDriver()
+	driver.volumes["test-volume"] = &localPersistVolume{Mountpoint: path.Join(POOLPATH, "test-volume"), Pool: "ssd"}
+
+	pools, err := driver.Pools()
+	if err != nil {
+		t.Fatalf("localPersistDriver.Pools() error = %v", err)
+	}
+	if len(pools) != 2 || pools[0].Name != DEFAULTPOOL || pools[1].Name != "ssd" {
+		t.Fatalf("localPersistDriver.Pools() = %v, want default and ssd", pools)
+	}
+	if pools[0].Volumes != 0 || pools[1].Volumes != 1 {
+		t.Errorf("localPersistDriver.Pools() volumes = %d and %d, want 0 and 1", pools[0].Volumes, pools[1].Volumes)
+	}
+	if pools[1].Size == 0 {
+		t.Errorf("localPersistDriver.Pools() size of pool ssd is 0")
+	}
+}
+
+func Test_Config_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		pools   map[string]*Pool
+		wantErr bool
+	}{
+		{name: "Absolute pool path, should pass", pools: map[string]*Pool{"ssd": {Path: POOLSMOUNT + "/ssd/"}}},
+		{name: "Pool path outside of the pools mount, should fail", pools: map[string]*Pool{"ssd": {Path: "/ssd"}}, wantErr: true},
+		{name: "Pools mount as pool path, should fail", pools: map[string]*Pool{"ssd": {Path: POOLSMOUNT}}, wantErr: true},
+		{name: "Relative pool path, should fail", pools: map[string]*Pool{"ssd": {Path: "ssd"}}, wantErr: true},
+		{name: "Default pool with path, should fail", pools: map[string]*Pool{DEFAULTPOOL: {Path: "/data"}}, wantErr: true},
+		{name: "Pool without configuration, should fail", pools: map[string]*Pool{"ssd": nil}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{Pools: tt.pools}
+			if err := config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && config.Pools["ssd"].Path != filepath.Clean(POOLSMOUNT+"/ssd/") {
+				t.Errorf("Config.validate() did not clean pool path %s", config.Pools["ssd"].Path)
+			}
+		})
+	}
+}
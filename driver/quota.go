@@ -0,0 +1,405 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Project quota ioctls and quotactl commands, see linux/fs.h and linux/quota.h
+const (
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+	qGetQuota          = 0x800007
+	qSetQuota          = 0x800008
+	prjQuota           = 2
+	qifBLimits         = 1
+	qifILimits         = 4
+	qifDqBlkSize       = 1024
+	firstProjectID     = 1000
+)
+
+// PROJECTIDFILE in the state directory holds the highest project ID given to a volume. Removed
+// volumes keep their data and its project ID, so their IDs are not given out again.
+const PROJECTIDFILE = "local-persist-project-id"
+
+// fsxattr mirrors struct fsxattr.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// dqblk mirrors struct if_dqblk.
+type dqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+// QuotaLimits are the project quota limits of a volume. Sizes are in bytes, zero means unlimited.
+type QuotaLimits struct {
+	Size       uint64 `json:"size"`
+	SoftSize   uint64 `json:"softSize,omitempty"`
+	Inodes     uint64 `json:"inodes,omitempty"`
+	SoftInodes uint64 `json:"softInodes,omitempty"`
+}
+
+// QuotaChange changes some of the project quota limits of a volume. Nil fields keep their limit,
+// zero removes it.
+type QuotaChange struct {
+	Size       *uint64 `json:"size,omitempty"`
+	SoftSize   *uint64 `json:"softSize,omitempty"`
+	Inodes     *uint64 `json:"inodes,omitempty"`
+	SoftInodes *uint64 `json:"softInodes,omitempty"`
+}
+
+// apply returns the limits with the change applied.
+func (change QuotaChange) apply(limits QuotaLimits) QuotaLimits {
+	for _, field := range []struct {
+		value  *uint64
+		target *uint64
+	}{
+		{change.Size, &limits.Size},
+		{change.SoftSize, &limits.SoftSize},
+		{change.Inodes, &limits.Inodes},
+		{change.SoftInodes, &limits.SoftInodes},
+	} {
+		if field.value != nil {
+			*field.target = *field.value
+		}
+	}
+	return limits
+}
+
+// QuotaUsage is the usage of a volume measured against its project quota limits.
+type QuotaUsage struct {
+	QuotaLimits
+	Used       uint64 `json:"used"`
+	UsedInodes uint64 `json:"usedInodes"`
+}
+
+// ErrNoProjectQuota is returned when the filesystem of a volume does not support project quotas.
+var ErrNoProjectQuota = errors.New("filesystem does not support project quotas (it needs to be XFS or ext4 mounted with prjquota)")
+
+// quotaOptions parses the size, soft-size, inodes and soft-inodes create options.
+// It returns nil when none of them is set.
+func quotaOptions(options map[string]string) (*QuotaLimits, error) {
+	var limits QuotaLimits
+	var set bool
+
+	for option, target := range map[string]*uint64{"size": &limits.Size, "soft-size": &limits.SoftSize} {
+		if options[option] == "" {
+			continue
+		}
+		size, err := ParseSize(options[option])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s option: %s", option, err)
+		}
+		*target, set = size, true
+	}
+
+	for option, target := range map[string]*uint64{"inodes": &limits.Inodes, "soft-inodes": &limits.SoftInodes} {
+		if options[option] == "" {
+			continue
+		}
+		inodes, err := strconv.ParseUint(options[option], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s option: %s", option, err)
+		}
+		*target, set = inodes, true
+	}
+
+	if !set {
+		return nil, nil
+	}
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+func (limits QuotaLimits) validate() error {
+	if limits.SoftSize > 0 && limits.Size > 0 && limits.SoftSize > limits.Size {
+		return fmt.Errorf("soft size %d is larger than size %d", limits.SoftSize, limits.Size)
+	}
+	if limits.SoftInodes > 0 && limits.Inodes > 0 && limits.SoftInodes > limits.Inodes {
+		return fmt.Errorf("soft inodes %d is larger than inodes %d", limits.SoftInodes, limits.Inodes)
+	}
+	return nil
+}
+
+// ParseSize parses a size in bytes with an optional binary unit suffix, e.g. 512M, 10G or 1TiB.
+func ParseSize(s string) (uint64, error) {
+	value := strings.TrimSpace(strings.ToUpper(s))
+	unit := strings.TrimLeft(value, "0123456789")
+	value = value[:len(value)-len(unit)]
+
+	multiplier := uint64(1)
+	if unit != "" && unit != "B" {
+		i := strings.IndexByte("KMGT", unit[0])
+		if i < 0 || (unit[1:] != "" && unit[1:] != "B" && unit[1:] != "IB") {
+			return 0, fmt.Errorf("could not parse size %q, the unit has to be K, M, G or T", s)
+		}
+		multiplier = 1 << (10 * (i + 1))
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse size %q", s)
+	}
+	if n > ^uint64(0)/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
+
+// nextProjectID returns a project ID that was not given to any volume, including removed ones,
+// and records it in PROJECTIDFILE. IDs that are still charged on the filesystem of dir, e.g. by
+// volumes removed before the IDs were recorded, are skipped as well.
+func (driver *localPersistDriver) nextProjectID(dir string) (uint32, error) {
+	id := uint32(firstProjectID)
+	for _, v := range driver.volumes {
+		if v.ProjectID >= id {
+			id = v.ProjectID + 1
+		}
+	}
+
+	idPath := filepath.Join(filepath.Dir(driver.stateFilePath), PROJECTIDFILE)
+	data, err := os.ReadFile(idPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	if err == nil {
+		last, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %s", idPath, err)
+		}
+		if uint32(last) >= id {
+			id = uint32(last) + 1
+		}
+	}
+
+	for {
+		usage, err := projectUsage(dir, id)
+		if err != nil || (usage.Used == 0 && usage.UsedInodes == 0) {
+			break
+		}
+		id++
+	}
+
+	tmp := idPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(uint64(id), 10)), 0600); err != nil {
+		return 0, err
+	}
+	return id, os.Rename(tmp, idPath)
+}
+
+// supportsProjectQuota reports whether project quotas are enabled on the filesystem of path.
+func supportsProjectQuota(path string) error {
+	var q dqblk
+	if err := quotactl(path, qGetQuota, 0, &q); err != nil {
+		log.Debugf("Project quotas are not available for %s: %s", path, err)
+		return ErrNoProjectQuota
+	}
+	return nil
+}
+
+// existingAncestor returns path, or its closest parent that exists.
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// setProjectQuota assigns the project ID to the directory and everything already in it, so that
+// reused directories are charged completely, and sets the limits of the project. Everything
+// created below the directory later inherits the ID. Nested filesystems are left alone.
+func setProjectQuota(logger *log.Entry, dir string, id uint32, limits QuotaLimits) error {
+	var root unix.Stat_t
+	if err := unix.Lstat(dir, &root); err != nil {
+		return err
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			return err
+		}
+		if st.Dev != root.Dev {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return setProjectID(path, id, d.IsDir())
+	})
+	if err != nil {
+		return err
+	}
+
+	return setProjectLimits(logger, dir, id, limits)
+}
+
+// setProjectID assigns the project ID to a directory or regular file. Directories pass it on to
+// what is created in them.
+func setProjectID(path string, id uint32, dir bool) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsxattr
+	if err := ioctl(f.Fd(), fsIocFsGetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("could not get project of %s: %w", path, err)
+	}
+	attr.projid = id
+	if dir {
+		attr.xflags |= fsXflagProjInherit
+	}
+	if err := ioctl(f.Fd(), fsIocFsSetXattr, unsafe.Pointer(&attr)); err != nil {
+		return fmt.Errorf("could not set project of %s: %w", path, err)
+	}
+	return nil
+}
+
+// setProjectLimits changes the limits of an existing project.
+func setProjectLimits(logger *log.Entry, dir string, id uint32, limits QuotaLimits) error {
+	softSize := limits.SoftSize
+	if softSize == 0 {
+		softSize = limits.Size
+	}
+	softInodes := limits.SoftInodes
+	if softInodes == 0 {
+		softInodes = limits.Inodes
+	}
+
+	q := dqblk{
+		bhardlimit: (limits.Size + qifDqBlkSize - 1) / qifDqBlkSize,
+		bsoftlimit: (softSize + qifDqBlkSize - 1) / qifDqBlkSize,
+		ihardlimit: limits.Inodes,
+		isoftlimit: softInodes,
+		valid:      qifBLimits | qifILimits,
+	}
+	if err := quotactl(dir, qSetQuota, id, &q); err != nil {
+		return fmt.Errorf("could not set quota of project %d: %w", id, err)
+	}
+
+	logger.Debugf("Set quota of project %d for %s to %+v", id, dir, limits)
+
+	return nil
+}
+
+// projectUsage returns the limits and usage of a project.
+func projectUsage(dir string, id uint32) (*QuotaUsage, error) {
+	var q dqblk
+	if err := quotactl(dir, qGetQuota, id, &q); err != nil {
+		return nil, fmt.Errorf("could not get quota of project %d: %w", id, err)
+	}
+
+	return &QuotaUsage{
+		QuotaLimits: QuotaLimits{
+			Size:       q.bhardlimit * qifDqBlkSize,
+			SoftSize:   q.bsoftlimit * qifDqBlkSize,
+			Inodes:     q.ihardlimit,
+			SoftInodes: q.isoftlimit,
+		},
+		Used:       q.curspace,
+		UsedInodes: q.curinodes,
+	}, nil
+}
+
+// quotactl issues a project quota command through quotactl_fd(2), which, unlike quotactl(2),
+// does not need access to the block device.
+func quotactl(path string, cmd int, id uint32, q *dqblk) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), uintptr(cmd<<8|prjQuota), uintptr(id), uintptr(unsafe.Pointer(q)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Resize changes the project quota limits of a volume.
+func (driver *localPersistDriver) Resize(name string, change QuotaChange) error {
+	log.Debug("Resize called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if v.ProjectID == 0 {
+		return fmt.Errorf("volume %s was created without a size", name)
+	}
+	var limits QuotaLimits
+	if v.Quota != nil {
+		limits = *v.Quota
+	}
+	limits = change.apply(limits)
+	if err := limits.validate(); err != nil {
+		return err
+	}
+
+	if err := setProjectLimits(defaultLogger(), v.Mountpoint, v.ProjectID, limits); err != nil {
+		return err
+	}
+
+	old := v.Quota
+	v.Quota = &limits
+	if err := driver.saveState(); err != nil {
+		v.Quota = old
+		return fmt.Errorf("error %s", err)
+	}
+
+	log.Infof("Resized volume %s to %+v", name, limits)
+
+	return nil
+}
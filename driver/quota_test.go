@@ -0,0 +1,214 @@
+package driver
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// mountLoopbackImage creates and mounts a filesystem image of the given type for tests that need
+// specific filesystem features. The test is skipped when that is not possible.
+func mountLoopbackImage(t *testing.T, fstype string, options string) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("mounting a loopback image needs root")
+	}
+	mkfs, err := exec.LookPath("mkfs." + fstype)
+	if err != nil {
+		t.Skipf("mkfs.%s is not available", fstype)
+	}
+
+	dir := t.TempDir()
+	image := filepath.Join(dir, fstype+".img")
+	mnt := filepath.Join(dir, "mnt")
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("truncate", "-s", "512M", image).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(mkfs, image).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.%s failed: %s", fstype, out)
+	}
+	args := []string{"-o", "loop"}
+	if options != "" {
+		args = []string{"-o", "loop," + options}
+	}
+	if out, err := exec.Command("mount", append(args, image, mnt)...).CombinedOutput(); err != nil {
+		t.Skipf("could not mount %s image: %s", fstype, out)
+	}
+	t.Cleanup(func() { exec.Command("umount", mnt).Run() })
+
+	return mnt
+}
+
+func Test_ParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    uint64
+		wantErr bool
+	}{
+		{size: "1024", want: 1024},
+		{size: "512k", want: 512 << 10},
+		{size: "10M", want: 10 << 20},
+		{size: "10G", want: 10 << 30},
+		{size: "1GiB", want: 1 << 30},
+		{size: "2TB", want: 2 << 40},
+		{size: "", wantErr: true},
+		{size: "ten", wantErr: true},
+		{size: "-1G", wantErr: true},
+		{size: "99999999999T", wantErr: true},
+		{size: "1P", wantErr: true},
+		{size: "1I", wantErr: true},
+		{size: "1KI", wantErr: true},
+		{size: "1GBi", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := ParseSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_quotaOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    *QuotaLimits
+		wantErr bool
+	}{
+		{name: "No quota options, should return nil", options: map[string]string{"mountpoint": "x"}},
+		{name: "Size, should pass", options: map[string]string{"size": "1G"}, want: &QuotaLimits{Size: 1 << 30}},
+		{
+			name:    "All options, should pass",
+			options: map[string]string{"size": "1G", "soft-size": "512M", "inodes": "1000", "soft-inodes": "900"},
+			want:    &QuotaLimits{Size: 1 << 30, SoftSize: 512 << 20, Inodes: 1000, SoftInodes: 900},
+		},
+		{name: "Soft size larger than size, should fail", options: map[string]string{"size": "1G", "soft-size": "2G"}, wantErr: true},
+		{name: "Invalid inodes, should fail", options: map[string]string{"inodes": "many"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := quotaOptions(tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("quotaOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("quotaOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_nextProjectID(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{volumes: map[string]*localPersistVolume{}, stateFilePath: STATEFILEPATH}
+	tests := []struct {
+		name    string
+		volumes map[string]*localPersistVolume
+		want    uint32
+	}{
+		{name: "No volumes, should give the first ID", volumes: map[string]*localPersistVolume{}, want: firstProjectID},
+		{name: "Volume with a higher ID, should give the ID after it", volumes: map[string]*localPersistVolume{"a": {ProjectID: firstProjectID + 5}, "b": {}}, want: firstProjectID + 6},
+		{name: "Volume with the highest ID removed, should not reuse its ID", volumes: map[string]*localPersistVolume{"b": {}}, want: firstProjectID + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver.volumes = tt.volumes
+			got, err := driver.nextProjectID(DATAPATH)
+			if err != nil {
+				t.Fatalf("localPersistDriver.nextProjectID() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("localPersistDriver.nextProjectID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_Create_size_unsupported(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if supportsProjectQuota(DATAPATH) == nil {
+		t.Skip("the test directory supports project quotas")
+	}
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"size": "1G"}})
+	if !errors.Is(err, ErrNoProjectQuota) {
+		t.Errorf("localPersistDriver.Create() error = %v, want %v", err, ErrNoProjectQuota)
+	}
+	if _, ok := driver.volumes["test-volume"]; ok {
+		t.Errorf("localPersistDriver.Create() registered volume without quota")
+	}
+	if _, err := os.Stat(path.Join(DATAPATH, "test-volume")); !os.IsNotExist(err) {
+		t.Errorf("localPersistDriver.Create() created directory for volume without quota")
+	}
+}
+
+func Test_localPersistDriver_Create_size(t *testing.T) {
+	mnt := mountLoopbackImage(t, "xfs", "prjquota")
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      mnt,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "test-volume", Options: map[string]string{"size": "10M", "inodes": "100"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+
+	v := driver.volumes["test-volume"]
+	if v.ProjectID != firstProjectID {
+		t.Errorf("localPersistDriver.Create() project = %d, want %d", v.ProjectID, firstProjectID)
+	}
+
+	// Writing more than the hard limit has to fail
+	data := make([]byte, 11<<20)
+	if err := os.WriteFile(filepath.Join(v.Mountpoint, "data"), data, 0644); err == nil {
+		t.Errorf("writing more than the size of the volume succeeded")
+	}
+
+	got, err := driver.Get(&volume.GetRequest{Name: "test-volume"})
+	if err != nil {
+		t.Fatalf("localPersistDriver.Get() error = %v", err)
+	}
+	usage, ok := got.Volume.Status["quota"].(*QuotaUsage)
+	if !ok || usage.Size != 10<<20 || usage.Inodes != 100 {
+		t.Errorf("localPersistDriver.Get() quota = %v, want size 10M and 100 inodes", got.Volume.Status["quota"])
+	}
+
+	size := uint64(20 << 20)
+	if err := driver.Resize("test-volume", QuotaChange{Size: &size}); err != nil {
+		t.Fatalf("localPersistDriver.Resize() error = %v", err)
+	}
+	if v.Quota.Size != size || v.Quota.Inodes != 100 {
+		t.Errorf("localPersistDriver.Resize() quota = %+v, want size 20M and the 100 inodes kept", v.Quota)
+	}
+	if err := os.WriteFile(filepath.Join(v.Mountpoint, "data"), data, 0644); err != nil {
+		t.Errorf("writing less than the resized size of the volume failed: %v", err)
+	}
+}
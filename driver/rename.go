@@ -0,0 +1,176 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// volumeNamePattern matches the volume names Docker accepts.
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Rename changes the name of a volume. The snapshots, trash, image, overlay and archive of the
+// volume are renamed along, and so are the references of other volumes to it. With moveDir, a
+// directory named after the volume is renamed as well.
+func (driver *localPersistDriver) Rename(name string, newName string, moveDir bool) error {
+	log.Debug("Rename called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	if _, exists := driver.volumes[newName]; exists {
+		return fmt.Errorf("the volume %s already exists", newName)
+	}
+	if !volumeNamePattern.MatchString(newName) {
+		return fmt.Errorf("invalid volume name %q", newName)
+	}
+	if len(v.Mounts) > 0 {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	if err := requireNotRestoring(name, v); err != nil {
+		return err
+	}
+
+	root, err := driver.poolPath(v.Pool)
+	if err != nil {
+		return err
+	}
+
+	// Every rename is undone when a later one, or saving the state, fails
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	rename := func(src string, dst string) error {
+		if _, err := os.Lstat(src); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			return fmt.Errorf("%s already exists", dst)
+		}
+		if err := ensureDir(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		undo = append(undo, func() {
+			if err := os.Rename(dst, src); err != nil {
+				log.Errorf("Could not rename %s back to %s: %s", dst, src, err)
+			}
+		})
+		return nil
+	}
+
+	updated := *v
+	snapshotDir, newSnapshotDir := filepath.Join(root, SNAPSHOTDIR, name), filepath.Join(root, SNAPSHOTDIR, newName)
+	renames := [][2]string{
+		{snapshotDir, newSnapshotDir},
+		{filepath.Join(root, TRASHDIR, name), filepath.Join(root, TRASHDIR, newName)},
+	}
+	if v.Image != nil {
+		image := *v.Image
+		image.Path = filepath.Join(filepath.Dir(v.Image.Path), newName+".img")
+		renames = append(renames, [2]string{v.Image.Path, image.Path})
+		updated.Image = &image
+	}
+	if v.Overlay != nil {
+		overlay := *v.Overlay
+		dir := filepath.Dir(v.Overlay.Upper)
+		newDir := filepath.Join(filepath.Dir(dir), newName)
+		overlay.Upper, overlay.Work = filepath.Join(newDir, "upper"), filepath.Join(newDir, "work")
+		renames = append(renames, [2]string{dir, newDir})
+		updated.Overlay = &overlay
+	}
+	if v.Archive != nil {
+		archive := *v.Archive
+		archive.Path = filepath.Join(filepath.Dir(v.Archive.Path), newName+".tar.gz")
+		renames = append(renames, [2]string{v.Archive.Path, archive.Path})
+		updated.Archive = &archive
+	}
+	if moveDir {
+		if filepath.Base(v.Mountpoint) != name {
+			return fmt.Errorf("the directory %s of volume %s is not named after it", v.Mountpoint, name)
+		}
+		if dependents := driver.dependents(name); len(dependents) > 0 {
+			return fmt.Errorf("the directory of volume %s is used by other volumes, it cannot be renamed", name)
+		}
+		updated.Mountpoint = filepath.Join(filepath.Dir(v.Mountpoint), newName)
+		for other, ov := range driver.volumes {
+			if filepath.Clean(ov.Mountpoint) == updated.Mountpoint {
+				return fmt.Errorf("mountpoint %s is used by volume %s", updated.Mountpoint, other)
+			}
+		}
+		renames = append(renames, [2]string{v.Mountpoint, updated.Mountpoint})
+	}
+
+	for _, r := range renames {
+		if err := rename(r[0], r[1]); err != nil {
+			rollback()
+			return fmt.Errorf("could not rename volume %s: %s", name, err)
+		}
+	}
+
+	// Other volumes refer to their source and parent by name, and overlays of a snapshot to the
+	// snapshot by path
+	type reference struct {
+		field    *string
+		old, new string
+	}
+	var references []reference
+	absSnapshotDir, err := filepath.Abs(snapshotDir)
+	if err != nil {
+		rollback()
+		return err
+	}
+	absNewSnapshotDir, err := filepath.Abs(newSnapshotDir)
+	if err != nil {
+		rollback()
+		return err
+	}
+	for _, ov := range driver.volumes {
+		if ov.Overlay != nil && ov.Overlay.Source == name {
+			references = append(references, reference{&ov.Overlay.Source, name, newName})
+			if rel, err := hostRel(absSnapshotDir, ov.Overlay.Lower); ov.Overlay.Snapshot != "" && err == nil {
+				references = append(references, reference{&ov.Overlay.Lower, ov.Overlay.Lower, filepath.Join(absNewSnapshotDir, rel)})
+			}
+		}
+		if ov.View != nil && ov.View.Source == name {
+			references = append(references, reference{&ov.View.Source, name, newName})
+		}
+		if ov.Parent == name {
+			references = append(references, reference{&ov.Parent, name, newName})
+		}
+	}
+	for _, ref := range references {
+		*ref.field = ref.new
+	}
+	delete(driver.volumes, name)
+	driver.volumes[newName] = &updated
+
+	if err := driver.saveState(); err != nil {
+		for _, ref := range references {
+			*ref.field = ref.old
+		}
+		delete(driver.volumes, newName)
+		driver.volumes[name] = v
+		rollback()
+		return fmt.Errorf("error %s", err)
+	}
+	driver.forgetUsage(name)
+
+	log.Infof("Renamed volume %s to %s", name, newName)
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Rename(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	for _, req := range []*volume.CreateRequest{
+		{Name: "old", Options: map[string]string{}},
+		{Name: "custom", Options: map[string]string{"mountpoint": "somewhere"}},
+		{Name: "in-use", Options: map[string]string{}},
+		{Name: "view", Options: map[string]string{"view-of": "custom"}},
+	} {
+		if err := driver.Create(req); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(DATAPATH, SNAPSHOTDIR, "old", "first"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(DATAPATH, SNAPSHOTDIR, "custom", "first"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "clone", Options: map[string]string{"overlay-of": "custom@first"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if _, err := driver.Mount(&volume.MountRequest{Name: "in-use", ID: "one"}); err != nil {
+		t.Fatalf("localPersistDriver.Mount() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		volume         string
+		newName        string
+		moveDir        bool
+		wantMountpoint string
+		wantErr        bool
+	}{
+		{name: "Rename moving the directory, should pass", volume: "old", newName: "new", moveDir: true, wantMountpoint: path.Join(DATAPATH, "new")},
+		{name: "Rename keeping the directory, should pass", volume: "new", newName: "newer", wantMountpoint: path.Join(DATAPATH, "new")},
+		{name: "Rename source of view, should pass", volume: "custom", newName: "renamed", wantMountpoint: path.Join(DATAPATH, "somewhere")},
+		{name: "Move directory not named after the volume, should fail", volume: "renamed", newName: "other", moveDir: true, wantErr: true},
+		{name: "Rename volume in use, should fail", volume: "in-use", newName: "unused", wantErr: true},
+		{name: "Rename to existing volume, should fail", volume: "newer", newName: "view", wantErr: true},
+		{name: "Rename to invalid name, should fail", volume: "newer", newName: "../escape", wantErr: true},
+		{name: "Rename to name Docker refuses, should fail", volume: "newer", newName: "-volume", wantErr: true},
+		{name: "Rename to single character, should fail", volume: "newer", newName: "v", wantErr: true},
+		{name: "Rename to name with spaces, should fail", volume: "newer", newName: "my volume", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := driver.Rename(tt.volume, tt.newName, tt.moveDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("localPersistDriver.Rename() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, ok := driver.volumes[tt.volume]; !ok {
+					t.Errorf("localPersistDriver.Rename() failed, but removed %s", tt.volume)
+				}
+				return
+			}
+			if _, ok := driver.volumes[tt.volume]; ok {
+				t.Errorf("localPersistDriver.Rename() kept the old name %s", tt.volume)
+			}
+			v, ok := driver.volumes[tt.newName]
+			if !ok || v.Mountpoint != tt.wantMountpoint {
+				t.Fatalf("localPersistDriver.Rename() volume = %+v, want mountpoint %s", v, tt.wantMountpoint)
+			}
+			if _, err := os.Stat(v.Mountpoint); err != nil {
+				t.Errorf("localPersistDriver.Rename() mountpoint %s does not exist", v.Mountpoint)
+			}
+		})
+	}
+
+	if _, err := os.Stat(path.Join(DATAPATH, SNAPSHOTDIR, "newer", "first")); err != nil {
+		t.Errorf("localPersistDriver.Rename() did not keep the snapshots attached")
+	}
+	if lower, _ := filepath.Abs(path.Join(DATAPATH, SNAPSHOTDIR, "renamed", "first")); driver.volumes["clone"].Overlay.Lower != lower {
+		t.Errorf("localPersistDriver.Rename() overlay lower = %s, want %s", driver.volumes["clone"].Overlay.Lower, lower)
+	}
+	if source := driver.volumes["view"].View.Source; source != "renamed" {
+		t.Errorf("localPersistDriver.Rename() view source = %s, want renamed", source)
+	}
+}
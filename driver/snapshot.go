@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SNAPSHOTDIR is the directory inside every pool containing the snapshots of volumes, in
+// <SNAPSHOTDIR>/<volume>/<snapshot>.
+const SNAPSHOTDIR = ".local-persist-snapshots"
+
+// snapshotPath returns the path of a snapshot of a volume.
+func (driver *localPersistDriver) snapshotPath(name string, v *localPersistVolume, snapshot string) (string, error) {
+	if snapshot == "" || snapshot == "." || snapshot == ".." || strings.ContainsRune(snapshot, filepath.Separator) {
+		return "", fmt.Errorf("invalid snapshot name %q", snapshot)
+	}
+
+	dir, err := driver.snapshotDir(name, v)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, snapshot), nil
+}
+
+// snapshotDir returns the directory containing the snapshots of a volume.
+func (driver *localPersistDriver) snapshotDir(name string, v *localPersistVolume) (string, error) {
+	root, err := driver.poolPath(v.Pool)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, SNAPSHOTDIR, name)
+	if _, err := isSubDir(filepath.Join(root, SNAPSHOTDIR), dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Snapshot creates a read-only snapshot of a volume. Without a name the snapshot is named after
+// the current time. It returns the name of the snapshot.
+func (driver *localPersistDriver) Snapshot(name string, snapshot string) (_ string, err error) {
+	log.Debug("Snapshot called")
+	defer func() {
+		driver.metrics.job("snapshot", err)
+	}()
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return "", fmt.Errorf("volume %s not found", name)
+	}
+
+	if err := requireHot(name, v); err != nil {
+		return "", err
+	}
+
+	if snapshot == "" {
+		snapshot = time.Now().UTC().Format("20060102T150405Z")
+	}
+	dst, err := driver.snapshotPath(name, v, snapshot)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("snapshot %s of volume %s already exists", snapshot, name)
+	}
+
+	backend, err := driver.backend(v.Backend)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureDir(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+	if err := backend.Snapshot(name, v, dst); err != nil {
+		return "", err
+	}
+
+	log.Infof("Created snapshot %s of volume %s", snapshot, name)
+
+	return snapshot, nil
+}
+
+// Snapshots returns the names of the snapshots of a volume.
+func (driver *localPersistDriver) Snapshots(name string) ([]string, error) {
+	log.Debug("Snapshots called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return nil, fmt.Errorf("volume %s not found", name)
+	}
+
+	dir, err := driver.snapshotDir(name, v)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// DeleteSnapshot deletes a snapshot of a volume.
+func (driver *localPersistDriver) DeleteSnapshot(name string, snapshot string) error {
+	log.Debug("DeleteSnapshot called")
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	v, ok := driver.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+	dst, err := driver.snapshotPath(name, v, snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err != nil {
+		return fmt.Errorf("snapshot %s of volume %s not found", snapshot, name)
+	}
+
+	if isSubvolume(dst) {
+		err = deleteSubvolume(dst)
+	} else {
+		err = os.RemoveAll(dst)
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete snapshot %s of volume %s: %s", snapshot, name, err)
+	}
+
+	log.Infof("Deleted snapshot %s of volume %s", snapshot, name)
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StateProblem is an inconsistency in the state of the driver.
+type StateProblem struct {
+	Volume  string `json:"volume,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// ValidateState checks the state file in statePath against the configuration and the volume
+// data of a stopped plugin, without starting a driver. A state file that cannot be parsed is
+// reported as a problem.
+func ValidateState(statePath string, dataPath string) ([]StateProblem, error) {
+	if err := RequireStopped(statePath); err != nil {
+		return nil, err
+	}
+	config, err := loadConfig(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	driver := &localPersistDriver{
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: path.Join(statePath, STATEFILE),
+		dataPath:      dataPath,
+		config:        config,
+	}
+
+	data, err := os.ReadFile(driver.stateFilePath)
+	if os.IsNotExist(err) {
+		return []StateProblem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeState(data, &driver.volumes); err != nil {
+		return []StateProblem{{Problem: err.Error()}}, nil
+	}
+
+	return driver.stateProblems(), nil
+}
+
+// decodeState parses a state file, refusing fields the driver does not know.
+func decodeState(data []byte, volumes *map[string]*localPersistVolume) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(volumes); err != nil {
+		return fmt.Errorf("invalid state: %s", err)
+	}
+	return nil
+}
+
+// stateProblems checks every volume, sorted by name.
+func (driver *localPersistDriver) stateProblems() []StateProblem {
+	names := make([]string, 0, len(driver.volumes))
+	for name := range driver.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []StateProblem{}
+	for _, name := range names {
+		for _, p := range driver.volumeProblems(name, driver.volumes[name]) {
+			problems = append(problems, StateProblem{Volume: name, Problem: p})
+		}
+	}
+	return problems
+}
+
+// volumeProblems returns the inconsistencies of a single volume.
+func (driver *localPersistDriver) volumeProblems(name string, v *localPersistVolume) []string {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return []string{fmt.Sprintf("invalid volume name %q", name)}
+	}
+	if v == nil {
+		return []string{"volume has no state"}
+	}
+
+	var problems []string
+	if _, err := time.Parse(time.RFC3339, v.CreatedAt); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid CreatedAt %q", v.CreatedAt))
+	}
+	if _, err := driver.poolPath(v.Pool); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := driver.backend(v.Backend); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, ref := range []struct {
+		kind   string
+		source string
+	}{{"parent", v.Parent}, {"overlay source", overlayOf(v)}, {"view source", viewOf(v)}} {
+		if _, ok := driver.volumes[ref.source]; ref.source != "" && !ok {
+			problems = append(problems, fmt.Sprintf("%s %s does not exist", ref.kind, ref.source))
+		}
+	}
+
+	if v.Mountpoint == "" {
+		return append(problems, "volume has no mountpoint")
+	}
+	if err := driver.checkContained(v.Mountpoint); err != nil {
+		problems = append(problems, err.Error())
+	}
+	fi, err := os.Lstat(v.Mountpoint)
+	switch {
+	case os.IsNotExist(err):
+		problems = append(problems, fmt.Sprintf("mountpoint %s does not exist", v.Mountpoint))
+	case err != nil:
+		problems = append(problems, err.Error())
+	case !fi.IsDir():
+		problems = append(problems, fmt.Sprintf("mountpoint %s is a %s, not a directory", v.Mountpoint, fileType(fi.Mode())))
+	}
+	return problems
+}
+
+// hasRuntimeState reports whether a volume is marked as mounted, which only a running plugin can
+// know to be true.
+func hasRuntimeState(v *localPersistVolume) bool {
+	return len(v.Mounts) > 0 ||
+		(v.Image != nil && (v.Image.Mounted || v.Image.LoopDevice != "")) ||
+		(v.Overlay != nil && v.Overlay.Mounted) ||
+		(v.View != nil && v.View.Mounted)
+}
+
+// clearRuntimeState marks a volume and its backend as not mounted.
+func clearRuntimeState(v *localPersistVolume) {
+	v.Mounts = nil
+	if v.Image != nil {
+		v.Image.Mounted, v.Image.LoopDevice = false, ""
+	}
+	if v.Overlay != nil {
+		v.Overlay.Mounted = false
+	}
+	if v.View != nil {
+		v.View.Mounted = false
+	}
+}
+
+// overlayOf returns the volume an overlay volume is a clone of.
+func overlayOf(v *localPersistVolume) string {
+	if v.Overlay == nil {
+		return ""
+	}
+	return v.Overlay.Source
+}
+
+// viewOf returns the volume a view volume shows.
+func viewOf(v *localPersistVolume) string {
+	if v.View == nil {
+		return ""
+	}
+	return v.View.Source
+}
+
+// ExportState returns the state of every volume, in the format of the state file.
+func (driver *localPersistDriver) ExportState() ([]byte, error) {
+	log.Debug("ExportState called")
+
+	driver.RLock()
+	defer driver.RUnlock()
+
+	return json.MarshalIndent(driver.volumes, "", "  ")
+}
+
+// ImportState adds the volumes of an exported state. Existing volumes are only replaced with
+// replace, and never while they are in use. The imported volumes are not mounted.
+func (driver *localPersistDriver) ImportState(data []byte, replace bool) ([]string, error) {
+	log.Debug("ImportState called")
+
+	var imported map[string]*localPersistVolume
+	if err := decodeState(data, &imported); err != nil {
+		return nil, err
+	}
+
+	driver.Lock()
+	defer driver.Unlock()
+
+	previous := map[string]*localPersistVolume{}
+	names := make([]string, 0, len(imported))
+	for name, v := range imported {
+		if existing, ok := driver.volumes[name]; ok {
+			if !replace {
+				return nil, fmt.Errorf("the volume %s already exists", name)
+			}
+			if len(existing.Mounts) > 0 {
+				return nil, fmt.Errorf("volume %s is in use", name)
+			}
+			previous[name] = existing
+		}
+		if v != nil {
+			clearRuntimeState(v)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rollback := func() {
+		for _, name := range names {
+			delete(driver.volumes, name)
+		}
+		for name, v := range previous {
+			driver.volumes[name] = v
+		}
+	}
+
+	for _, name := range names {
+		driver.volumes[name] = imported[name]
+	}
+	var problems []string
+	for _, name := range names {
+		for _, p := range driver.volumeProblems(name, imported[name]) {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, p))
+		}
+	}
+	if len(problems) > 0 {
+		rollback()
+		return nil, fmt.Errorf("invalid volumes: %s", strings.Join(problems, "; "))
+	}
+
+	if err := driver.saveState(); err != nil {
+		rollback()
+		return nil, fmt.Errorf("error %s", err)
+	}
+
+	log.Infof("Imported volumes %s", strings.Join(names, ", "))
+
+	return names, nil
+}
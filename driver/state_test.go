@@ -0,0 +1,160 @@
+package driver
+
+import (
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_ValidateState(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := os.MkdirAll(path.Join(DATAPATH, "present"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(DATAPATH, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		state        string
+		wantProblems int
+	}{
+		{name: "Valid state, should pass", state: `{"ok": {"Mountpoint": "` + path.Join(DATAPATH, "present") + `", "CreatedAt": "2024-01-01T00:00:00Z"}}`},
+		{name: "Invalid JSON, should fail", state: `{"ok": `, wantProblems: 1},
+		{name: "Unknown field, should fail", state: `{"ok": {"Mountpoint": "` + path.Join(DATAPATH, "present") + `", "Unknown": 1}}`, wantProblems: 1},
+		{name: "Missing mountpoint, should fail", state: `{"gone": {"Mountpoint": "` + path.Join(DATAPATH, "gone") + `", "CreatedAt": "2024-01-01T00:00:00Z"}}`, wantProblems: 1},
+		{name: "Mountpoint is a file, should fail", state: `{"file": {"Mountpoint": "` + path.Join(DATAPATH, "file") + `", "CreatedAt": "2024-01-01T00:00:00Z"}}`, wantProblems: 1},
+		{name: "Mountpoint outside of the pools, should fail", state: `{"out": {"Mountpoint": "` + BASEDIR + `", "CreatedAt": "2024-01-01T00:00:00Z"}}`, wantProblems: 1},
+		{name: "Unknown backend, pool and parent, should fail", state: `{"ok": {"Mountpoint": "` + path.Join(DATAPATH, "present") + `", "CreatedAt": "2024-01-01T00:00:00Z", "Backend": "tape", "Pool": "nowhere", "Parent": "nobody"}}`, wantProblems: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path.Join(STATEPATH, STATEFILE), []byte(tt.state), 0600); err != nil {
+				t.Fatal(err)
+			}
+			problems, err := ValidateState(STATEPATH, DATAPATH)
+			if err != nil {
+				t.Fatalf("ValidateState() error = %v", err)
+			}
+			if len(problems) != tt.wantProblems {
+				t.Errorf("ValidateState() = %v, want %d problems", problems, tt.wantProblems)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_ImportState(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "existing", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	exported, err := driver.ExportState()
+	if err != nil {
+		t.Fatalf("localPersistDriver.ExportState() error = %v", err)
+	}
+	if err := os.MkdirAll(path.Join(DATAPATH, "imported"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	imported := `{"imported": {"Mountpoint": "` + path.Join(DATAPATH, "imported") + `", "CreatedAt": "2024-01-01T00:00:00Z", "Mounts": ["stale"],
+		"Backend": "image", "Image": {"Path": "` + path.Join(DATAPATH, "imported.img") + `", "FsType": "ext4", "Size": 1048576, "LoopDevice": "/dev/loop7", "Mounted": true}}}`
+
+	tests := []struct {
+		name    string
+		state   string
+		replace bool
+		wantErr bool
+	}{
+		{name: "Import existing volume, should fail", state: string(exported), wantErr: true},
+		{name: "Replace existing volume, should pass", state: string(exported), replace: true},
+		{name: "Import new volume, should pass", state: imported},
+		{name: "Import missing mountpoint, should fail", state: `{"missing": {"Mountpoint": "` + path.Join(DATAPATH, "missing") + `", "CreatedAt": "2024-01-01T00:00:00Z"}}`, wantErr: true},
+		{name: "Import invalid state, should fail", state: `[]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := driver.ImportState([]byte(tt.state), tt.replace)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("localPersistDriver.ImportState() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, ok := driver.volumes["missing"]; ok {
+		t.Errorf("volume of a failed import was kept")
+	}
+	if v := driver.volumes["imported"]; v == nil || len(v.Mounts) != 0 || v.Image.Mounted || v.Image.LoopDevice != "" {
+		t.Errorf("imported volume = %+v, want it without mounts", v)
+	}
+}
+
+func Test_RequireStopped(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	if err := RequireStopped(STATEPATH); err != nil {
+		t.Errorf("RequireStopped() without admin socket error = %v", err)
+	}
+
+	l, err := net.Listen("unix", path.Join(STATEPATH, ADMINSOCKET))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := RequireStopped(STATEPATH); err == nil {
+		t.Errorf("RequireStopped() with an answering admin socket should give error")
+	}
+	if _, err := ValidateState(STATEPATH, DATAPATH); err == nil {
+		t.Errorf("ValidateState() of a running plugin should give error")
+	}
+	if _, err := Fsck(STATEPATH, DATAPATH, FsckOptions{Repair: true}); err == nil {
+		t.Errorf("Fsck() repairing a running plugin should give error")
+	}
+	if _, err := Fsck(STATEPATH, DATAPATH, FsckOptions{}); err != nil {
+		t.Errorf("Fsck() checking a running plugin error = %v", err)
+	}
+}
+
+func Test_LockState(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	// A plugin holding the lock is running, even when its admin socket does not answer
+	release, err := LockState(STATEPATH)
+	if err != nil {
+		t.Fatalf("LockState() error = %v", err)
+	}
+	if holder, _ := os.ReadFile(path.Join(STATEPATH, STATELOCKFILE)); strings.TrimSpace(string(holder)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("LockState() wrote holder %q, want %d", holder, os.Getpid())
+	}
+	if _, err := LockState(STATEPATH); err == nil {
+		t.Errorf("LockState() of a locked state should give error")
+	}
+	if err := RequireStopped(STATEPATH); err == nil {
+		t.Errorf("RequireStopped() of a locked state should give error")
+	}
+	if _, err := Fsck(STATEPATH, DATAPATH, FsckOptions{Repair: true}); err == nil {
+		t.Errorf("Fsck() repairing a locked state should give error")
+	}
+
+	release()
+	if err := RequireStopped(STATEPATH); err != nil {
+		t.Errorf("RequireStopped() after the release error = %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DEFAULTUSAGESCANINTERVAL is the default time in which every volume with a soft-limit is measured once.
+const DEFAULTUSAGESCANINTERVAL = 10 * time.Minute
+
+// USAGESCANIDLEFACTOR is how many times as long as measuring a volume took the scanner waits
+// before it measures the next one, so that walking large volumes takes at most a tenth of the time.
+const USAGESCANIDLEFACTOR = 9
+
+// SoftLimitUsage is the measured size of a volume compared to its soft-limit option.
+type SoftLimitUsage struct {
+	Limit     uint64    `json:"limit"`
+	Used      uint64    `json:"used"`
+	ScannedAt time.Time `json:"scannedAt"`
+	OverLimit bool      `json:"overLimit"`
+}
+
+// softLimitOption parses the soft-limit create option, zero means no soft-limit.
+func softLimitOption(options map[string]string) (uint64, error) {
+	if options["soft-limit"] == "" {
+		return 0, nil
+	}
+	limit, err := ParseSize(options["soft-limit"])
+	if err != nil {
+		return 0, fmt.Errorf("invalid soft-limit option: %s", err)
+	}
+	return limit, nil
+}
+
+// ScanUsage measures the size of every volume with a soft-limit until the context is cancelled.
+// With metrics enabled every volume is measured, to report its usage. The volumes are measured one
+// at a time, spread over the scan interval, so that the scanner does not cause a burst of IO. When
+// measuring takes long, the scanner waits longer and the interval is stretched.
+func (driver *localPersistDriver) ScanUsage(ctx context.Context) {
+	interval := driver.config.usageScanInterval
+	if interval == 0 {
+		interval = DEFAULTUSAGESCANINTERVAL
+	}
+	if driver.config.MetricsListen != "" {
+		log.Infof("Scanning usage of all volumes every %s", interval)
+	} else {
+		log.Infof("Scanning usage of volumes with a soft-limit every %s", interval)
+	}
+
+	for {
+		names := driver.scannedVolumes()
+
+		pause := interval
+		if len(names) > 0 {
+			pause = interval / time.Duration(len(names))
+		}
+
+		for _, name := range names {
+			start := time.Now()
+			if err := driver.scanVolume(name); err != nil {
+				log.Warnf("Could not scan usage of volume %s: %s", name, err)
+			}
+
+			wait := pause
+			if idle := time.Since(start) * USAGESCANIDLEFACTOR; idle > wait {
+				wait = idle
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if len(names) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pause):
+			}
+		}
+	}
+}
+
+// scannedVolumes returns the volumes ScanUsage measures.
+func (driver *localPersistDriver) scannedVolumes() []string {
+	driver.RLock()
+	defer driver.RUnlock()
+
+	var names []string
+	for name, v := range driver.volumes {
+		if v.SoftLimit > 0 || driver.config.MetricsListen != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scanCopy returns a copy of the fields of the volume that Usage reads, which can be used without
+// the driver lock. The state the fields point to is copied as well, as mounts change it.
+func (v *localPersistVolume) scanCopy() *localPersistVolume {
+	c := &localPersistVolume{
+		Mountpoint: v.Mountpoint,
+		ProjectID:  v.ProjectID,
+		SoftLimit:  v.SoftLimit,
+		Backend:    v.Backend,
+	}
+	if v.Quota != nil {
+		quota := *v.Quota
+		c.Quota = &quota
+	}
+	if v.Image != nil {
+		image := *v.Image
+		c.Image = &image
+	}
+	if v.Overlay != nil {
+		overlay := *v.Overlay
+		c.Overlay = &overlay
+	}
+	if v.View != nil {
+		view := *v.View
+		c.View = &view
+	}
+	return c
+}
+
+// scanVolume measures a single volume and logs when it crosses its soft-limit.
+func (driver *localPersistDriver) scanVolume(name string) error {
+	driver.RLock()
+	v, ok := driver.volumes[name]
+	var snapshot *localPersistVolume
+	if ok {
+		snapshot = v.scanCopy()
+	}
+	driver.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("volume %s not found", name)
+	}
+
+	backend, err := driver.backend(snapshot.Backend)
+	if err != nil {
+		return err
+	}
+	used, _, err := backend.Usage(name, snapshot)
+	if err != nil {
+		return err
+	}
+
+	limit := snapshot.SoftLimit
+	usage := &SoftLimitUsage{Limit: limit, Used: used, ScannedAt: time.Now(), OverLimit: limit > 0 && used > limit}
+
+	driver.usageLock.Lock()
+	defer driver.usageLock.Unlock()
+
+	if driver.usage == nil {
+		driver.usage = map[string]*SoftLimitUsage{}
+	}
+	previous := driver.usage[name]
+	driver.usage[name] = usage
+
+	switch {
+	case limit == 0:
+		log.Debugf("Volume %s uses %d bytes", name, usage.Used)
+	case usage.OverLimit && (previous == nil || !previous.OverLimit):
+		log.Warnf("Volume %s uses %d bytes, which is over its soft-limit of %d bytes", name, usage.Used, limit)
+	case !usage.OverLimit && previous != nil && previous.OverLimit:
+		log.Infof("Volume %s uses %d bytes, which is under its soft-limit of %d bytes again", name, usage.Used, limit)
+	default:
+		log.Debugf("Volume %s uses %d of %d bytes", name, usage.Used, limit)
+	}
+
+	return nil
+}
+
+// softLimitUsage returns the last measured usage of a volume, or nil if it was not scanned yet.
+func (driver *localPersistDriver) softLimitUsage(name string) *SoftLimitUsage {
+	driver.usageLock.Lock()
+	defer driver.usageLock.Unlock()
+
+	return driver.usage[name]
+}
+
+func (driver *localPersistDriver) forgetUsage(name string) {
+	driver.usageLock.Lock()
+	defer driver.usageLock.Unlock()
+
+	delete(driver.usage, name)
+}
+
+// checkSoftLimit returns an error when the volume uses more than RefuseMountRatio times its soft-limit.
+func (driver *localPersistDriver) checkSoftLimit(name string) error {
+	ratio := driver.config.RefuseMountRatio
+	if ratio <= 0 {
+		return nil
+	}
+
+	usage := driver.softLimitUsage(name)
+	if usage == nil || usage.Limit == 0 || float64(usage.Used) <= float64(usage.Limit)*ratio {
+		return nil
+	}
+	return fmt.Errorf("volume %s uses %d bytes, which is more than %.2f times its soft-limit of %d bytes", name, usage.Used, ratio, usage.Limit)
+}
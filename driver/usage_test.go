@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_scanVolume(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	mountpoint := path.Join(DATAPATH, "test-volume")
+	if err := ensureDir(mountpoint, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", mountpoint)
+	}
+
+	driver := &localPersistDriver{
+		Name: "local-persist-test",
+		volumes: map[string]*localPersistVolume{
+			"test-volume": {Mountpoint: mountpoint, SoftLimit: 10},
+		},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{RefuseMountRatio: 2},
+	}
+
+	tests := []struct {
+		name          string
+		size          int
+		wantOverLimit bool
+		wantMountErr  bool
+	}{
+		{name: "Under soft-limit, should mount", size: 5},
+		{name: "Over soft-limit, should mount", size: 15, wantOverLimit: true},
+		{name: "Far over soft-limit, should not mount", size: 25, wantOverLimit: true, wantMountErr: true},
+		{name: "Under soft-limit again, should mount", size: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(path.Join(mountpoint, "data"), make([]byte, tt.size), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := driver.scanVolume("test-volume"); err != nil {
+				t.Fatalf("localPersistDriver.scanVolume() error = %v", err)
+			}
+
+			got, err := driver.Get(&volume.GetRequest{Name: "test-volume"})
+			if err != nil {
+				t.Fatalf("localPersistDriver.Get() error = %v", err)
+			}
+			usage := got.Volume.Status["softLimit"].(*SoftLimitUsage)
+			if usage.Used != uint64(tt.size) || usage.OverLimit != tt.wantOverLimit {
+				t.Errorf("localPersistDriver.Get() soft-limit usage = %+v, want %d bytes and over limit %v", usage, tt.size, tt.wantOverLimit)
+			}
+
+			if _, err := driver.Mount(&volume.MountRequest{Name: "test-volume"}); (err != nil) != tt.wantMountErr {
+				t.Errorf("localPersistDriver.Mount() error = %v, wantErr %v", err, tt.wantMountErr)
+			}
+		})
+	}
+}
+
+func Test_localPersistDriver_ScanUsage(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	mountpoint := path.Join(DATAPATH, "test-volume")
+	if err := ensureDir(mountpoint, 0755); err != nil {
+		t.Fatalf("Could not ensureDir %s", mountpoint)
+	}
+
+	driver := &localPersistDriver{
+		Name: "local-persist-test",
+		volumes: map[string]*localPersistVolume{
+			"test-volume":     {Mountpoint: mountpoint, SoftLimit: 10},
+			"no-limit-volume": {Mountpoint: mountpoint},
+		},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+		config:        Config{usageScanInterval: 10 * time.Millisecond},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	driver.ScanUsage(ctx)
+
+	if driver.softLimitUsage("test-volume") == nil {
+		t.Errorf("localPersistDriver.ScanUsage() did not scan test-volume")
+	}
+	if driver.softLimitUsage("no-limit-volume") != nil {
+		t.Errorf("localPersistDriver.ScanUsage() scanned volume without soft-limit")
+	}
+}
+
+func Test_localPersistVolume_scanCopy(t *testing.T) {
+	v := &localPersistVolume{
+		Mountpoint: "/data/test-volume",
+		SoftLimit:  10,
+		Backend:    BACKENDIMAGE,
+		Image:      &imageState{Path: "/data/test-volume.img", Size: 16},
+		Overlay:    &overlayState{Upper: "/data/upper"},
+		View:       &viewState{Source: "source"},
+		Quota:      &QuotaLimits{Size: 20},
+	}
+	c := v.scanCopy()
+
+	v.Image.Mounted, v.Overlay.Mounted, v.View.Mounted, v.Quota.Size = true, true, true, 30
+	if c.Image.Mounted || c.Overlay.Mounted || c.View.Mounted || c.Quota.Size != 20 {
+		t.Errorf("localPersistVolume.scanCopy() = %+v shares state with the volume", c)
+	}
+	if c.Mountpoint != v.Mountpoint || c.SoftLimit != v.SoftLimit || c.Backend != v.Backend || c.Image.Path != v.Image.Path {
+		t.Errorf("localPersistVolume.scanCopy() = %+v, want the fields of %+v", c, v)
+	}
+}
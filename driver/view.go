@@ -0,0 +1,261 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// BACKENDVIEW is the backend option of read-only views of other volumes.
+const BACKENDVIEW = "view"
+
+// viewState is the state of a read-only view of (a subpath of) another volume.
+type viewState struct {
+	Source  string
+	Subpath string `json:",omitempty"`
+	Mounted bool
+}
+
+// readOnlyOption parses the readonly option of a new volume.
+func readOnlyOption(options map[string]string) (bool, error) {
+	value, ok := options["readonly"]
+	if !ok {
+		return false, nil
+	}
+	readOnly, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid readonly option %q", value)
+	}
+	return readOnly, nil
+}
+
+// viewOptions resolves the view-of option (volume or volume:subpath) of a new volume.
+func (driver *localPersistDriver) viewOptions(options map[string]string) (*viewState, error) {
+	source, subpath, _ := strings.Cut(options["view-of"], ":")
+	if source == "" {
+		return nil, fmt.Errorf("the %s backend needs the view-of option", BACKENDVIEW)
+	}
+
+	view := &viewState{Source: source}
+	if subpath != "" {
+		view.Subpath = filepath.Clean(subpath)
+	}
+	if _, err := driver.viewSource(view); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// viewSource returns the directory presented by a view.
+func (driver *localPersistDriver) viewSource(view *viewState) (string, error) {
+	sv, ok := driver.volumes[view.Source]
+	if !ok {
+		return "", fmt.Errorf("volume %s to view not found", view.Source)
+	}
+	switch sv.Backend {
+	case BACKENDIMAGE, BACKENDOVERLAY, BACKENDVIEW:
+		return "", fmt.Errorf("volumes with the %s backend cannot be viewed", sv.Backend)
+	}
+	if err := requireHot(view.Source, sv); err != nil {
+		return "", err
+	}
+
+	src := sv.Mountpoint
+	if view.Subpath != "" {
+		src = filepath.Join(sv.Mountpoint, view.Subpath)
+		if _, err := isSubDir(sv.Mountpoint, src); err != nil {
+			return "", err
+		}
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("directory %s to view does not exist", src)
+	}
+	return src, nil
+}
+
+// dependents returns the names of the volumes that depend on name: its overlays, views and children.
+func (driver *localPersistDriver) dependents(name string) []string {
+	dependents := []string{}
+	for other, v := range driver.volumes {
+		if (v.Overlay != nil && v.Overlay.Source == name) || (v.View != nil && v.View.Source == name) || v.Parent == name {
+			dependents = append(dependents, other)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// bindReadOnly bind mounts src on dst and makes the bind mount read-only.
+func bindReadOnly(src string, dst string) error {
+	if err := unix.Mount(src, dst, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("could not bind mount %s on %s: %s", src, dst, err)
+	}
+	if err := unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(dst, 0)
+		return fmt.Errorf("could not make %s read-only: %s", dst, err)
+	}
+
+	log.Debugf("Bind mounted %s read-only on %s", src, dst)
+
+	return nil
+}
+
+// isReadOnlyMounted reports whether the topmost mount on path is read-only.
+func isReadOnlyMounted(path string) (bool, error) {
+	options, err := mountOptions(path)
+	return contains(options, "ro"), err
+}
+
+// mountVolume mounts the backend of a volume for its first user and, for read-only volumes,
+// covers the mountpoint with a read-only bind mount of itself.
+func (driver *localPersistDriver) mountVolume(logger *log.Entry, name string, v *localPersistVolume) error {
+	backend, err := driver.backend(v.Backend)
+	if err != nil {
+		return err
+	}
+	if err := backend.Mount(logger, name, v); err != nil {
+		return err
+	}
+
+	if v.ReadOnly && v.View == nil {
+		if err := bindReadOnly(v.Mountpoint, v.Mountpoint); err != nil {
+			backend.Unmount(logger, name, v)
+			return err
+		}
+	}
+	return nil
+}
+
+// unmountVolume undoes mountVolume after the last user is gone.
+func (driver *localPersistDriver) unmountVolume(logger *log.Entry, name string, v *localPersistVolume) error {
+	backend, err := driver.backend(v.Backend)
+	if err != nil {
+		return err
+	}
+
+	if v.ReadOnly && v.View == nil {
+		if err := unix.Unmount(v.Mountpoint, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("could not unmount %s: %s", v.Mountpoint, err)
+		}
+	}
+	return backend.Unmount(logger, name, v)
+}
+
+// viewBackend presents another volume, or a subpath of it, read-only.
+type viewBackend struct {
+	driver *localPersistDriver
+}
+
+func (b viewBackend) Provision(logger *log.Entry, name string, v *localPersistVolume, options map[string]string) error {
+	if options["clone-of"] != "" || options["size"] != "" {
+		return fmt.Errorf("the %s backend does not support the clone-of and size options", BACKENDVIEW)
+	}
+
+	view, err := b.driver.viewOptions(options)
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(v.Mountpoint, 0755); err != nil {
+		return fmt.Errorf("could not create directory %s: %s", v.Mountpoint, err)
+	}
+
+	v.View = view
+	v.ReadOnly = true
+	return nil
+}
+
+func (b viewBackend) Mount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.View == nil {
+		return fmt.Errorf("volume %s is not a view", name)
+	}
+	if v.View.Mounted {
+		return nil
+	}
+
+	src, err := b.driver.viewSource(v.View)
+	if err != nil {
+		return err
+	}
+	if err := bindReadOnly(src, v.Mountpoint); err != nil {
+		return err
+	}
+	v.View.Mounted = true
+
+	logger.Infof("Mounted view of %s on %s", src, v.Mountpoint)
+
+	return nil
+}
+
+func (b viewBackend) Unmount(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.View == nil || !v.View.Mounted {
+		return nil
+	}
+	if err := unix.Unmount(v.Mountpoint, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("could not unmount %s: %s", v.Mountpoint, err)
+	}
+	v.View.Mounted = false
+
+	logger.Infof("Unmounted view from %s", v.Mountpoint)
+
+	return nil
+}
+
+func (b viewBackend) Remove(logger *log.Entry, name string, v *localPersistVolume) error {
+	if v.View != nil && v.View.Mounted {
+		return fmt.Errorf("the view %s is still mounted", name)
+	}
+	return nil
+}
+
+func (b viewBackend) Purge(name string, v *localPersistVolume) error {
+	// The data belongs to the viewed volume, only the empty mountpoint is removed
+	return os.Remove(v.Mountpoint)
+}
+
+func (b viewBackend) Usage(name string, v *localPersistVolume) (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+func (b viewBackend) Snapshot(name string, v *localPersistVolume, dst string) error {
+	return ErrSnapshotNotSupported
+}
+
+// Recover mounts a view that is still in use again and unmounts a view that is not in use.
+func (b viewBackend) Recover(name string, v *localPersistVolume) (bool, error) {
+	if v.View == nil {
+		return false, nil
+	}
+
+	mounted, err := isMounted(v.Mountpoint)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case len(v.Mounts) > 0 && mounted:
+		return false, nil
+
+	case len(v.Mounts) > 0:
+		log.Warnf("Volume %s is in use, but its view is not mounted. Mounting it again", name)
+		v.View.Mounted = false
+		return true, b.Mount(defaultLogger(), name, v)
+
+	default:
+		if mounted {
+			log.Warnf("Volume %s is not in use, but its view is mounted. Unmounting it", name)
+			if err := unix.Unmount(v.Mountpoint, 0); err != nil {
+				return false, fmt.Errorf("could not unmount %s: %s", v.Mountpoint, err)
+			}
+		}
+		changed := v.View.Mounted
+		v.View.Mounted = false
+		return changed, nil
+	}
+}
@@ -0,0 +1,129 @@
+package driver
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_localPersistDriver_Create_view(t *testing.T) {
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "source", Options: map[string]string{}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+	if err := os.MkdirAll(path.Join(driver.volumes["source"].Mountpoint, "sub", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		volume  string
+		options map[string]string
+		wantErr bool
+	}{
+		{name: "View of volume, should pass", volume: "view", options: map[string]string{"view-of": "source"}},
+		{name: "View of subpath, should pass", volume: "sub-view", options: map[string]string{"view-of": "source:sub/dir"}},
+		{name: "View of missing subpath, should fail", volume: "missing-view", options: map[string]string{"view-of": "source:missing"}, wantErr: true},
+		{name: "View of subpath outside volume, should fail", volume: "escape-view", options: map[string]string{"view-of": "source:../.."}, wantErr: true},
+		{name: "View of unknown volume, should fail", volume: "unknown-view", options: map[string]string{"view-of": "unknown"}, wantErr: true},
+		{name: "View of view, should fail", volume: "view-view", options: map[string]string{"view-of": "view"}, wantErr: true},
+		{name: "View with other backend, should fail", volume: "directory-view", options: map[string]string{"view-of": "source", "backend": "directory"}, wantErr: true},
+		{name: "Read-only volume, should pass", volume: "readonly", options: map[string]string{"readonly": "true"}},
+		{name: "Invalid readonly option, should fail", volume: "invalid", options: map[string]string{"readonly": "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := driver.Create(&volume.CreateRequest{Name: tt.volume, Options: tt.options})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("localPersistDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if v := driver.volumes["view"]; v.View == nil || !v.ReadOnly {
+		t.Errorf("localPersistDriver.Create() volume = %+v, want a read-only view", v)
+	}
+	if v := driver.volumes["readonly"]; !v.ReadOnly {
+		t.Errorf("localPersistDriver.Create() volume = %+v, want a read-only volume", v)
+	}
+
+	// The source cannot be removed while it has views
+	if err := driver.Remove(&volume.RemoveRequest{Name: "source"}); err == nil {
+		t.Errorf("localPersistDriver.Remove() of viewed volume should give error")
+	}
+	for _, name := range []string{"view", "sub-view"} {
+		if err := driver.Remove(&volume.RemoveRequest{Name: name}); err != nil {
+			t.Fatalf("localPersistDriver.Remove() error = %v", err)
+		}
+	}
+	if err := driver.Remove(&volume.RemoveRequest{Name: "source"}); err != nil {
+		t.Errorf("localPersistDriver.Remove() error = %v", err)
+	}
+}
+
+func Test_localPersistDriver_Mount_view(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	setupDirs(t)
+	defer cleanupBaseDir()
+
+	driver := &localPersistDriver{
+		Name:          "local-persist-test",
+		volumes:       map[string]*localPersistVolume{},
+		stateFilePath: STATEFILEPATH,
+		dataPath:      DATAPATH,
+	}
+	for _, req := range []*volume.CreateRequest{
+		{Name: "source", Options: map[string]string{}},
+		{Name: "readonly", Options: map[string]string{"readonly": "true"}},
+	} {
+		if err := driver.Create(req); err != nil {
+			t.Fatalf("localPersistDriver.Create() error = %v", err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(driver.volumes["source"].Mountpoint, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(driver.volumes["source"].Mountpoint, "sub", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Create(&volume.CreateRequest{Name: "view", Options: map[string]string{"view-of": "source:sub"}}); err != nil {
+		t.Fatalf("localPersistDriver.Create() error = %v", err)
+	}
+
+	for _, name := range []string{"view", "readonly"} {
+		v := driver.volumes[name]
+		if _, err := driver.Mount(&volume.MountRequest{Name: name, ID: "one"}); err != nil {
+			t.Fatalf("localPersistDriver.Mount() error = %v", err)
+		}
+		if name == "view" {
+			if data, err := os.ReadFile(path.Join(v.Mountpoint, "file")); err != nil || string(data) != "data" {
+				t.Errorf("localPersistDriver.Mount() view contains %q, %v, want data", data, err)
+			}
+		}
+		if err := os.WriteFile(path.Join(v.Mountpoint, "new"), nil, 0644); err == nil {
+			t.Errorf("localPersistDriver.Mount() volume %s is writable", name)
+		}
+		if err := driver.Unmount(&volume.UnmountRequest{Name: name, ID: "one"}); err != nil {
+			t.Fatalf("localPersistDriver.Unmount() error = %v", err)
+		}
+		if mounted, _ := isMounted(v.Mountpoint); mounted {
+			t.Errorf("localPersistDriver.Unmount() did not unmount volume %s", name)
+		}
+	}
+
+	if data, err := os.ReadFile(path.Join(driver.volumes["source"].Mountpoint, "sub", "file")); err != nil || string(data) != "data" {
+		t.Errorf("source volume contains %q, %v, want data", data, err)
+	}
+}
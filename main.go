@@ -1,31 +1,566 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"os/user"
 	"strconv"
+	"text/tabwriter"
 
 	"github.com/Carbonique/local-persist/driver"
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
 const (
-	stateDir = "/local-persist/state"
+	stateDir = "/var/lib/local-persist"
 	dataDir  = "/local-persist/data"
 )
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsck(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "drift":
+			err = drift(os.Args[2:])
+		case "pools":
+			err = pools(os.Args[2:])
+		case "resize":
+			err = resize(os.Args[2:])
+		case "snapshot":
+			err = snapshot(os.Args[2:])
+		case "purge":
+			err = purge(os.Args[2:])
+		case "reset":
+			err = reset(os.Args[2:])
+		case "cleanup":
+			err = cleanup(os.Args[2:])
+		case "move":
+			err = move(os.Args[2:])
+		case "rename":
+			err = rename(os.Args[2:])
+		case "list":
+			err = list(os.Args[2:])
+		case "inspect":
+			err = inspect(os.Args[2:])
+		case "create":
+			err = create(os.Args[2:])
+		case "forget":
+			err = forget(os.Args[2:])
+		case "adopt":
+			err = adopt(os.Args[2:])
+		case "validate-state":
+			err = validateState(os.Args[2:])
+		case "export-state":
+			err = exportState(os.Args[2:])
+		case "import-state":
+			err = importState(os.Args[2:])
+		case "verify-audit":
+			err = verifyAudit(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %s", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The lock is held as long as the plugin runs, so that the commands changing the state of a
+	// stopped plugin refuse to run next to it, even when the admin API could not be served
+	release, err := driver.LockState(stateDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer release()
+
 	d, err := driver.NewLocalPersistDriver(stateDir, dataDir)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
+	if err := d.Recover(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: could not recover volumes: %v\n", err)
+	}
+
+	go d.ScanUsage(context.Background())
+	go d.ReapExpired(context.Background())
+	go d.ArchiveIdle(context.Background())
+	go func() {
+		if err := d.ServeAdmin(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not serve the admin API: %v\n", err)
+		}
+	}()
+
+	go func() {
+		if err := d.ServeMetrics(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: could not serve metrics: %v\n", err)
+		}
+	}()
+
 	u, _ := user.Lookup("root")
 	uid, _ := strconv.Atoi(u.Uid)
 
-	handler := volume.NewHandler(d)
+	handler := volume.NewHandler(d.Instrumented())
 	fmt.Println(handler.ServeUnix(d.Name, uid))
 }
+
+// drift reports (and optionally resolves) the differences between the state and the data directory.
+func drift(args []string) error {
+	flags, opts := newConnectionFlags("drift")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	adopt := flags.Bool("adopt", false, "register every untracked directory as a volume")
+	trash := flags.Bool("trash", false, "move every untracked directory to the trash")
+	forget := flags.Bool("forget", false, "remove every volume with a missing mountpoint from the state")
+	flags.Parse(args)
+
+	if *adopt && *trash {
+		return fmt.Errorf("-adopt and -trash are mutually exclusive")
+	}
+
+	options := driver.ReconcileOptions{Adopt: *adopt, Trash: *trash, Forget: *forget}
+	actions := *adopt || *trash || *forget
+
+	var report *driver.DriftReport
+	if *opts.offline {
+		if actions {
+			release, err := opts.lockState()
+			if err != nil {
+				return err
+			}
+			defer release()
+		}
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		report, err = d.Reconcile(options)
+		if actions {
+			auditArgs := map[string]string{"adopt": strconv.FormatBool(*adopt), "trash": strconv.FormatBool(*trash), "forget": strconv.FormatBool(*forget)}
+			audited(*opts.state, "reconcile", "", auditArgs, err)
+		}
+		if err != nil {
+			return err
+		}
+	} else if actions {
+		if err := adminCall(*opts.socket, http.MethodPost, "/reconcile", options, &report); err != nil {
+			return err
+		}
+	} else if err := adminCall(*opts.socket, http.MethodGet, "/drift", nil, &report); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
+
+// fsck checks the state and data of a stopped plugin and optionally repairs them. It returns the
+// exit code: 0 when clean, 1 when every issue was repaired, 4 when issues are left, 8 on errors.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	state := flags.String("state", stateDir, "directory containing the plugin state")
+	data := flags.String("data", dataDir, "directory containing the volume data")
+	repair := flags.Bool("repair", false, "apply the automatic repairs")
+	dryRun := flags.Bool("dry-run", false, "show the repairs and the change of the state file without applying them")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	report, err := driver.Fsck(*state, *data, driver.FsckOptions{Repair: *repair, DryRun: *dryRun})
+	if *repair && !*dryRun {
+		audited(*state, "fsck-repair", "", nil, err)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return driver.FSCKERROR
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return driver.FSCKERROR
+	}
+	return report.ExitCode()
+}
+
+// pools prints the size and free space of every pool.
+func pools(args []string) error {
+	flags := flag.NewFlagSet("pools", flag.ExitOnError)
+	state := flags.String("state", stateDir, "directory containing the plugin state")
+	data := flags.String("data", dataDir, "directory containing the volume data")
+	asJSON := flags.Bool("json", false, "print the pools as JSON")
+	flags.Parse(args)
+
+	d, err := driver.NewLocalPersistDriver(*state, *data)
+	if err != nil {
+		return err
+	}
+
+	infos, err := d.Pools()
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "POOL\tPATH\tSIZE\tFREE\tVOLUMES\n")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", info.Name, info.Path, info.Size, info.Free, info.Volumes)
+	}
+	return tw.Flush()
+}
+
+// resize changes the project quota limits of a volume created with a size.
+func resize(args []string) error {
+	flags, opts := newConnectionFlags("resize")
+	size := flags.String("size", "", "hard limit of the size, e.g. 10G, 0 removes it")
+	softSize := flags.String("soft-size", "", "soft limit of the size, 0 removes it")
+	inodes := flags.String("inodes", "", "hard limit of the number of inodes, 0 removes it")
+	softInodes := flags.String("soft-inodes", "", "soft limit of the number of inodes, 0 removes it")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist resize [flags] <volume>")
+	}
+
+	// Limits without a flag are kept
+	var change driver.QuotaChange
+	for _, option := range []struct {
+		name   string
+		value  string
+		parse  func(string) (uint64, error)
+		target **uint64
+	}{
+		{"size", *size, driver.ParseSize, &change.Size},
+		{"soft-size", *softSize, driver.ParseSize, &change.SoftSize},
+		{"inodes", *inodes, parseCount, &change.Inodes},
+		{"soft-inodes", *softInodes, parseCount, &change.SoftInodes},
+	} {
+		if option.value == "" {
+			continue
+		}
+		n, err := option.parse(option.value)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %s", option.name, err)
+		}
+		*option.target = &n
+	}
+
+	if !*opts.offline {
+		return adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "resize"), change, nil)
+	}
+	release, err := opts.lockState()
+	if err != nil {
+		return err
+	}
+	defer release()
+	d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+	if err != nil {
+		return err
+	}
+	auditArgs := map[string]string{"size": *size, "softSize": *softSize, "inodes": *inodes, "softInodes": *softInodes}
+	return audited(*opts.state, "resize", flags.Arg(0), auditArgs, d.Resize(flags.Arg(0), change))
+}
+
+func parseCount(s string) (uint64, error) {
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// snapshot creates, lists or deletes the snapshots of a volume.
+func snapshot(args []string) error {
+	flags, opts := newConnectionFlags("snapshot")
+	list := flags.Bool("list", false, "list the snapshots of the volume")
+	del := flags.Bool("delete", false, "delete the snapshot")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: local-persist snapshot [flags] <volume> [snapshot]")
+	}
+
+	if !*opts.offline {
+		switch {
+		case *list:
+			var snapshots []string
+			if err := adminCall(*opts.socket, http.MethodGet, volumePath(flags.Arg(0), "snapshots"), nil, &snapshots); err != nil {
+				return err
+			}
+			for _, s := range snapshots {
+				fmt.Println(s)
+			}
+			return nil
+		case *del:
+			return adminCall(*opts.socket, http.MethodDelete, volumePath(flags.Arg(0), "snapshots", flags.Arg(1)), nil, nil)
+		default:
+			var res struct {
+				Name string `json:"name"`
+			}
+			if err := adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "snapshots"), map[string]string{"name": flags.Arg(1)}, &res); err != nil {
+				return err
+			}
+			fmt.Println(res.Name)
+			return nil
+		}
+	}
+
+	if !*list {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *list:
+		snapshots, err := d.Snapshots(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		for _, s := range snapshots {
+			fmt.Println(s)
+		}
+		return nil
+	case *del:
+		return audited(*opts.state, "delete-snapshot", flags.Arg(0), map[string]string{"snapshot": flags.Arg(1)}, d.DeleteSnapshot(flags.Arg(0), flags.Arg(1)))
+	default:
+		name, err := d.Snapshot(flags.Arg(0), flags.Arg(1))
+		if err := audited(*opts.state, "snapshot", flags.Arg(0), map[string]string{"name": name}, err); err != nil {
+			return err
+		}
+		fmt.Println(name)
+		return nil
+	}
+}
+
+// purge removes a volume and deletes its data.
+func purge(args []string) error {
+	flags, opts := newConnectionFlags("purge")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist purge [flags] <volume>")
+	}
+
+	if !*opts.offline {
+		return adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "purge"), nil, nil)
+	}
+	release, err := opts.lockState()
+	if err != nil {
+		return err
+	}
+	defer release()
+	d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+	if err != nil {
+		return err
+	}
+	return audited(*opts.state, "purge", flags.Arg(0), nil, d.Purge(flags.Arg(0)))
+}
+
+// reset discards the changes of an overlay volume.
+func reset(args []string) error {
+	flags, opts := newConnectionFlags("reset")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist reset [flags] <volume>")
+	}
+
+	if !*opts.offline {
+		return adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "reset"), nil, nil)
+	}
+	release, err := opts.lockState()
+	if err != nil {
+		return err
+	}
+	defer release()
+	d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+	if err != nil {
+		return err
+	}
+	return audited(*opts.state, "reset", flags.Arg(0), nil, d.Reset(flags.Arg(0)))
+}
+
+// cleanup deletes the subdirectories of a per-mount volume that belong to mounts which are gone.
+func cleanup(args []string) error {
+	flags, opts := newConnectionFlags("cleanup")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist cleanup [flags] <volume>")
+	}
+
+	var dirs []string
+	if *opts.offline {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		dirs, err = d.CleanMountDirs(flags.Arg(0))
+		if err := audited(*opts.state, "cleanup", flags.Arg(0), nil, err); err != nil {
+			return err
+		}
+	} else {
+		var res struct {
+			Removed []string `json:"removed"`
+		}
+		if err := adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "cleanup"), nil, &res); err != nil {
+			return err
+		}
+		dirs = res.Removed
+	}
+	for _, dir := range dirs {
+		fmt.Println(dir)
+	}
+	return nil
+}
+
+// move relocates a volume to another mountpoint or pool.
+func move(args []string) error {
+	flags, opts := newConnectionFlags("move")
+	pool := flags.String("pool", "", "pool to move the volume to, defaults to the default pool")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("usage: local-persist move [flags] <volume> [mountpoint]")
+	}
+
+	var mountpoint string
+	if *opts.offline {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		mountpoint, err = d.Move(flags.Arg(0), *pool, flags.Arg(1))
+		if err := audited(*opts.state, "move", flags.Arg(0), map[string]string{"pool": *pool, "mountpoint": flags.Arg(1)}, err); err != nil {
+			return err
+		}
+	} else {
+		var res struct {
+			Mountpoint string `json:"mountpoint"`
+		}
+		req := map[string]string{"pool": *pool, "mountpoint": flags.Arg(1)}
+		if err := adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "move"), req, &res); err != nil {
+			return err
+		}
+		mountpoint = res.Mountpoint
+	}
+	fmt.Println(mountpoint)
+	return nil
+}
+
+// rename changes the name of a volume.
+func rename(args []string) error {
+	flags, opts := newConnectionFlags("rename")
+	moveDir := flags.Bool("move-dir", false, "rename the directory of the volume as well, if it is named after the volume")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: local-persist rename [flags] <volume> <new name>")
+	}
+
+	if !*opts.offline {
+		req := map[string]interface{}{"name": flags.Arg(1), "moveDir": *moveDir}
+		return adminCall(*opts.socket, http.MethodPost, volumePath(flags.Arg(0), "rename"), req, nil)
+	}
+	release, err := opts.lockState()
+	if err != nil {
+		return err
+	}
+	defer release()
+	d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+	if err != nil {
+		return err
+	}
+	auditArgs := map[string]string{"name": flags.Arg(1), "moveDir": strconv.FormatBool(*moveDir)}
+	return audited(*opts.state, "rename", flags.Arg(0), auditArgs, d.Rename(flags.Arg(0), flags.Arg(1), *moveDir))
+}
+
+// volumePath returns the admin API path of a volume, followed by the elements.
+func volumePath(name string, elements ...string) string {
+	path := "/volumes/" + url.PathEscape(name)
+	for _, e := range elements {
+		path += "/" + url.PathEscape(e)
+	}
+	return path
+}
+
+// audited records a command that changed the state of a stopped plugin in its audit log, and
+// returns the error of the command.
+func audited(state string, operation string, volume string, args map[string]string, err error) error {
+	actor := fmt.Sprintf("cli uid=%d", os.Getuid())
+	if u, lookupErr := user.Current(); lookupErr == nil {
+		actor += " user=" + u.Username
+	}
+	if _, auditErr := driver.AppendAudit(state, actor, operation, volume, args, err); auditErr != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not write the audit log: %v\n", auditErr)
+	}
+	return err
+}
+
+// verifyAudit checks the hash chain of the audit log and fails when it was changed.
+func verifyAudit(args []string) error {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	state := flags.String("state", stateDir, "directory containing the plugin state")
+	anchor := flags.String("anchor", "", "hash of an entry that has to be in the log, e.g. the head of an earlier verification")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	report, err := driver.VerifyAudit(*state, *anchor)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("the audit log was changed, found %d problems", len(report.Problems))
+	}
+	return nil
+}
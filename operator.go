@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Carbonique/local-persist/driver"
+	"github.com/docker/go-plugins-helpers/volume"
+	"gopkg.in/yaml.v3"
+)
+
+// operatorFlags are the flags shared by the operator subcommands. Without -offline they talk to
+// the admin socket of the running plugin, with -offline they work on the state and data
+// directories of a stopped plugin.
+type operatorFlags struct {
+	state   *string
+	data    *string
+	socket  *string
+	offline *bool
+	format  *string
+}
+
+func newOperatorFlags(name string, defaultFormat string) (*flag.FlagSet, *operatorFlags) {
+	flags, opts := newConnectionFlags(name)
+	opts.format = flags.String("format", defaultFormat, "output format: table, json or yaml")
+	return flags, opts
+}
+
+// newConnectionFlags returns the operator flags without -format, for the commands printing plain results.
+func newConnectionFlags(name string) (*flag.FlagSet, *operatorFlags) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	return flags, &operatorFlags{
+		state:   flags.String("state", stateDir, "directory containing the plugin state"),
+		data:    flags.String("data", dataDir, "directory containing the volume data"),
+		socket:  flags.String("socket", filepath.Join(stateDir, driver.ADMINSOCKET), "admin socket of the running plugin"),
+		offline: flags.Bool("offline", false, "work on the state and data directories of a stopped plugin instead of the admin socket"),
+	}
+}
+
+// lockState locks the state of the stopped plugin for a command changing it with -offline, and
+// fails while the plugin is running. The returned function releases the lock.
+func (opts *operatorFlags) lockState() (func(), error) {
+	return driver.LockState(*opts.state)
+}
+
+// list prints every volume.
+func list(args []string) error {
+	flags, opts := newOperatorFlags("list", "table")
+	flags.Parse(args)
+
+	var infos []driver.VolumeInfo
+	if *opts.offline {
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		infos = d.Volumes()
+	} else if err := adminCall(*opts.socket, http.MethodGet, "/volumes", nil, &infos); err != nil {
+		return err
+	}
+
+	return writeOutput(*opts.format, infos, func(w io.Writer) error {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tPOOL\tBACKEND\tMOUNTS\tMOUNTPOINT\n")
+		for _, info := range infos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", info.Name, info.Pool, info.Backend, info.Mounts, info.Mountpoint)
+		}
+		return tw.Flush()
+	})
+}
+
+// inspect prints the details of volumes.
+func inspect(args []string) error {
+	flags, opts := newOperatorFlags("inspect", "yaml")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("usage: local-persist inspect [flags] <volume>...")
+	}
+
+	var d interface {
+		Volume(string) (driver.VolumeInfo, error)
+	}
+	if *opts.offline {
+		var err error
+		if d, err = driver.NewLocalPersistDriver(*opts.state, *opts.data); err != nil {
+			return err
+		}
+	}
+
+	infos := []driver.VolumeInfo{}
+	for _, name := range flags.Args() {
+		var info driver.VolumeInfo
+		var err error
+		if d != nil {
+			info, err = d.Volume(name)
+		} else {
+			err = adminCall(*opts.socket, http.MethodGet, "/volumes/"+url.PathEscape(name), nil, &info)
+		}
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	return writeOutput(*opts.format, infos, func(w io.Writer) error {
+		for i, info := range infos {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			writeVolumeTable(w, info)
+		}
+		return nil
+	})
+}
+
+// create creates a volume, like docker volume create but without registering it with Docker.
+func create(args []string) error {
+	flags, opts := newOperatorFlags("create", "table")
+	options := map[string]string{}
+	flags.Func("opt", "create option key=value, may be repeated", func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("option %s is not key=value", s)
+		}
+		options[k] = v
+		return nil
+	})
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist create [flags] <volume>")
+	}
+	name := flags.Arg(0)
+
+	var info driver.VolumeInfo
+	if *opts.offline {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		err = d.Create(&volume.CreateRequest{Name: name, Options: options})
+		if err := audited(*opts.state, "create", name, options, err); err != nil {
+			return err
+		}
+		if info, err = d.Volume(name); err != nil {
+			return err
+		}
+	} else if err := adminCall(*opts.socket, http.MethodPost, "/volumes", map[string]interface{}{"name": name, "options": options}, &info); err != nil {
+		return err
+	}
+
+	return writeOutput(*opts.format, info, func(w io.Writer) error {
+		writeVolumeTable(w, info)
+		return nil
+	})
+}
+
+// forget removes a volume from the state, its directory is kept.
+func forget(args []string) error {
+	flags, opts := newOperatorFlags("forget", "table")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist forget [flags] <volume>")
+	}
+
+	if *opts.offline {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		return audited(*opts.state, "forget", flags.Arg(0), nil, d.Forget(flags.Arg(0)))
+	}
+	return adminCall(*opts.socket, http.MethodPost, "/volumes/"+url.PathEscape(flags.Arg(0))+"/forget", nil, nil)
+}
+
+// adopt registers an existing directory in a pool as a volume.
+func adopt(args []string) error {
+	flags, opts := newOperatorFlags("adopt", "table")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: local-persist adopt [flags] <volume> <directory>")
+	}
+	name := flags.Arg(0)
+
+	var info driver.VolumeInfo
+	if *opts.offline {
+		release, err := opts.lockState()
+		if err != nil {
+			return err
+		}
+		defer release()
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		err = d.Adopt(name, flags.Arg(1))
+		if err := audited(*opts.state, "adopt", name, map[string]string{"path": flags.Arg(1)}, err); err != nil {
+			return err
+		}
+		if info, err = d.Volume(name); err != nil {
+			return err
+		}
+	} else if err := adminCall(*opts.socket, http.MethodPost, "/adopt", map[string]string{"name": name, "path": flags.Arg(1)}, &info); err != nil {
+		return err
+	}
+
+	return writeOutput(*opts.format, info, func(w io.Writer) error {
+		writeVolumeTable(w, info)
+		return nil
+	})
+}
+
+// validateState checks the state file of a stopped plugin and fails when it finds problems.
+func validateState(args []string) error {
+	flags := flag.NewFlagSet("validate-state", flag.ExitOnError)
+	state := flags.String("state", stateDir, "directory containing the plugin state")
+	data := flags.String("data", dataDir, "directory containing the volume data")
+	format := flags.String("format", "table", "output format: table, json or yaml")
+	flags.Parse(args)
+
+	problems, err := driver.ValidateState(*state, *data)
+	if err != nil {
+		return err
+	}
+
+	err = writeOutput(*format, problems, func(w io.Writer) error {
+		if len(problems) == 0 {
+			fmt.Fprintln(w, "No problems found")
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "VOLUME\tPROBLEM\n")
+		for _, p := range problems {
+			fmt.Fprintf(tw, "%s\t%s\n", p.Volume, p.Problem)
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in the state", len(problems))
+	}
+	return nil
+}
+
+// exportState prints the state of every volume.
+func exportState(args []string) error {
+	flags, opts := newOperatorFlags("export-state", "json")
+	flags.Parse(args)
+
+	var state json.RawMessage
+	if *opts.offline {
+		d, err := driver.NewLocalPersistDriver(*opts.state, *opts.data)
+		if err != nil {
+			return err
+		}
+		if state, err = d.ExportState(); err != nil {
+			return err
+		}
+	} else if err := adminCall(*opts.socket, http.MethodGet, "/state", nil, &state); err != nil {
+		return err
+	}
+
+	return writeOutput(*opts.format, state, nil)
+}
+
+// importState adds the volumes of an exported state, in JSON or YAML, to the state of a stopped
+// plugin, holding the state lock while it does.
+func importState(args []string) error {
+	flags := flag.NewFlagSet("import-state", flag.ExitOnError)
+	state := flags.String("state", stateDir, "directory containing the plugin state")
+	data := flags.String("data", dataDir, "directory containing the volume data")
+	replace := flags.Bool("replace", false, "replace existing volumes with the same name")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: local-persist import-state [flags] <file or ->")
+	}
+
+	var raw []byte
+	var err error
+	if flags.Arg(0) == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+
+	// JSON is YAML as well
+	var parsed interface{}
+	if err := yaml.Unmarshal(raw, &parsed); err != nil {
+		return fmt.Errorf("could not parse %s: %s", flags.Arg(0), err)
+	}
+	exported, err := json.Marshal(parsed)
+	if err != nil {
+		return err
+	}
+
+	release, err := driver.LockState(*state)
+	if err != nil {
+		return err
+	}
+	defer release()
+	d, err := driver.NewLocalPersistDriver(*state, *data)
+	if err != nil {
+		return err
+	}
+	names, err := d.ImportState(exported, *replace)
+	auditArgs := map[string]string{"file": flags.Arg(0), "replace": strconv.FormatBool(*replace), "volumes": strings.Join(names, ",")}
+	if err := audited(*state, "import-state", "", auditArgs, err); err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// writeVolumeTable prints a volume as key/value pairs.
+func writeVolumeTable(w io.Writer, info driver.VolumeInfo) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(tw, "Mountpoint:\t%s\n", info.Mountpoint)
+	fmt.Fprintf(tw, "CreatedAt:\t%s\n", info.CreatedAt)
+	fmt.Fprintf(tw, "Pool:\t%s\n", info.Pool)
+	fmt.Fprintf(tw, "Backend:\t%s\n", info.Backend)
+	fmt.Fprintf(tw, "Mounts:\t%d\n", info.Mounts)
+
+	keys := make([]string, 0, len(info.Status))
+	for k := range info.Status {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, _ := json.Marshal(info.Status[k])
+		fmt.Fprintf(tw, "Status.%s:\t%s\n", k, v)
+	}
+	tw.Flush()
+}
+
+// writeOutput prints v in the format. A nil table only supports json and yaml.
+func writeOutput(format string, v interface{}, table func(io.Writer) error) error {
+	switch {
+	case format == "table" && table != nil:
+		return table(os.Stdout)
+
+	case format == "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+
+	case format == "yaml":
+		// Going through JSON keeps the field names and order of the JSON output
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return err
+		}
+		blockStyle(&node)
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(&node); err != nil {
+			return err
+		}
+		return enc.Close()
+
+	default:
+		return fmt.Errorf("unsupported format %s", format)
+	}
+}
+
+// blockStyle resets the flow style and quoting of nodes parsed from JSON.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+// adminCall calls the admin API of the running plugin and decodes the response into res.
+func adminCall(socket string, method string, path string, req interface{}, res interface{}) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	r, err := http.NewRequest(method, "http://local-persist/v"+driver.ADMINAPIVERSION+path, body)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	c := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := c.Do(r)
+	if err != nil {
+		return fmt.Errorf("could not reach the plugin (use -offline for a stopped plugin): %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s", e.Error)
+	}
+
+	if res == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
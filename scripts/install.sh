@@ -2,13 +2,17 @@ TAG=$1
 PLUGIN=ghcr.io/carbonique/local-persist:${TAG}
 STATE_DIR="$(pwd)/test/state"
 DATA_DIR="$(pwd)/test/data"
+POOLS_DIR="$(pwd)/test/pools"
+HOST_DIR="$(pwd)/test/host"
 
 mkdir -p $STATE_DIR
 mkdir -p $DATA_DIR
+mkdir -p $POOLS_DIR
+mkdir -p $HOST_DIR
 
 docker plugin disable ${PLUGIN}
 docker plugin rm ${PLUGIN}
 docker plugin create ${PLUGIN} ./plugin
-docker plugin set ${PLUGIN} data.source=$DATA_DIR state.source=$STATE_DIR
+docker plugin set ${PLUGIN} data.source=$DATA_DIR state.source=$STATE_DIR pools.source=$POOLS_DIR host.source=$HOST_DIR
 docker plugin enable ${PLUGIN}
 